@@ -1,10 +1,12 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
+
 	"github.com/gorilla/websocket"
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
 	"github.com/pion/webrtc/v3"
 )
 
@@ -14,6 +16,22 @@ var upgrader = websocket.Upgrader{
 
 var pc *webrtc.PeerConnection
 
+var writeMutex sync.Mutex
+
+func writeSignal(conn *websocket.Conn, m signaling.Message) {
+	msg, err := signaling.Encode(m)
+	if err != nil {
+		log.Println("Error encoding message:", err)
+		return
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		log.Println("Error writing message:", err)
+	}
+}
+
 func handleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -29,28 +47,33 @@ func handleWebSocketConnection(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		var signal Signal
-		if err := json.Unmarshal(msg, &signal); err != nil {
-			log.Println("Error unmarshalling message:", err)
-			return
+		signal, err := signaling.Decode(msg)
+		if err != nil {
+			log.Println("Rejected message:", err)
+			writeSignal(conn, signaling.AsError(err))
+			continue
 		}
 
-		switch signal.Type {
-		case "offer":
+		switch signal := signal.(type) {
+		case *signaling.Offer:
 			handleOffer(conn, signal)
-		case "answer":
-			handleAnswer(conn, signal)
-		case "candidate":
+		case *signaling.Answer:
+			handleAnswer(signal)
+		case *signaling.Candidate:
 			handleCandidate(signal)
+		case *signaling.Bye:
+			if pc != nil {
+				pc.Close()
+				pc = nil
+			}
 		}
 	}
 }
 
-func handleOffer(conn *websocket.Conn, signal Signal) {
-	offer := webrtc.SessionDescription{}
-	if err := json.Unmarshal([]byte(signal.SDP), &offer); err != nil {
-		log.Println("Error unmarshalling offer:", err)
-		return
+func handleOffer(conn *websocket.Conn, signal *signaling.Offer) {
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  signal.SDP,
 	}
 
 	var err error
@@ -62,12 +85,8 @@ func handleOffer(conn *websocket.Conn, signal Signal) {
 
 	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c != nil {
-			signal := Signal{
-				Type:      "candidate",
-				Candidate: c.ToJSON().Candidate,
-			}
-			msg, _ := json.Marshal(signal)
-			conn.WriteMessage(websocket.TextMessage, msg)
+			candidate := signaling.ICECandidateInit(c.ToJSON())
+			writeSignal(conn, &signaling.Candidate{Candidate: &candidate})
 		}
 	})
 
@@ -91,41 +110,32 @@ func handleOffer(conn *websocket.Conn, signal Signal) {
 		return
 	}
 
-	signal = Signal{
-		Type: "answer",
-		SDP:  answer.SDP,
-	}
-	msg, _ := json.Marshal(signal)
-	conn.WriteMessage(websocket.TextMessage, msg)
+	writeSignal(conn, &signaling.Answer{SDP: answer.SDP})
 }
 
-func handleAnswer(conn *websocket.Conn, signal Signal) {
-	answer := webrtc.SessionDescription{}
-	if err := json.Unmarshal([]byte(signal.SDP), &answer); err != nil {
-		log.Println("Error unmarshalling answer:", err)
+func handleAnswer(signal *signaling.Answer) {
+	if pc == nil {
+		log.Println("Received answer without a peer connection")
 		return
 	}
 
+	answer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  signal.SDP,
+	}
 	if err := pc.SetRemoteDescription(answer); err != nil {
 		log.Println("Error setting remote description:", err)
 	}
 }
 
-func handleCandidate(signal Signal) {
+func handleCandidate(signal *signaling.Candidate) {
 	if pc != nil {
-		candidate := webrtc.ICECandidateInit{
-			Candidate: signal.Candidate,
+		if err := pc.AddICECandidate(webrtc.ICECandidateInit(*signal.Candidate)); err != nil {
+			log.Println("Error adding ICE candidate:", err)
 		}
-		pc.AddICECandidate(candidate)
 	}
 }
 
-type Signal struct {
-	Type      string `json:"type"`
-	SDP       string `json:"sdp"`
-	Candidate string `json:"candidate"`
-}
-
 func main() {
 	http.HandleFunc("/ws", handleWebSocketConnection)
 	log.Fatal(http.ListenAndServe(":8081", nil))
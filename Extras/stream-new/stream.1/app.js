@@ -9,6 +9,12 @@ const playButton = document.querySelector('button#play');
 const downloadButton = document.querySelector('button#download');
 let pc, sendChannel, receiveChannel;
 const signaling = new WebSocket('ws://localhost:8080');
+// Must match signaling.Version on the Go side.
+const SIGNALING_VERSION = 1;
+
+function sendSignal(message) {
+  signaling.send(JSON.stringify({ version: SIGNALING_VERSION, ...message }));
+}
 
 // Data channel elements
 const startButton = document.getElementById('startButton');
@@ -142,7 +148,7 @@ startButton.onclick = async () => {
     sendChannel.onmessage = onReceiveMessage;
 
     const offer = await pc.createOffer();
-    signaling.send(JSON.stringify({ type: 'offer', sdp: offer.sdp }));
+    sendSignal({ type: 'offer', sdp: offer.sdp });
     await pc.setLocalDescription(offer);
 
     console.log('Connection is built');
@@ -154,7 +160,7 @@ startButton.onclick = async () => {
 
 closeButton.onclick = () => {
   hangup();
-  signaling.send(JSON.stringify({ type: 'bye' }));
+  sendSignal({ type: 'bye' });
   console.log('Connection is closed');
 };
 
@@ -162,10 +168,11 @@ function createPeerConnection() {
   return new Promise((resolve, reject) => {
     pc = new RTCPeerConnection();
     pc.onicecandidate = event => {
-      signaling.send(JSON.stringify({
+      if (!event.candidate) return;
+      sendSignal({
         type: 'candidate',
-        candidate: event.candidate ? event.candidate.candidate : null
-      }));
+        candidate: event.candidate.toJSON()
+      });
     };
     pc.ondatachannel = event => {
       receiveChannel = event.channel;
@@ -3,40 +3,102 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/mladenovic-13/pion-webrtc-app/auth"
+	"github.com/mladenovic-13/pion-webrtc-app/config"
+	"github.com/mladenovic-13/pion-webrtc-app/storage"
+	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v4"
 )
 
 const (
-	webPort = ":8080"
+	// reconnectGracePeriod is how long a disconnected peer has to come back,
+	// for example through an ICE restart, before the recording is finalized.
+	reconnectGracePeriod = 15 * time.Second
+
+	// authTimeout is how long a client that did not put its token in the
+	// upgrade request has to send it in an auth message.
+	authTimeout = 10 * time.Second
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+	CheckOrigin:     func(r *http.Request) bool { return auth.AllowsOrigin(r, cfg.Auth.AllowedOrigins) },
 }
 
 var (
+	cfg = config.Default()
+	api *webrtc.API
+
+	// recordings stores the recording files, as configured in cfg.Storage.
+	recordings storage.Sink
+
 	videoDataChannel *webrtc.DataChannel
-	webmFile         *os.File
+	webmFile         storage.Writer
 	webmMutex        sync.Mutex
+	recordingCount   int
 )
 
 func main() {
+	var err error
+	if cfg, err = config.Load(flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if err := os.MkdirAll(cfg.RecordingDir, 0o755); err != nil {
+		log.Fatal("Failed to create recording directory: ", err)
+	}
+	if recordings, err = newRecordingSink(); err != nil {
+		log.Fatal("Failed to set up recording storage: ", err)
+	}
+	if api, err = newWebRTCAPI(); err != nil {
+		log.Fatal("Failed to set up WebRTC: ", err)
+	}
+
 	http.HandleFunc("/ws", handleWebSocket)
-	fs := http.FileServer(http.Dir("./web"))
+	http.HandleFunc("/api/ice-servers", handleICEServers)
+	fs := http.FileServer(http.Dir(cfg.StaticDir))
 	http.Handle("/", fs)
 
-	fmt.Printf("Starting server at http://localhost%s\n", webPort)
-	log.Fatal(http.ListenAndServe(webPort, nil))
+	fmt.Printf("Starting server on %s\n", cfg.Listen)
+	log.Fatal(http.ListenAndServe(cfg.Listen, nil))
+}
+
+// handleICEServers hands the browser the same ICE servers the server uses.
+// They may include TURN credentials, so the request needs the same token as
+// the WebSocket.
+func handleICEServers(w http.ResponseWriter, r *http.Request) {
+	if cfg.Auth.Required() {
+		err := auth.ErrMissingToken
+		if token := auth.FromRequest(r); token != "" {
+			_, err = auth.Verify(token, []byte(cfg.Auth.Secret), time.Now())
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"iceServers": cfg.ICEServers,
+	}); err != nil {
+		log.Println("Failed to write ICE servers:", err)
+	}
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
@@ -47,12 +109,36 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
+	claims, err := authenticate(conn, r)
+	if err != nil {
+		log.Printf("Rejected WebSocket from %s: %v", r.RemoteAddr, err)
+		conn.WriteJSON(map[string]string{"type": "error", "message": err.Error()})
+		return
+	}
+
 	peerConnection, err := createPeerConnection()
 	if err != nil {
 		log.Println("Failed to create PeerConnection:", err)
 		return
 	}
 
+	// The connection's ID only names its recordings.
+	id := make([]byte, 8)
+	rand.Read(id)
+	sessionID := hex.EncodeToString(id)
+	var subject string
+	if claims != nil {
+		subject = claims.Subject
+	}
+
+	if claims != nil && claims.Duration() > 0 {
+		limit := time.AfterFunc(claims.Duration(), func() {
+			log.Printf("Session reached its time limit of %s", claims.Duration())
+			peerConnection.Close()
+		})
+		defer limit.Stop()
+	}
+
 	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate == nil {
 			return
@@ -95,7 +181,11 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 			}
 			handleCandidate(peerConnection, candidate)
 		case "start-recording":
-			startRecording()
+			if claims != nil && !claims.Record {
+				conn.WriteJSON(map[string]string{"type": "error", "message": "recording is not permitted"})
+				continue
+			}
+			startRecording(sessionID, subject)
 			conn.WriteJSON(map[string]string{"type": "recording-started"})
 		case "stop-recording":
 			stopRecording()
@@ -104,6 +194,33 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// authenticate verifies the token in the upgrade request or, if there is
+// none, in a first {"type": "auth", "token": "..."} message. Without an auth
+// secret every client is let in, with nil claims.
+func authenticate(conn *websocket.Conn, r *http.Request) (*auth.Claims, error) {
+	if !cfg.Auth.Required() {
+		return nil, nil
+	}
+
+	token := auth.FromRequest(r)
+	if token == "" {
+		conn.SetReadDeadline(time.Now().Add(authTimeout))
+		var msg struct {
+			Type  string `json:"type"`
+			Token string `json:"token"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != "auth" {
+			return nil, auth.ErrMissingToken
+		}
+		conn.SetReadDeadline(time.Time{})
+		token = msg.Token
+	}
+	if token == "" {
+		return nil, auth.ErrMissingToken
+	}
+	return auth.Verify(token, []byte(cfg.Auth.Secret), time.Now())
+}
+
 func handleOffer(peerConnection *webrtc.PeerConnection, conn *websocket.Conn, sdp string) {
 	offer := webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
@@ -153,38 +270,95 @@ func handleCandidate(peerConnection *webrtc.PeerConnection, candidateInit map[st
 	}
 }
 
+// newWebRTCAPI builds an API with pion's default codecs and interceptors, as
+// webrtc.NewPeerConnection would, and pion's logging at the configured level.
+func newWebRTCAPI() (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(webrtc.SettingEngine{LoggerFactory: cfg.LoggerFactory()}),
+	), nil
+}
+
 func createPeerConnection() (*webrtc.PeerConnection, error) {
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+	iceServers := make([]webrtc.ICEServer, 0, len(cfg.ICEServers))
+	for _, server := range cfg.ICEServers {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
 	}
 
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: iceServers,
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	peerConnection.OnDataChannel(handleDataChannel)
 
+	var (
+		graceMutex   sync.Mutex
+		graceTimer   *time.Timer
+		shutdownOnce sync.Once
+	)
+
+	// Both the grace timer and a failed or closed connection shut down, and
+	// closing the PeerConnection reports Closed again, so only the first
+	// call does anything.
+	shutdown := func() {
+		shutdownOnce.Do(func() {
+			stopRecording()
+
+			if err := peerConnection.Close(); err != nil {
+				log.Println("Error closing peer connection:", err)
+			}
+
+			os.Exit(0)
+		})
+	}
+
 	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
 		fmt.Println("[STATE] ICE Connection State has changed:", state.String())
 
+		graceMutex.Lock()
+		defer graceMutex.Unlock()
+
 		if state == webrtc.ICEConnectionStateConnected || state == webrtc.ICEConnectionStateCompleted {
 			fmt.Println("[STATE] WebRTC connection successfully established.")
+			if graceTimer != nil {
+				graceTimer.Stop()
+				graceTimer = nil
+			}
 		}
 
-		if state == webrtc.ICEConnectionStateFailed || state == webrtc.ICEConnectionStateDisconnected {
-			fmt.Println("[STATE] Connection failed or disconnected.")
-			stopRecording()
-
-			if err := peerConnection.Close(); err != nil {
-				log.Println("Error closing peer connection:", err)
-			}
+		// The browser restarts ICE when the connection drops, so the
+		// recording is only finalized if that does not work out.
+		if state == webrtc.ICEConnectionStateDisconnected && graceTimer == nil {
+			fmt.Printf("[STATE] Connection interrupted, waiting %s for the peer to reconnect.\n", reconnectGracePeriod)
+			graceTimer = time.AfterFunc(reconnectGracePeriod, func() {
+				fmt.Println("[STATE] Peer did not reconnect.")
+				shutdown()
+			})
+		}
 
-			os.Exit(0)
+		if state == webrtc.ICEConnectionStateFailed || state == webrtc.ICEConnectionStateClosed {
+			fmt.Println("[STATE] Connection failed or closed.")
+			// Closing the PeerConnection from the ICE agent's own goroutine
+			// would wait on itself.
+			go shutdown()
 		}
 	})
 
@@ -227,7 +401,9 @@ func handleVideoData(data []byte) {
 	}
 }
 
-func startRecording() {
+// startRecording creates the next recording file of the session, named
+// from cfg.RecordingName.
+func startRecording(sessionID, subject string) {
 	webmMutex.Lock()
 	defer webmMutex.Unlock()
 
@@ -236,14 +412,53 @@ func startRecording() {
 		return
 	}
 
+	recordingCount++
+	name := cfg.RecordingFile(sessionID, subject, strconv.Itoa(recordingCount), time.Now())
 	var err error
-	webmFile, err = os.Create("output.webm")
+	webmFile, err = recordings.Create(name)
 	if err != nil {
 		log.Println("Error creating WebM file:", err)
 		return
 	}
 
-	log.Println("Started recording")
+	log.Println("Started recording into", name)
+}
+
+// newRecordingSink returns the storage configured in cfg.Storage, encrypting
+// what it stores if a master key is configured.
+func newRecordingSink() (storage.Sink, error) {
+	var sink storage.Sink = storage.NewLocal(cfg.RecordingDir)
+	if cfg.Storage.Type == config.StorageS3 {
+		s3 := cfg.Storage.S3
+		var err error
+		sink, err = storage.NewS3(storage.S3Config{
+			Endpoint:        s3.Endpoint,
+			Region:          s3.Region,
+			Bucket:          s3.Bucket,
+			Prefix:          s3.Prefix,
+			AccessKeyID:     s3.AccessKeyID,
+			SecretAccessKey: s3.SecretAccessKey,
+			SessionToken:    s3.SessionToken,
+			PathStyle:       s3.PathStyle,
+			PartSize:        int(s3.PartSize),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !cfg.Storage.Encryption.Enabled() {
+		return sink, nil
+	}
+	masterKey, err := cfg.Storage.Encryption.MasterKey()
+	if err != nil {
+		return nil, fmt.Errorf("encryption key: %w", err)
+	}
+	key, err := storage.NewMasterKey(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewEncrypted(sink, key), nil
 }
 
 func stopRecording() {
@@ -1,23 +1,20 @@
-module github.com/mladenovic-13/pion-webrtc-app
+module stream
 
 go 1.21.6
 
 require (
 	github.com/gorilla/websocket v1.5.3
+	github.com/mladenovic-13/pion-webrtc-app v0.0.0
 	github.com/pion/interceptor v0.1.30
+	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/webrtc/v4 v4.0.0-beta.29 // Use the latest version
 )
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/pion/datachannel v1.5.9 // indirect
-	github.com/pion/dtls/v2 v2.2.7 // indirect
 	github.com/pion/dtls/v3 v3.0.2 // indirect
-	github.com/pion/ice/v3 v3.0.0 // indirect
 	github.com/pion/ice/v4 v4.0.1 // indirect
-	github.com/pion/logging v0.2.2 // indirect
-	github.com/pion/mdns v0.0.8 // indirect
 	github.com/pion/mdns/v2 v2.0.7 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
 	github.com/pion/rtcp v1.2.14 // indirect
@@ -25,17 +22,13 @@ require (
 	github.com/pion/sctp v1.8.33 // indirect
 	github.com/pion/sdp/v3 v3.0.9 // indirect
 	github.com/pion/srtp/v3 v3.0.3 // indirect
-	github.com/pion/stun v0.6.1 // indirect
 	github.com/pion/stun/v3 v3.0.0 // indirect
-	github.com/pion/transport/v2 v2.2.3 // indirect
 	github.com/pion/transport/v3 v3.0.7 // indirect
-	github.com/pion/turn/v3 v3.0.0 // indirect
 	github.com/pion/turn/v4 v4.0.0 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.9.0 // indirect
 	github.com/wlynxg/anet v0.0.4 // indirect
 	golang.org/x/crypto v0.27.0 // indirect
 	golang.org/x/net v0.29.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/mladenovic-13/pion-webrtc-app => ../..
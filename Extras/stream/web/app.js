@@ -13,6 +13,8 @@ let isRecording = false;
 let mediaRecorder;
 let recordedChunks = [];
 let isVideoDataChannelOpen = false;
+// Servers that require a token get it from ?token=
+const authToken = new URLSearchParams(window.location.search).get("token");
 
 async function joinSession() {
   const name = document.getElementById("name").value;
@@ -28,9 +30,7 @@ async function joinSession() {
 }
 
 async function setupWebRTCConnection() {
-  peerConnection = new RTCPeerConnection({
-    iceServers: [{ urls: "stun:stun.l.google.com:19302" }]
-  });
+  peerConnection = new RTCPeerConnection({ iceServers: await fetchIceServers() });
 
   peerConnection.ondatachannel = handleDataChannel;
 
@@ -39,6 +39,9 @@ async function setupWebRTCConnection() {
 
     ws.onopen = async () => {
       isWebSocketConnected = true;
+      if (authToken) {
+        ws.send(JSON.stringify({ type: "auth", token: authToken }));
+      }
       await setupLocalStream();
     };
 
@@ -87,8 +90,15 @@ async function setupWebRTCConnection() {
         console.log("[STATE] WebRTC connection successfully established.");
       }
 
-      if (peerConnection.iceConnectionState === "failed" || peerConnection.iceConnectionState === "disconnected") {
-        console.log("[STATE] WebRTC connection failed or disconnected.");
+      if (peerConnection.iceConnectionState === "disconnected" && isWebSocketConnected) {
+        // The server waits a while for us, so try to recover with new ICE
+        // credentials before giving up
+        console.log("[STATE] WebRTC connection interrupted, restarting ICE.");
+        restartIce();
+      }
+
+      if (peerConnection.iceConnectionState === "failed") {
+        console.log("[STATE] WebRTC connection failed.");
         alert("WebRTC connection failed. Please refresh the page to try again.");
         cleanupConnection();
       }
@@ -162,6 +172,34 @@ async function setupLocalStream() {
   }
 }
 
+async function restartIce() {
+  try {
+    const offer = await peerConnection.createOffer({ iceRestart: true });
+    await peerConnection.setLocalDescription(offer);
+
+    ws.send(JSON.stringify({ type: "offer", sdp: offer.sdp }));
+  } catch (err) {
+    console.error("Error restarting ICE:", err);
+  }
+}
+
+// The server hands out the ICE servers it uses itself, TURN included.
+async function fetchIceServers() {
+  try {
+    // The list may hold TURN credentials, so it takes the same token as
+    // the WebSocket.
+    const headers = authToken ? { Authorization: `Bearer ${authToken}` } : {};
+    const response = await fetch("/api/ice-servers", { headers });
+    if (!response.ok) {
+      throw new Error(`HTTP ${response.status}`);
+    }
+    return (await response.json()).iceServers;
+  } catch (err) {
+    console.error("Failed to fetch ICE servers, using host candidates only:", err);
+    return [];
+  }
+}
+
 function startSendingVideoData(stream) {
   mediaRecorder = new MediaRecorder(stream, { mimeType: 'video/webm;codecs=vp8,opus' });
 
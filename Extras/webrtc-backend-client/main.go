@@ -1,23 +1,56 @@
 package main
 
 import (
+    "errors"
+    "flag"
     "fmt"
-    // "io"
+    "io"
     "log"
     "os"
     "os/signal"
+    "path/filepath"
+    "strings"
+    "sync"
     "time"
-    "github.com/go-audio/audio"
-    "github.com/go-audio/wav"
     "github.com/gorilla/websocket"
+    "github.com/mladenovic-13/pion-webrtc-app/config"
+    "github.com/mladenovic-13/pion-webrtc-app/signaling"
+    "github.com/pion/interceptor"
     "github.com/pion/webrtc/v3"
+    "github.com/pion/webrtc/v3/pkg/media/oggwriter"
 )
 
-// SignalMessage represents the structure of messages exchanged with the signaling server
-type SignalMessage struct {
-    Type      string                     `json:"type"`
-    SDP       *webrtc.SessionDescription `json:"sdp,omitempty"`
-    Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+// writeMutex serializes writes to the signaling connection
+var writeMutex sync.Mutex
+
+// remotePeer is the room peer that sent the current offer
+var (
+    remotePeerMutex sync.Mutex
+    remotePeer      string
+)
+
+func setRemotePeer(id string) {
+    remotePeerMutex.Lock()
+    defer remotePeerMutex.Unlock()
+    remotePeer = id
+}
+
+func getRemotePeer() string {
+    remotePeerMutex.Lock()
+    defer remotePeerMutex.Unlock()
+    return remotePeer
+}
+
+// writeSignal encodes a signaling message and sends it through the signaling
+// server to the peer named by to. Messages for the server itself have no to.
+func writeSignal(conn *websocket.Conn, to string, message signaling.Message) error {
+    data, err := signaling.EncodeRoute(message, signaling.Route{To: to})
+    if err != nil {
+        return err
+    }
+    writeMutex.Lock()
+    defer writeMutex.Unlock()
+    return conn.WriteMessage(websocket.TextMessage, data)
 }
 
 // logWithTimestamp logs a message with a timestamp
@@ -26,13 +59,25 @@ func logWithTimestamp(message string) {
 }
 
 func main() {
+    serverURL := flag.String("server", "ws://localhost:3000/ws", "signaling server WebSocket URL")
+    room := flag.String("room", "audio", "room to join on the signaling server")
+    peerID := flag.String("peer", "receiver", "peer ID to register as in the room")
+    // The ICE servers, recording directory and log level come from the
+    // shared configuration; the listen settings are unused here
+    cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+    if err != nil {
+        log.Fatal("Invalid configuration: ", err)
+    }
+    if err := os.MkdirAll(cfg.RecordingDir, 0o755); err != nil {
+        log.Fatal("Failed to create recording directory: ", err)
+    }
+
     log.SetFlags(log.LstdFlags | log.Lmicroseconds)
     logWithTimestamp("Starting WebRTC audio receiver...")
 
     // Connect to the signaling server
-    serverURL := "ws://localhost:3000"
-    logWithTimestamp(fmt.Sprintf("Connecting to signaling server at: %s", serverURL))
-    conn, _, err := websocket.DefaultDialer.Dial(serverURL, nil)
+    logWithTimestamp(fmt.Sprintf("Connecting to signaling server at: %s", *serverURL))
+    conn, _, err := websocket.DefaultDialer.Dial(*serverURL, nil)
     if err != nil {
         logWithTimestamp(fmt.Sprintf("WebSocket connection failed: %v", err))
         log.Fatal(err)
@@ -42,10 +87,21 @@ func main() {
 
     // Create a new WebRTC API
     logWithTimestamp("Creating new WebRTC peer connection...")
-    peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-        ICEServers: []webrtc.ICEServer{
-            {URLs: []string{"stun:stun.l.google.com:19302"}},
-        },
+    api, err := newWebRTCAPI(cfg)
+    if err != nil {
+        logWithTimestamp(fmt.Sprintf("Failed to set up WebRTC: %v", err))
+        log.Fatal(err)
+    }
+    iceServers := make([]webrtc.ICEServer, 0, len(cfg.ICEServers))
+    for _, server := range cfg.ICEServers {
+        iceServers = append(iceServers, webrtc.ICEServer{
+            URLs:       server.URLs,
+            Username:   server.Username,
+            Credential: server.Credential,
+        })
+    }
+    peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
+        ICEServers: iceServers,
     })
     if err != nil {
         logWithTimestamp(fmt.Sprintf("Failed to create peer connection: %v", err))
@@ -58,7 +114,14 @@ func main() {
     setupSignalHandlers(peerConnection, conn)
 
     // Call the handleTrack function to handle incoming audio tracks
-    handleTrack(peerConnection)
+    handleTrack(peerConnection, filepath.Join(cfg.RecordingDir, "received_audio.ogg"))
+
+    // Register with the signaling server so web clients can address us
+    logWithTimestamp(fmt.Sprintf("Joining room %q as %q...", *room, *peerID))
+    if err := writeSignal(conn, "", &signaling.Join{Room: *room, PeerID: *peerID}); err != nil {
+        logWithTimestamp(fmt.Sprintf("Failed to join room: %v", err))
+        log.Fatal(err)
+    }
 
     // Wait for interrupt signal to gracefully close the connection
     interrupt := make(chan os.Signal, 1)
@@ -93,12 +156,8 @@ func setupSignalHandlers(peerConnection *webrtc.PeerConnection, conn *websocket.
             return
         }
         logWithTimestamp(fmt.Sprintf("Received ICE candidate: %v", candidate))
-        candidateJSON := candidate.ToJSON()
-        message := SignalMessage{
-            Type:      "candidate",
-            Candidate: &candidateJSON,
-        }
-        err := conn.WriteJSON(message)
+        candidateJSON := signaling.ICECandidateInit(candidate.ToJSON())
+        err := writeSignal(conn, getRemotePeer(), &signaling.Candidate{Candidate: &candidateJSON})
         if err != nil {
             logWithTimestamp(fmt.Sprintf("Error sending ICE candidate: %v", err))
         } else {
@@ -110,24 +169,44 @@ func setupSignalHandlers(peerConnection *webrtc.PeerConnection, conn *websocket.
     go func() {
         for {
             logWithTimestamp("Waiting for WebSocket message...")
-            var message SignalMessage
-            err := conn.ReadJSON(&message)
+            _, data, err := conn.ReadMessage()
             if err != nil {
                 logWithTimestamp(fmt.Sprintf("Error reading message: %v", err))
                 return
             }
-            logWithTimestamp(fmt.Sprintf("Received message of type: %s", message.Type))
-            handleSignalingMessage(peerConnection, conn, &message)
+            message, route, err := signaling.DecodeRoute(data)
+            if err != nil {
+                logWithTimestamp(fmt.Sprintf("Rejected message: %v", err))
+                if route.From != "" {
+                    if err := writeSignal(conn, route.From, signaling.AsError(err)); err != nil {
+                        logWithTimestamp(fmt.Sprintf("Error sending error reply: %v", err))
+                    }
+                }
+                continue
+            }
+            logWithTimestamp(fmt.Sprintf("Received message of type: %s", message.Type()))
+            handleSignalingMessage(peerConnection, conn, message, route.From)
         }
     }()
 }
 
-// handleSignalingMessage handles the incoming signaling messages
-func handleSignalingMessage(peerConnection *webrtc.PeerConnection, conn *websocket.Conn, message *SignalMessage) {
-    switch message.Type {
-    case "offer":
-        logWithTimestamp("Processing SDP offer...")
-        err := peerConnection.SetRemoteDescription(*message.SDP)
+// handleSignalingMessage handles the incoming signaling messages. from is the
+// room peer that sent the message, or empty for messages from the server.
+func handleSignalingMessage(peerConnection *webrtc.PeerConnection, conn *websocket.Conn, message signaling.Message, from string) {
+    switch message := message.(type) {
+    case *signaling.Joined:
+        logWithTimestamp(fmt.Sprintf("Joined room %q as %q, other peers: %v", message.Room, message.PeerID, message.Peers))
+    case *signaling.PeerJoined:
+        logWithTimestamp(fmt.Sprintf("Peer %q joined the room", message.PeerID))
+    case *signaling.PeerLeft:
+        logWithTimestamp(fmt.Sprintf("Peer %q left the room", message.PeerID))
+    case *signaling.Offer:
+        logWithTimestamp(fmt.Sprintf("Processing SDP offer from %q...", from))
+        setRemotePeer(from)
+        err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+            Type: webrtc.SDPTypeOffer,
+            SDP:  message.SDP,
+        })
         if err != nil {
             logWithTimestamp(fmt.Sprintf("Error setting remote description: %v", err))
             return
@@ -148,151 +227,96 @@ func handleSignalingMessage(peerConnection *webrtc.PeerConnection, conn *websock
         }
         logWithTimestamp("Local description set successfully")
         logWithTimestamp("Sending answer to web client...")
-        err = conn.WriteJSON(SignalMessage{Type: "answer", SDP: &answer})
+        err = writeSignal(conn, from, &signaling.Answer{SDP: answer.SDP})
         if err != nil {
             logWithTimestamp(fmt.Sprintf("Error sending answer: %v", err))
             return
         }
         logWithTimestamp("Answer sent successfully")
-    case "candidate":
+    case *signaling.Candidate:
         logWithTimestamp("Processing ICE candidate...")
-        if message.Candidate != nil {
-            err := peerConnection.AddICECandidate(*message.Candidate)
-            if err != nil {
-                logWithTimestamp(fmt.Sprintf("Error adding ICE candidate: %v", err))
-                return
-            }
-            logWithTimestamp("ICE candidate added successfully")
+        err := peerConnection.AddICECandidate(webrtc.ICECandidateInit(*message.Candidate))
+        if err != nil {
+            logWithTimestamp(fmt.Sprintf("Error adding ICE candidate: %v", err))
+            return
+        }
+        logWithTimestamp("ICE candidate added successfully")
+    case *signaling.Error:
+        if from == "" {
+            logWithTimestamp(fmt.Sprintf("Signaling server reported error: %s", message.Message))
+        } else {
+            logWithTimestamp(fmt.Sprintf("Peer %q reported error: %s", from, message.Message))
         }
     }
 }
 
-func handleTrack(peerConnection *webrtc.PeerConnection) {
+// newWebRTCAPI builds an API with pion's default codecs and interceptors, as
+// webrtc.NewPeerConnection would, logging at the configured level.
+func newWebRTCAPI(cfg *config.Config) (*webrtc.API, error) {
+    mediaEngine := &webrtc.MediaEngine{}
+    if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+        return nil, err
+    }
+    registry := &interceptor.Registry{}
+    if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+        return nil, err
+    }
+    settingEngine := webrtc.SettingEngine{LoggerFactory: cfg.LoggerFactory()}
+    return webrtc.NewAPI(
+        webrtc.WithMediaEngine(mediaEngine),
+        webrtc.WithInterceptorRegistry(registry),
+        webrtc.WithSettingEngine(settingEngine),
+    ), nil
+}
+
+// handleTrack saves incoming Opus audio tracks to an Ogg Opus file. The RTP
+// payloads are Opus-encoded, so they are stored as Ogg pages rather than
+// being treated as PCM samples. The Ogg writer derives each page's granule
+// position from the RTP timestamps, which are in 48 kHz units for Opus.
+func handleTrack(peerConnection *webrtc.PeerConnection, path string) {
     // When an incoming track is detected, handle the track
     peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-        logWithTimestamp(fmt.Sprintf("New incoming track received of type: %s", track.Kind().String()))
-
-        // Check if the incoming track is audio
-        if track.Kind() == webrtc.RTPCodecTypeAudio {
-            logWithTimestamp("Handling incoming audio track...")
+        codec := track.Codec()
+        logWithTimestamp(fmt.Sprintf("New incoming track received of type: %s (%s)", track.Kind().String(), codec.MimeType))
 
-            // Prepare to write incoming audio to a file
-            outFile, err := os.Create("received_audio.wav")
-            if err != nil {
-                logWithTimestamp(fmt.Sprintf("Error creating audio file: %v", err))
-                return
-            }
-            defer outFile.Close()
+        // Check if the incoming track is Opus audio
+        if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus) {
+            logWithTimestamp("Received non-Opus track, ignoring...")
+            return
+        }
+        logWithTimestamp("Handling incoming audio track...")
 
-            // Set up WAV encoder
-            enc := wav.NewEncoder(outFile, 48000, 16, 1, 1) // Example for mono audio, 48kHz sample rate
+        // Opus always runs at 48 kHz, the channel count comes from the SDP
+        channels := codec.Channels
+        if channels == 0 {
+            channels = 2
+        }
+        oggFile, err := oggwriter.New(path, codec.ClockRate, channels)
+        if err != nil {
+            logWithTimestamp(fmt.Sprintf("Error creating audio file: %v", err))
+            return
+        }
 
-            // Receive audio packets
-            audioBuf := &audio.IntBuffer{Data: make([]int, 0), Format: &audio.Format{SampleRate: 48000, NumChannels: 1}}
-            for {
-                // Read RTP packets
-                pkt, _, err := track.ReadRTP()
-                if err != nil {
+        // Receive audio packets until the track ends
+        for {
+            pkt, _, err := track.ReadRTP()
+            if err != nil {
+                if !errors.Is(err, io.EOF) {
                     logWithTimestamp(fmt.Sprintf("Error reading RTP packets: %v", err))
-                    break
-                }
-
-                // Decode audio data and append to buffer
-                for i := 0; i < len(pkt.Payload); i += 2 {
-                    sample := int16(pkt.Payload[i+1])<<8 | int16(pkt.Payload[i])
-                    audioBuf.Data = append(audioBuf.Data, int(sample))
-                }
-
-                // Write data to WAV file in chunks
-                if err := enc.Write(audioBuf); err != nil {
-                    logWithTimestamp(fmt.Sprintf("Error writing audio data to file: %v", err))
-                    break
                 }
-                audioBuf.Data = audioBuf.Data[:0] // Reset buffer
+                break
             }
 
-            // Finalize the WAV file
-            if err := enc.Close(); err != nil {
-                logWithTimestamp(fmt.Sprintf("Error closing WAV file encoder: %v", err))
+            if err := oggFile.WriteRTP(pkt); err != nil {
+                logWithTimestamp(fmt.Sprintf("Error writing audio data to file: %v", err))
+                break
             }
-        } else {
-            logWithTimestamp("Received non-audio track, ignoring...")
         }
+
+        // Finalize the Ogg file
+        if err := oggFile.Close(); err != nil {
+            logWithTimestamp(fmt.Sprintf("Error closing Ogg file: %v", err))
+        }
+        logWithTimestamp(fmt.Sprintf("Saved received audio to %s", path))
     })
 }
-
-
-// func handleTrack(peerConnection *webrtc.PeerConnection) {
-//     logWithTimestamp("Setting up track handler...")
-
-//     outputFile, err := os.Create("received_audio.wav")
-//     if err != nil {
-//         logWithTimestamp(fmt.Sprintf("Error creating WAV file: %v", err))
-//         log.Fatal(err)
-//     }
-//     wavEncoder := wav.NewEncoder(outputFile, 48000, 16, 1, 1)
-
-//     peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-//         logWithTimestamp(fmt.Sprintf("Received track with codec: %s", track.Codec().MimeType))
-
-//         if track.Kind() != webrtc.RTPCodecTypeAudio {
-//             logWithTimestamp("Non-audio track received, ignoring...")
-//             return
-//         }
-
-//         const targetSampleSize = 480 // Number of samples (shorts) we want to buffer
-//         buffer := make([]int, 0, targetSampleSize)
-
-//         for {
-//             rtp, _, readErr := track.ReadRTP()
-//             if readErr != nil {
-//                 if readErr == io.EOF {
-//                     logWithTimestamp("End of audio stream")
-//                     break
-//                 }
-//                 logWithTimestamp(fmt.Sprintf("Error reading RTP packet: %v", readErr))
-//                 break
-//             }
-
-//             // Convert RTP payload to samples
-//             for i := 0; i < len(rtp.Payload)-1; i += 2 {
-//                 sample := int16(rtp.Payload[i]) | int16(rtp.Payload[i+1])<<8
-//                 buffer = append(buffer, int(sample))
-
-//                 // When buffer reaches targetSampleSize, write to WAV file
-//                 if len(buffer) == targetSampleSize {
-//                     logWithTimestamp(fmt.Sprintf("Writing %d samples to WAV file", len(buffer)))
-//                     if err := wavEncoder.Write(&audio.IntBuffer{Data: buffer, Format: &audio.Format{SampleRate: 48000, NumChannels: 1}}); err != nil {
-//                         logWithTimestamp(fmt.Sprintf("Error writing to WAV file: %v", err))
-//                         return
-//                     }
-//                     buffer = buffer[:0] // Clear buffer
-//                 }
-//             }
-
-//             // Handle the last byte if the payload length is odd
-//             if len(rtp.Payload)%2 != 0 {
-//                 lastByte := int16(rtp.Payload[len(rtp.Payload)-1])
-//                 buffer = append(buffer, int(lastByte))
-//             }
-//         }
-
-//         // Write any remaining samples in the buffer to the WAV file
-//         if len(buffer) > 0 {
-//             logWithTimestamp(fmt.Sprintf("Writing remaining %d samples to WAV file", len(buffer)))
-//             if err := wavEncoder.Write(&audio.IntBuffer{Data: buffer, Format: &audio.Format{SampleRate: 48000, NumChannels: 1}}); err != nil {
-//                 logWithTimestamp(fmt.Sprintf("Error writing to WAV file: %v", err))
-//             }
-//         }
-
-//         logWithTimestamp("Closing WAV encoder")
-//         if err := wavEncoder.Close(); err != nil {
-//             logWithTimestamp(fmt.Sprintf("Error closing WAV encoder: %v", err))
-//         }
-
-//         logWithTimestamp("Closing output file")
-//         if err := outputFile.Close(); err != nil {
-//             logWithTimestamp(fmt.Sprintf("Error closing output file: %v", err))
-//         }
-//     })
-// }
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/mladenovic-13/pion-webrtc-app/signaling/server"
+)
+
+func main() {
+	addr := flag.String("addr", ":3000", "address to listen on")
+	static := flag.String("static", "./public", "directory of static files to serve")
+	flag.Parse()
+
+	http.Handle("/ws", server.New())
+	http.Handle("/", http.FileServer(http.Dir(*static)))
+
+	fmt.Printf("Signaling server listening on %s (WebSocket at /ws)\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
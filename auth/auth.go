@@ -0,0 +1,171 @@
+// Package auth checks who may open a session on the Go servers in this
+// repository: the Origin of WebSocket upgrades, and the tokens that clients
+// present.
+//
+// A token is signed with a secret shared with whatever hands tokens out,
+// usually the application's own backend. Two forms are accepted, both
+// carrying the same JSON claims:
+//
+//	JWT         base64url(header) "." base64url(claims) "." base64url(HMAC-SHA256(secret, header "." claims))
+//	HMAC token  base64url(claims) "." base64url(HMAC-SHA256(secret, claims))
+//
+// JWTs must use the HS256 algorithm. The HMAC form is for backends without a
+// JWT library.
+//
+// Like package signaling, the package does not depend on pion/webrtc.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// QueryParam names the URL query parameter a token may be passed in, as in
+// /ws?token=<token>.
+const QueryParam = "token"
+
+// Errors returned by Verify.
+var (
+	ErrMalformed    = errors.New("malformed token")
+	ErrAlgorithm    = errors.New("token is not signed with HS256")
+	ErrSignature    = errors.New("invalid token signature")
+	ErrExpired      = errors.New("token has expired")
+	ErrNotValidYet  = errors.New("token is not valid yet")
+	ErrMissingToken = errors.New("missing token")
+)
+
+// Claims are what a token permits. Times are in seconds, as in a JWT.
+type Claims struct {
+	// Subject identifies the client, for logging and per-client limits.
+	Subject string `json:"sub,omitempty"`
+	// ExpiresAt and NotBefore bound when the token may be used to open a
+	// session, as Unix times. Zero means no bound.
+	ExpiresAt int64 `json:"exp,omitempty"`
+	NotBefore int64 `json:"nbf,omitempty"`
+	// Room, if set, is the only SFU room the session may join.
+	Room string `json:"room,omitempty"`
+	// MaxDuration, if set, is how many seconds the session may last.
+	MaxDuration int64 `json:"maxDuration,omitempty"`
+	// Record permits the session to record.
+	Record bool `json:"record,omitempty"`
+	// Admin permits the admin API.
+	Admin bool `json:"admin,omitempty"`
+}
+
+// AllowsRoom reports whether the claims permit joining the room name.
+func (c *Claims) AllowsRoom(name string) bool {
+	return c.Room == "" || c.Room == name
+}
+
+// Duration returns MaxDuration as a time.Duration, or zero if it is unset.
+func (c *Claims) Duration() time.Duration {
+	return time.Duration(c.MaxDuration) * time.Second
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Sign returns claims as a JWT signed with secret.
+func Sign(claims *Claims, secret []byte) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + signature(signed, secret), nil
+}
+
+// Verify checks that token was signed with secret and is valid at now, and
+// returns its claims.
+func Verify(token string, secret []byte, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	var signed, payload, sig string
+	switch len(parts) {
+	case 3:
+		header, err := base64.RawURLEncoding.DecodeString(parts[0])
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		var h struct {
+			Algorithm string `json:"alg"`
+		}
+		if err := json.Unmarshal(header, &h); err != nil {
+			return nil, ErrMalformed
+		}
+		// Checking the algorithm is what keeps "none" and public key
+		// algorithms out.
+		if h.Algorithm != "HS256" {
+			return nil, ErrAlgorithm
+		}
+		signed, payload, sig = parts[0]+"."+parts[1], parts[1], parts[2]
+	case 2:
+		signed, payload, sig = parts[0], parts[0], parts[1]
+	default:
+		return nil, ErrMalformed
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(signature(signed, secret))) {
+		return nil, ErrSignature
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var claims Claims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if claims.ExpiresAt != 0 && now.Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return nil, ErrNotValidYet
+	}
+	return &claims, nil
+}
+
+func signature(signed string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// FromRequest returns the token in the Authorization header, as in
+// "Authorization: Bearer <token>", or else in the token query parameter. It
+// returns the empty string if there is neither.
+func FromRequest(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get(QueryParam)
+}
+
+// AllowsOrigin reports whether a WebSocket upgrade from r's Origin is
+// allowed. allowed lists origins such as "https://app.example.com", or "*"
+// for any. When it is empty only pages served by the server itself are
+// allowed. Requests without an Origin header do not come from a browser and
+// are always allowed; tokens are what keep other clients out.
+func AllowsOrigin(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(allowed) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
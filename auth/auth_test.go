@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var (
+	secret = []byte("test secret")
+	now    = time.Unix(1_800_000_000, 0)
+)
+
+func encode(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// sign signs header.payload, or payload alone for the HMAC form, the way
+// Sign does.
+func sign(signed string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignVerify(t *testing.T) {
+	claims := &Claims{
+		Subject:     "alice",
+		ExpiresAt:   now.Unix() + 60,
+		NotBefore:   now.Unix() - 60,
+		Room:        "demo",
+		MaxDuration: 3600,
+		Record:      true,
+		Admin:       true,
+	}
+	token, err := Sign(claims, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Verify(token, secret, now)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if *got != *claims {
+		t.Errorf("claims = %+v, want %+v", *got, *claims)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    Claims
+	}{
+		{"empty", `{}`, Claims{}},
+		{"all", `{"sub":"bob","exp":1800000060,"nbf":1799999940,"room":"r","maxDuration":90,"record":true,"admin":true}`,
+			Claims{Subject: "bob", ExpiresAt: 1800000060, NotBefore: 1799999940, Room: "r", MaxDuration: 90, Record: true, Admin: true}},
+		{"unknown claims ignored", `{"sub":"bob","iss":"backend","aud":["stream"]}`, Claims{Subject: "bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwt := sign(jwtHeader+"."+encode(tt.payload), secret)
+			hmacToken := sign(encode(tt.payload), secret)
+			for _, token := range []string{jwt, hmacToken} {
+				got, err := Verify(token, secret, now)
+				if err != nil {
+					t.Fatalf("Verify(%s): %v", token, err)
+				}
+				if *got != tt.want {
+					t.Errorf("claims = %+v, want %+v", *got, tt.want)
+				}
+			}
+		})
+	}
+
+	claims, _ := Verify(sign(encode(`{"maxDuration":90,"room":"r"}`), secret), secret, now)
+	if claims.Duration() != 90*time.Second {
+		t.Errorf("Duration() = %s, want 1m30s", claims.Duration())
+	}
+	if !claims.AllowsRoom("r") || claims.AllowsRoom("other") {
+		t.Errorf("AllowsRoom does not limit the session to room r")
+	}
+	if !(&Claims{}).AllowsRoom("any") {
+		t.Errorf("claims without a room do not allow every room")
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	payload := encode(`{"sub":"alice"}`)
+	valid := sign(jwtHeader+"."+payload, secret)
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"expired", sign(jwtHeader+"."+encode(`{"exp":1800000000}`), secret), ErrExpired},
+		{"long expired", sign(encode(`{"exp":1}`), secret), ErrExpired},
+		{"not valid yet", sign(jwtHeader+"."+encode(`{"nbf":1800000001}`), secret), ErrNotValidYet},
+		{"alg none", encode(`{"alg":"none","typ":"JWT"}`) + "." + payload + ".", ErrAlgorithm},
+		{"alg none signed", sign(encode(`{"alg":"none"}`)+"."+payload, secret), ErrAlgorithm},
+		{"alg RS256", sign(encode(`{"alg":"RS256","typ":"JWT"}`)+"."+payload, secret), ErrAlgorithm},
+		{"alg HS512", sign(encode(`{"alg":"HS512","typ":"JWT"}`)+"."+payload, secret), ErrAlgorithm},
+		{"alg missing", sign(encode(`{"typ":"JWT"}`)+"."+payload, secret), ErrAlgorithm},
+		{"wrong secret", sign(jwtHeader+"."+payload, []byte("other secret")), ErrSignature},
+		{"hmac wrong secret", sign(payload, []byte("other secret")), ErrSignature},
+		{"tampered payload", jwtHeader + "." + encode(`{"sub":"admin"}`) + valid[len(jwtHeader)+1+len(payload):], ErrSignature},
+		{"no signature", jwtHeader + "." + payload + ".", ErrSignature},
+		{"empty", "", ErrMalformed},
+		{"one part", payload, ErrMalformed},
+		{"four parts", valid + ".x", ErrMalformed},
+		{"header not base64", "!!." + payload + ".sig", ErrMalformed},
+		{"header not JSON", encode("HS256") + "." + payload + ".sig", ErrMalformed},
+		{"payload not base64", sign(jwtHeader+".!!", secret), ErrMalformed},
+		{"payload not JSON", sign(jwtHeader+"."+encode("alice"), secret), ErrMalformed},
+		{"claim of wrong type", sign(jwtHeader+"."+encode(`{"exp":"tomorrow"}`), secret), ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := Verify(tt.token, secret, now)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Verify error = %v, want %v", err, tt.want)
+			}
+			if claims != nil {
+				t.Errorf("Verify returned claims %+v with an error", *claims)
+			}
+		})
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		header string
+		want   string
+	}{
+		{"bearer", "/ws", "Bearer abc", "abc"},
+		{"lower case scheme", "/ws", "bearer abc", "abc"},
+		{"header wins", "/ws?token=query", "Bearer header", "header"},
+		{"query", "/ws?token=query", "", "query"},
+		{"other scheme", "/ws?token=query", "Basic dXNlcg==", "query"},
+		{"none", "/ws", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.url, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if got := FromRequest(r); got != tt.want {
+				t.Errorf("FromRequest = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1078 @@
+// Package config loads the settings shared by the Go programs in this
+// repository: the HTTP listen address, the directory of static web files,
+// the directory recordings are written to, the log level and the ICE servers
+// handed to both the Go peers and the browser.
+//
+// Settings come from a JSON file, environment variables and command-line
+// flags, each overriding the one before:
+//
+//	{
+//	  "listen": ":8080",
+//	  "adminListen": "127.0.0.1:8081",
+//	  "staticDir": "./web",
+//	  "recordingDir": "./recordings",
+//	  "recordingName": "{user}/{time}-{session}-{take}.webm",
+//	  "logLevel": "warn",
+//	  "iceServers": [
+//	    {"urls": ["stun:stun.l.google.com:19302"]},
+//	    {"urls": ["turn:turn.example.com:3478"], "username": "user", "credential": "secret"}
+//	  ],
+//	  "ice": {
+//	    "udpListen": ":8443",
+//	    "tcpListen": ":8443",
+//	    "nat1To1IPs": ["203.0.113.10"],
+//	    "networkTypes": ["udp4", "tcp4"],
+//	    "interfaces": ["eth0"],
+//	    "mdns": "disabled"
+//	  },
+//	  "turn": {
+//	    "listen": ":3478",
+//	    "publicIP": "203.0.113.10",
+//	    "relayPorts": "50000-50999",
+//	    "credentialTTL": "12h"
+//	  },
+//	  "tls": {
+//	    "certFile": "cert.pem",
+//	    "keyFile": "key.pem",
+//	    "redirectListen": ":80"
+//	  },
+//	  "auth": {
+//	    "allowedOrigins": ["https://app.example.com"],
+//	    "secret": "..."
+//	  },
+//	  "limits": {
+//	    "maxSessionsPerIP": 4,
+//	    "maxSessionDuration": "2h",
+//	    "maxRecordingSize": "2GiB",
+//	    "maxDiskUsage": "100GiB"
+//	  },
+//	  "storage": {
+//	    "type": "s3",
+//	    "s3": {
+//	      "endpoint": "http://localhost:9000",
+//	      "region": "us-east-1",
+//	      "bucket": "recordings",
+//	      "accessKeyId": "...",
+//	      "secretAccessKey": "...",
+//	      "pathStyle": true
+//	    },
+//	    "encryption": {"keyFile": "master.key"}
+//	  }
+//	}
+//
+// Like package signaling, the package does not depend on pion/webrtc, so
+// that programs built against different major versions can share it.
+// ICEServer has the same fields as webrtc.ICEServer and marshals to the
+// RTCIceServer dictionary the browser expects.
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/logging"
+)
+
+// EnvPrefix starts the name of every environment variable read by Load, as
+// in WEBRTC_LISTEN.
+const EnvPrefix = "WEBRTC_"
+
+// Log levels, from least to most verbose.
+const (
+	LevelError = "error"
+	LevelWarn  = "warn"
+	LevelInfo  = "info"
+	LevelDebug = "debug"
+	LevelTrace = "trace"
+)
+
+var levels = map[string]logging.LogLevel{
+	LevelError: logging.LogLevelError,
+	LevelWarn:  logging.LogLevelWarn,
+	LevelInfo:  logging.LogLevelInfo,
+	LevelDebug: logging.LogLevelDebug,
+	LevelTrace: logging.LogLevelTrace,
+}
+
+// ICEServer is a STUN or TURN server. TURN servers need a username and
+// credential.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Config holds the settings of a program.
+type Config struct {
+	// Listen is the address the HTTP server listens on.
+	Listen string `json:"listen"`
+	// AdminListen is the address the admin API is served on, apart from
+	// Listen so that it is not exposed with the public endpoints. It is a
+	// loopback address by default, and the admin API is disabled when it is
+	// empty.
+	AdminListen string `json:"adminListen"`
+	// StaticDir is the directory of web files served at /.
+	StaticDir string `json:"staticDir"`
+	// RecordingDir is the directory recordings are written to. It is
+	// created if it does not exist.
+	RecordingDir string `json:"recordingDir"`
+	// RecordingName is the template recording files are named by. See
+	// RecordingFile.
+	RecordingName string `json:"recordingName"`
+	// LogLevel sets how much the WebRTC stack logs. At debug and above the
+	// programs also log their own signaling traffic.
+	LogLevel   string        `json:"logLevel"`
+	ICEServers []ICEServer   `json:"iceServers"`
+	ICE        ICEConfig     `json:"ice"`
+	TURN       TURNConfig    `json:"turn"`
+	TLS        TLSConfig     `json:"tls"`
+	Auth       AuthConfig    `json:"auth"`
+	Limits     LimitsConfig  `json:"limits"`
+	Storage    StorageConfig `json:"storage"`
+}
+
+// Storage types accepted in StorageConfig.Type.
+const (
+	StorageLocal = "local"
+	StorageS3    = "s3"
+)
+
+// StorageConfig selects where recordings are stored. See package storage.
+type StorageConfig struct {
+	// Type is StorageLocal, the default, to keep recordings in the
+	// recording directory, or StorageS3 to upload them to a bucket.
+	Type       string           `json:"type"`
+	S3         S3Config         `json:"s3"`
+	Encryption EncryptionConfig `json:"encryption"`
+}
+
+// EncryptionConfig turns on encryption at rest for every recording file,
+// whatever the storage. See storage.MasterKey.
+type EncryptionConfig struct {
+	// Key is the master key, 32 bytes in hex or base64, that wraps the data
+	// key of each file. KeyFile names a file holding it instead, so that
+	// the key does not have to be written into the configuration.
+	Key     string `json:"key"`
+	KeyFile string `json:"keyFile"`
+}
+
+// Enabled reports whether recordings are encrypted.
+func (e *EncryptionConfig) Enabled() bool {
+	return e.Key != "" || e.KeyFile != ""
+}
+
+// MasterKey returns the master key, reading it from KeyFile if that is set.
+func (e *EncryptionConfig) MasterKey() ([]byte, error) {
+	text := e.Key
+	if e.KeyFile != "" {
+		data, err := os.ReadFile(e.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	text = strings.TrimSpace(text)
+
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("the encryption key must be 32 bytes in hex or base64")
+}
+
+// S3Config describes the bucket recordings are uploaded to. Files still
+// being resumed are kept in the recording directory until they are
+// complete.
+type S3Config struct {
+	// Endpoint is the base URL of an S3-compatible store, such as
+	// "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000".
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+	Bucket   string `json:"bucket"`
+	// Prefix is put in front of every recording name, as in "recordings/".
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken"`
+	// PathStyle puts the bucket in the URL path instead of the host name,
+	// as MinIO and most self-hosted stores need.
+	PathStyle bool `json:"pathStyle"`
+	// PartSize is how much of a recording is buffered before it is uploaded
+	// as a part: at least 5MiB, which is the default.
+	PartSize Size `json:"partSize"`
+}
+
+// Placeholders replaced in RecordingName.
+const (
+	NameSession = "{session}"
+	NameUser    = "{user}"
+	NameTime    = "{time}"
+	NameTake    = "{take}"
+)
+
+var namePlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// unsafeNameChars are replaced in the values put into RecordingName, so that
+// a token subject cannot name a file outside the recording directory.
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// RecordingFile returns the name of a recording file: RecordingName with
+// {session} replaced by the session ID, {user} by the client's token
+// subject, or "anonymous" without one, {time} by t in UTC as
+// 20060102T150405Z and {take} by the take number, or "rtp" for the
+// recording of the RTP tracks.
+func (c *Config) RecordingFile(session, user, take string, t time.Time) string {
+	if user == "" {
+		user = "anonymous"
+	}
+	values := map[string]string{
+		NameSession: session,
+		NameUser:    user,
+		NameTime:    t.UTC().Format("20060102T150405Z"),
+		NameTake:    take,
+	}
+	return namePlaceholder.ReplaceAllStringFunc(c.RecordingName, func(placeholder string) string {
+		value := unsafeNameChars.ReplaceAllString(values[placeholder], "_")
+		if strings.Trim(value, ".") == "" {
+			value = "_"
+		}
+		return value
+	})
+}
+
+// LimitsConfig bounds what clients may use of the server. Zero means no
+// limit.
+type LimitsConfig struct {
+	// MaxSessionsPerIP and MaxSessionsPerClient limit the sessions open at
+	// once from one IP address and for one token subject.
+	MaxSessionsPerIP     int `json:"maxSessionsPerIP"`
+	MaxSessionsPerClient int `json:"maxSessionsPerClient"`
+	// MaxSessionDuration ends sessions that last longer. A token may set a
+	// shorter limit.
+	MaxSessionDuration Duration `json:"maxSessionDuration"`
+	// MaxRecordingSize limits what one session writes to the recording
+	// directory, over all its recordings.
+	MaxRecordingSize Size `json:"maxRecordingSize"`
+	// MaxDiskUsage limits the size of the recording directory, which must
+	// not be the working directory then.
+	MaxDiskUsage Size `json:"maxDiskUsage"`
+}
+
+// AuthConfig limits who may open sessions. See package auth.
+type AuthConfig struct {
+	// AllowedOrigins are the origins, such as "https://app.example.com",
+	// whose pages may open a WebSocket; "*" allows any. Only pages served
+	// by the server itself may when it is empty.
+	AllowedOrigins []string `json:"allowedOrigins"`
+	// Secret verifies the tokens clients present. Every session needs a
+	// token signed with it when it is set.
+	Secret string `json:"secret"`
+}
+
+// Required reports whether clients need a token.
+func (a *AuthConfig) Required() bool {
+	return a.Secret != ""
+}
+
+// TLSConfig configures HTTPS for the HTTP server. Browsers only allow
+// getUserMedia on secure origins, which plain HTTP is not unless it is
+// localhost.
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM files with the certificate chain and
+	// its private key. HTTPS is enabled when they are set.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// SelfSigned enables HTTPS with a certificate generated on startup, for
+	// development. Browsers warn about it until it is accepted.
+	SelfSigned bool `json:"selfSigned"`
+	// RedirectListen is an address, such as ":80", where plain HTTP
+	// requests are redirected to HTTPS.
+	RedirectListen string `json:"redirectListen"`
+}
+
+// Enabled reports whether the HTTP server uses HTTPS.
+func (t *TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.SelfSigned
+}
+
+// Network types accepted in ICEConfig.NetworkTypes. "udp" and "tcp" stand
+// for both IP versions.
+var networkTypes = map[string]bool{
+	"udp": true, "udp4": true, "udp6": true,
+	"tcp": true, "tcp4": true, "tcp6": true,
+}
+
+// mDNS modes accepted in ICEConfig.MDNS.
+const (
+	// MDNSDisabled ignores .local candidates from the remote peer.
+	MDNSDisabled = "disabled"
+	// MDNSQuery resolves the remote peer's .local candidates, as browsers
+	// send by default.
+	MDNSQuery = "query"
+	// MDNSGather also hides the server's own host addresses behind .local
+	// names.
+	MDNSGather = "gather"
+)
+
+// ICEConfig configures the stream engine's side of ICE. By default every
+// PeerConnection gathers candidates on ephemeral UDP ports of its own, which
+// is hard to expose from a container.
+type ICEConfig struct {
+	// UDPListen is a UDP address, such as ":8443", that the ICE traffic of
+	// every PeerConnection is multiplexed over instead.
+	UDPListen string `json:"udpListen"`
+	// TCPListen is a TCP address that additionally accepts ICE-TCP
+	// (RFC 6544) from clients that cannot use UDP.
+	TCPListen string `json:"tcpListen"`
+	// NAT1To1IPs are the public IPs of a 1:1 NAT in front of the server,
+	// advertised in candidates of type NAT1To1CandidateType: in place of the
+	// private addresses ("host", the default) or in addition to them
+	// ("srflx"). An entry may also map one public IP to one private IP, as
+	// "public/private".
+	NAT1To1IPs           []string `json:"nat1To1IPs"`
+	NAT1To1CandidateType string   `json:"nat1To1CandidateType"`
+	// PortRange limits the ephemeral UDP ports used without UDPListen.
+	PortRange PortRange `json:"portRange"`
+	// NetworkTypes are the networks candidates are gathered on: udp4, udp6,
+	// tcp4, tcp6, or udp and tcp for both IP versions. By default they are
+	// UDP, and TCP too when TCPListen is set.
+	NetworkTypes []string `json:"networkTypes"`
+	// Interfaces, if not empty, are the only network interfaces candidates
+	// are gathered on.
+	Interfaces []string `json:"interfaces"`
+	// IPs, if not empty, are the only local IPs or CIDR networks candidates
+	// are gathered on.
+	IPs []string `json:"ips"`
+	// MDNS is one of MDNSDisabled, MDNSQuery (the default) or MDNSGather.
+	MDNS string `json:"mdns"`
+}
+
+// AllowsNetwork reports whether candidates are gathered on network, such as
+// "udp4" or "tcp6".
+func (i *ICEConfig) AllowsNetwork(network string) bool {
+	if len(i.NetworkTypes) == 0 {
+		return strings.HasPrefix(network, "udp") || (i.TCPListen != "" && strings.HasPrefix(network, "tcp"))
+	}
+	for _, t := range i.NetworkTypes {
+		if t == network || t == strings.TrimRight(network, "46") {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsInterface reports whether candidates are gathered on the network
+// interface name.
+func (i *ICEConfig) AllowsInterface(name string) bool {
+	if len(i.Interfaces) == 0 {
+		return true
+	}
+	for _, allowed := range i.Interfaces {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether candidates are gathered on the local ip.
+func (i *ICEConfig) AllowsIP(ip net.IP) bool {
+	if len(i.IPs) == 0 {
+		return true
+	}
+	for _, allowed := range i.IPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if net.ParseIP(allowed).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TURNConfig configures the TURN relay embedded in the stream engine. The
+// relay hands out time-limited credentials in the style of the TURN REST API
+// (draft-uberti-behave-turn-rest), signed with Secret.
+type TURNConfig struct {
+	// Listen is the UDP address the relay listens on, such as ":3478". The
+	// relay is disabled when it is empty.
+	Listen string `json:"listen"`
+	// PublicIP is the address clients reach the relay at. It defaults to
+	// the host in Listen, which must then be a specific IP.
+	PublicIP string `json:"publicIP"`
+	// RelayPorts limits the ports allocated for relayed traffic. Any port
+	// is used when it is unset.
+	RelayPorts PortRange `json:"relayPorts"`
+	Realm      string    `json:"realm"`
+	// Secret signs the credentials. A random secret is used when it is
+	// empty, so that credentials do not outlive the process.
+	Secret string `json:"secret"`
+	// CredentialTTL is how long the credentials handed to a client stay
+	// valid, unless its session has a time limit to expire with.
+	CredentialTTL Duration `json:"credentialTTL"`
+	// AllowPrivatePeers lets clients relay to loopback, link-local and
+	// private addresses, which are refused by default so that the relay
+	// cannot be used to reach the server's own network.
+	AllowPrivatePeers bool `json:"allowPrivatePeers"`
+}
+
+// Default returns the settings used when nothing else is configured.
+func Default() *Config {
+	return &Config{
+		Listen:        ":8080",
+		AdminListen:   "127.0.0.1:8081",
+		StaticDir:     "./web",
+		RecordingDir:  ".",
+		RecordingName: "output-" + NameSession + "-" + NameTake + ".webm",
+		LogLevel:      LevelError,
+		ICEServers: []ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+		},
+		ICE: ICEConfig{
+			NAT1To1CandidateType: "host",
+			MDNS:                 MDNSQuery,
+		},
+		TURN: TURNConfig{
+			Realm:         "pion-webrtc-app",
+			CredentialTTL: Duration(4 * time.Hour),
+		},
+		Storage: StorageConfig{
+			Type: StorageLocal,
+			S3:   S3Config{Region: "us-east-1"},
+		},
+	}
+}
+
+// Load registers the configuration flags with fs, parses args and returns
+// the defaults overridden by the configuration file, the environment and the
+// flags, in that order. Programs define their own flags on fs beforehand.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	var iceServers stringList
+	path := fs.String("config", "", "JSON configuration `file` (env "+EnvPrefix+"CONFIG)")
+	fs.String("listen", "", "HTTP listen `address` (env "+EnvPrefix+"LISTEN)")
+	fs.String("admin-listen", "", "HTTP listen `address` of the admin API, or empty to disable it (env "+EnvPrefix+"ADMIN_LISTEN)")
+	fs.String("static-dir", "", "`directory` of web files to serve (env "+EnvPrefix+"STATIC_DIR)")
+	fs.String("recording-dir", "", "`directory` to write recordings to (env "+EnvPrefix+"RECORDING_DIR)")
+	fs.String("recording-name", "", "`template` naming recording files, with {session}, {user}, {time} and {take} (env "+EnvPrefix+"RECORDING_NAME)")
+	fs.String("storage", "", "`type` of recording storage: local or s3 (env "+EnvPrefix+"STORAGE)")
+	fs.String("s3-endpoint", "", "`URL` of the S3-compatible store to upload recordings to (env "+EnvPrefix+"S3_ENDPOINT)")
+	fs.String("s3-region", "", "S3 `region` (env "+EnvPrefix+"S3_REGION)")
+	fs.String("s3-bucket", "", "S3 `bucket` to upload recordings to (env "+EnvPrefix+"S3_BUCKET)")
+	fs.String("s3-prefix", "", "`prefix` of the recording names in the S3 bucket (env "+EnvPrefix+"S3_PREFIX)")
+	fs.String("s3-access-key-id", "", "S3 access key `ID` (env "+EnvPrefix+"S3_ACCESS_KEY_ID)")
+	fs.String("s3-secret-access-key", "", "S3 secret access `key` (env "+EnvPrefix+"S3_SECRET_ACCESS_KEY)")
+	fs.String("s3-session-token", "", "S3 session `token` for temporary credentials (env "+EnvPrefix+"S3_SESSION_TOKEN)")
+	fs.Bool("s3-path-style", false, "put the S3 bucket in the URL path, as MinIO needs (env "+EnvPrefix+"S3_PATH_STYLE)")
+	fs.Var(new(Size), "s3-part-size", "`size` of the parts recordings are uploaded to S3 in, at least 5MiB (env "+EnvPrefix+"S3_PART_SIZE)")
+	fs.String("encryption-key", "", "master `key` encrypting recordings at rest, 32 bytes in hex or base64 (env "+EnvPrefix+"ENCRYPTION_KEY)")
+	fs.String("encryption-key-file", "", "`file` holding the master key encrypting recordings at rest (env "+EnvPrefix+"ENCRYPTION_KEY_FILE)")
+	fs.String("log-level", "", "log `level`: error, warn, info, debug or trace (env "+EnvPrefix+"LOG_LEVEL)")
+	fs.Var(&iceServers, "ice-server", "STUN or TURN server `URL`, may be repeated (env "+EnvPrefix+"ICE_SERVERS, comma separated)")
+	fs.String("ice-udp-listen", "", "UDP `address` to multiplex all ICE traffic over (env "+EnvPrefix+"ICE_UDP_LISTEN)")
+	fs.String("ice-tcp-listen", "", "TCP `address` to accept ICE-TCP on (env "+EnvPrefix+"ICE_TCP_LISTEN)")
+	fs.Var(new(stringList), "ice-nat-ips", "public `IPs` of a 1:1 NAT in front of the server, comma separated (env "+EnvPrefix+"ICE_NAT_IPS)")
+	fs.String("ice-nat-candidate-type", "", "candidate `type` for the NAT IPs: host or srflx (env "+EnvPrefix+"ICE_NAT_CANDIDATE_TYPE)")
+	fs.Var(new(PortRange), "ice-port-range", "`range` of ephemeral UDP ports for ICE, as min-max (env "+EnvPrefix+"ICE_PORT_RANGE)")
+	fs.Var(new(stringList), "ice-network-types", "`networks` to gather candidates on: udp4, udp6, tcp4, tcp6, udp or tcp, comma separated (env "+EnvPrefix+"ICE_NETWORK_TYPES)")
+	fs.Var(new(stringList), "ice-interfaces", "network `interfaces` to gather candidates on, comma separated (env "+EnvPrefix+"ICE_INTERFACES)")
+	fs.Var(new(stringList), "ice-ips", "local `IPs` or CIDR networks to gather candidates on, comma separated (env "+EnvPrefix+"ICE_IPS)")
+	fs.String("ice-mdns", "", "mDNS `mode`: disabled, query or gather (env "+EnvPrefix+"ICE_MDNS)")
+	fs.String("turn-username", "", "`username` for the TURN servers (env "+EnvPrefix+"TURN_USERNAME)")
+	fs.String("turn-credential", "", "`credential` for the TURN servers (env "+EnvPrefix+"TURN_CREDENTIAL)")
+	fs.String("turn-listen", "", "UDP `address` of the embedded TURN relay (env "+EnvPrefix+"TURN_LISTEN)")
+	fs.String("turn-public-ip", "", "public `IP` of the embedded TURN relay (env "+EnvPrefix+"TURN_PUBLIC_IP)")
+	fs.Var(new(PortRange), "turn-relay-ports", "`range` of ports relayed by the embedded TURN relay, as min-max (env "+EnvPrefix+"TURN_RELAY_PORTS)")
+	fs.String("turn-secret", "", "`secret` signing the embedded TURN relay's credentials (env "+EnvPrefix+"TURN_SECRET)")
+	fs.Var(new(Duration), "turn-ttl", "`duration` the embedded TURN relay's credentials stay valid (env "+EnvPrefix+"TURN_TTL)")
+	fs.Bool("turn-allow-private-peers", false, "let the embedded TURN relay relay to private and loopback addresses (env "+EnvPrefix+"TURN_ALLOW_PRIVATE_PEERS)")
+	fs.String("tls-cert", "", "certificate `file` for HTTPS (env "+EnvPrefix+"TLS_CERT)")
+	fs.String("tls-key", "", "private key `file` for HTTPS (env "+EnvPrefix+"TLS_KEY)")
+	fs.Var(new(stringList), "allowed-origins", "`origins` allowed to open a WebSocket, comma separated, or * for any (env "+EnvPrefix+"ALLOWED_ORIGINS)")
+	fs.String("auth-secret", "", "`secret` verifying client tokens; tokens are required when it is set (env "+EnvPrefix+"AUTH_SECRET)")
+	fs.Int("max-sessions-per-ip", 0, "most `sessions` open at once from one IP address (env "+EnvPrefix+"MAX_SESSIONS_PER_IP)")
+	fs.Int("max-sessions-per-client", 0, "most `sessions` open at once for one token subject (env "+EnvPrefix+"MAX_SESSIONS_PER_CLIENT)")
+	fs.Var(new(Duration), "max-session-duration", "longest a session may last (env "+EnvPrefix+"MAX_SESSION_DURATION)")
+	fs.Var(new(Size), "max-recording-size", "most one session may record, such as 2GiB (env "+EnvPrefix+"MAX_RECORDING_SIZE)")
+	fs.Var(new(Size), "max-disk-usage", "largest the recording directory may grow, such as 100GiB (env "+EnvPrefix+"MAX_DISK_USAGE)")
+	fs.Bool("tls-self-signed", false, "serve HTTPS with a generated self-signed certificate, for development (env "+EnvPrefix+"TLS_SELF_SIGNED)")
+	fs.String("tls-redirect-listen", "", "HTTP `address` that redirects to HTTPS (env "+EnvPrefix+"TLS_REDIRECT_LISTEN)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	// lookup returns the value of a flag, or else of its environment
+	// variable.
+	lookup := func(name string) (string, bool) {
+		if set[name] {
+			return fs.Lookup(name).Value.String(), true
+		}
+		env := EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		if v := os.Getenv(env); v != "" {
+			return v, true
+		}
+		return "", false
+	}
+
+	c := Default()
+	if *path == "" {
+		*path = os.Getenv(EnvPrefix + "CONFIG")
+	}
+	if *path != "" {
+		if err := c.readFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, field := range map[string]*string{
+		"listen":                 &c.Listen,
+		"admin-listen":           &c.AdminListen,
+		"static-dir":             &c.StaticDir,
+		"recording-dir":          &c.RecordingDir,
+		"recording-name":         &c.RecordingName,
+		"storage":                &c.Storage.Type,
+		"s3-endpoint":            &c.Storage.S3.Endpoint,
+		"s3-region":              &c.Storage.S3.Region,
+		"s3-bucket":              &c.Storage.S3.Bucket,
+		"s3-prefix":              &c.Storage.S3.Prefix,
+		"s3-access-key-id":       &c.Storage.S3.AccessKeyID,
+		"s3-secret-access-key":   &c.Storage.S3.SecretAccessKey,
+		"s3-session-token":       &c.Storage.S3.SessionToken,
+		"encryption-key":         &c.Storage.Encryption.Key,
+		"encryption-key-file":    &c.Storage.Encryption.KeyFile,
+		"log-level":              &c.LogLevel,
+		"ice-udp-listen":         &c.ICE.UDPListen,
+		"ice-tcp-listen":         &c.ICE.TCPListen,
+		"ice-nat-candidate-type": &c.ICE.NAT1To1CandidateType,
+		"ice-mdns":               &c.ICE.MDNS,
+		"turn-listen":            &c.TURN.Listen,
+		"turn-public-ip":         &c.TURN.PublicIP,
+		"turn-secret":            &c.TURN.Secret,
+		"tls-cert":               &c.TLS.CertFile,
+		"tls-key":                &c.TLS.KeyFile,
+		"tls-redirect-listen":    &c.TLS.RedirectListen,
+		"auth-secret":            &c.Auth.Secret,
+	} {
+		if v, ok := lookup(name); ok {
+			*field = v
+		}
+	}
+	for name, field := range map[string]flag.Value{
+		"ice-port-range":       &c.ICE.PortRange,
+		"turn-relay-ports":     &c.TURN.RelayPorts,
+		"turn-ttl":             &c.TURN.CredentialTTL,
+		"max-session-duration": &c.Limits.MaxSessionDuration,
+		"max-recording-size":   &c.Limits.MaxRecordingSize,
+		"max-disk-usage":       &c.Limits.MaxDiskUsage,
+		"s3-part-size":         &c.Storage.S3.PartSize,
+	} {
+		if v, ok := lookup(name); ok {
+			if err := field.Set(v); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+
+	for name, field := range map[string]*int{
+		"max-sessions-per-ip":     &c.Limits.MaxSessionsPerIP,
+		"max-sessions-per-client": &c.Limits.MaxSessionsPerClient,
+	} {
+		if v, ok := lookup(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*field = n
+		}
+	}
+
+	for name, field := range map[string]*bool{
+		"tls-self-signed":          &c.TLS.SelfSigned,
+		"s3-path-style":            &c.Storage.S3.PathStyle,
+		"turn-allow-private-peers": &c.TURN.AllowPrivatePeers,
+	} {
+		if v, ok := lookup(name); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*field = b
+		}
+	}
+
+	for name, field := range map[string]*[]string{
+		"ice-nat-ips":       &c.ICE.NAT1To1IPs,
+		"ice-network-types": &c.ICE.NetworkTypes,
+		"ice-interfaces":    &c.ICE.Interfaces,
+		"ice-ips":           &c.ICE.IPs,
+		"allowed-origins":   &c.Auth.AllowedOrigins,
+	} {
+		if v, ok := lookup(name); ok {
+			var list stringList
+			list.Set(v)
+			*field = list
+		}
+	}
+
+	if !set["ice-server"] {
+		if v := os.Getenv(EnvPrefix + "ICE_SERVERS"); v != "" {
+			iceServers.Set(v)
+		}
+	}
+	if len(iceServers) > 0 {
+		c.ICEServers = nil
+		for _, url := range iceServers {
+			c.ICEServers = append(c.ICEServers, ICEServer{URLs: []string{url}})
+		}
+	}
+
+	// TURN credentials given outside the file apply to every TURN server, so
+	// that the secret does not have to be written into the file.
+	username, hasUsername := lookup("turn-username")
+	credential, hasCredential := lookup("turn-credential")
+	for i := range c.ICEServers {
+		if !c.ICEServers[i].isTURN() {
+			continue
+		}
+		if hasUsername {
+			c.ICEServers[i].Username = username
+		}
+		if hasCredential {
+			c.ICEServers[i].Credential = credential
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Unknown fields are most likely typos, which would otherwise go
+	// unnoticed.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports whether the settings are usable.
+func (c *Config) Validate() error {
+	if c.Listen == "" {
+		return errors.New("listen address is empty")
+	}
+	if c.AdminListen != "" {
+		if _, _, err := net.SplitHostPort(c.AdminListen); err != nil {
+			return fmt.Errorf("admin listen address: %w", err)
+		}
+		if c.AdminListen == c.Listen {
+			return errors.New("the admin API needs a listen address of its own")
+		}
+	}
+	if _, ok := levels[c.LogLevel]; !ok {
+		return fmt.Errorf("unknown log level %q", c.LogLevel)
+	}
+	for _, server := range c.ICEServers {
+		if len(server.URLs) == 0 {
+			return errors.New("ICE server has no URLs")
+		}
+		for _, url := range server.URLs {
+			scheme, _, _ := strings.Cut(url, ":")
+			switch scheme {
+			case "stun", "stuns":
+			case "turn", "turns":
+				if server.Username == "" || server.Credential == "" {
+					return fmt.Errorf("TURN server %s needs a username and credential", url)
+				}
+			default:
+				return fmt.Errorf("ICE server URL %q is not a stun, stuns, turn or turns URL", url)
+			}
+		}
+	}
+	if err := c.ICE.validate(); err != nil {
+		return fmt.Errorf("ICE: %w", err)
+	}
+	if c.TURN.Listen != "" {
+		if err := c.TURN.validate(); err != nil {
+			return fmt.Errorf("embedded TURN relay: %w", err)
+		}
+	}
+	if err := c.TLS.validate(); err != nil {
+		return fmt.Errorf("TLS: %w", err)
+	}
+	if c.Limits.MaxSessionsPerIP < 0 || c.Limits.MaxSessionsPerClient < 0 || c.Limits.MaxSessionDuration < 0 {
+		return errors.New("limits must not be negative")
+	}
+	if c.Limits.MaxDiskUsage > 0 && filepath.Clean(c.RecordingDir) == "." {
+		return errors.New("limiting the disk usage needs a recording directory of its own, not the working directory")
+	}
+	if err := c.validateRecordingName(); err != nil {
+		return err
+	}
+	if err := c.Storage.validate(); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	for _, origin := range c.Auth.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("allowed origin %q is not of the form scheme://host[:port]", origin)
+		}
+	}
+	return nil
+}
+
+func (i *ICEConfig) validate() error {
+	for _, address := range []string{i.UDPListen, i.TCPListen} {
+		if address == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return err
+		}
+	}
+	for _, mapping := range i.NAT1To1IPs {
+		public, private, hasPrivate := strings.Cut(mapping, "/")
+		if net.ParseIP(public) == nil || (hasPrivate && net.ParseIP(private) == nil) {
+			return fmt.Errorf("invalid NAT 1:1 IP %q", mapping)
+		}
+	}
+	switch i.NAT1To1CandidateType {
+	case "host", "srflx":
+	default:
+		return fmt.Errorf("NAT 1:1 candidate type %q is neither host nor srflx", i.NAT1To1CandidateType)
+	}
+	if i.PortRange.Min > i.PortRange.Max {
+		return fmt.Errorf("invalid port range %s", i.PortRange)
+	}
+	if i.PortRange.Max != 0 && i.UDPListen != "" {
+		return errors.New("a port range has no effect with a UDP listen address")
+	}
+	for _, t := range i.NetworkTypes {
+		if !networkTypes[t] {
+			return fmt.Errorf("unknown network type %q", t)
+		}
+	}
+	udp := i.AllowsNetwork("udp4") || i.AllowsNetwork("udp6")
+	tcp := i.AllowsNetwork("tcp4") || i.AllowsNetwork("tcp6")
+	if i.UDPListen != "" && !udp {
+		return errors.New("a UDP listen address needs a udp network type")
+	}
+	// pion only gathers TCP candidates on the ICE-TCP listener.
+	if i.TCPListen != "" && !tcp {
+		return errors.New("a TCP listen address needs a tcp network type")
+	}
+	if i.TCPListen == "" && tcp {
+		return errors.New("tcp network types need a TCP listen address")
+	}
+	for _, ip := range i.IPs {
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid IP or network %q", ip)
+		}
+	}
+	switch i.MDNS {
+	case MDNSDisabled, MDNSQuery, MDNSGather:
+	default:
+		return fmt.Errorf("unknown mDNS mode %q", i.MDNS)
+	}
+	return nil
+}
+
+func (c *Config) validateRecordingName() error {
+	for _, placeholder := range namePlaceholder.FindAllString(c.RecordingName, -1) {
+		switch placeholder {
+		case NameSession, NameUser, NameTime, NameTake:
+		default:
+			return fmt.Errorf("unknown placeholder %s in recording name", placeholder)
+		}
+	}
+	name := path.Clean(c.RecordingName)
+	if c.RecordingName == "" || name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("recording name %q is not a relative path", c.RecordingName)
+	}
+	return nil
+}
+
+func (s *StorageConfig) validate() error {
+	if s.Encryption.Key != "" && s.Encryption.KeyFile != "" {
+		return errors.New("an encryption key and key file are mutually exclusive")
+	}
+	if s.Encryption.Key != "" {
+		if _, err := s.Encryption.MasterKey(); err != nil {
+			return err
+		}
+	}
+
+	switch s.Type {
+	case StorageLocal:
+		return nil
+	case StorageS3:
+	default:
+		return fmt.Errorf("unknown type %q", s.Type)
+	}
+
+	if u, err := url.Parse(s.S3.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("S3 endpoint %q is not an http or https URL", s.S3.Endpoint)
+	}
+	if s.S3.Region == "" || s.S3.Bucket == "" {
+		return errors.New("S3 needs a region and bucket")
+	}
+	if s.S3.AccessKeyID == "" || s.S3.SecretAccessKey == "" {
+		return errors.New("S3 needs an access key ID and secret access key")
+	}
+	if s.S3.PartSize != 0 && s.S3.PartSize < 5<<20 {
+		return errors.New("the S3 part size must be at least 5MiB")
+	}
+	return nil
+}
+
+func (t *TLSConfig) validate() error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("the certificate and key files must be given together")
+	}
+	if t.CertFile != "" && t.SelfSigned {
+		return errors.New("a certificate file and a self-signed certificate are mutually exclusive")
+	}
+	if t.RedirectListen != "" {
+		if !t.Enabled() {
+			return errors.New("redirecting to HTTPS needs a certificate")
+		}
+		if _, _, err := net.SplitHostPort(t.RedirectListen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TURNConfig) validate() error {
+	if _, _, err := net.SplitHostPort(t.Listen); err != nil {
+		return err
+	}
+	if t.PublicIP != "" && net.ParseIP(t.PublicIP) == nil {
+		return fmt.Errorf("invalid public IP %q", t.PublicIP)
+	}
+	if t.RelayIP() == nil {
+		return errors.New("a public IP is needed when listening on all interfaces")
+	}
+	if t.RelayPorts.Min > t.RelayPorts.Max {
+		return fmt.Errorf("invalid relay port range %s", t.RelayPorts)
+	}
+	if t.CredentialTTL <= 0 {
+		return errors.New("credential TTL must be positive")
+	}
+	return nil
+}
+
+// RelayIP returns the IP clients reach the embedded TURN relay at, or nil
+// if it is not known.
+func (t *TURNConfig) RelayIP() net.IP {
+	if t.PublicIP != "" {
+		return net.ParseIP(t.PublicIP)
+	}
+	host, _, err := net.SplitHostPort(t.Listen)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return ip
+	}
+	return nil
+}
+
+// URL returns the turn: URL clients use for the embedded TURN relay.
+func (t *TURNConfig) URL() string {
+	_, port, _ := net.SplitHostPort(t.Listen)
+	return "turn:" + net.JoinHostPort(t.RelayIP().String(), port) + "?transport=udp"
+}
+
+// Logs reports whether messages at level are logged.
+func (c *Config) Logs(level string) bool {
+	return levels[level] <= levels[c.LogLevel]
+}
+
+// LoggerFactory returns a logger factory for pion at the configured level.
+// The PION_LOG_* environment variables still select levels for individual
+// pion subsystems.
+func (c *Config) LoggerFactory() logging.LoggerFactory {
+	factory := logging.NewDefaultLoggerFactory()
+	factory.DefaultLogLevel = levels[c.LogLevel]
+	return factory
+}
+
+func (s ICEServer) isTURN() bool {
+	for _, url := range s.URLs {
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			return true
+		}
+	}
+	return false
+}
+
+// Duration is a time.Duration written as a string such as "12h".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(v string) error {
+	duration, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+// Size is a number of bytes written with an optional binary unit, such as
+// "512MiB" or "2G".
+type Size int64
+
+var sizeUnits = []string{"K", "M", "G", "T"}
+
+func (s Size) String() string {
+	n, unit := int64(s), ""
+	for _, u := range sizeUnits {
+		if n == 0 || n%1024 != 0 {
+			break
+		}
+		n, unit = n/1024, u+"iB"
+	}
+	return strconv.FormatInt(n, 10) + unit
+}
+
+func (s *Size) Set(v string) error {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(v)), "B")
+	multiplier := int64(1)
+	for i, u := range sizeUnits {
+		if trimmed, ok := cutSuffix(number, u+"I", u); ok {
+			number = strings.TrimSpace(trimmed)
+			multiplier = 1 << (10 * (i + 1))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*s = Size(n * multiplier)
+	return nil
+}
+
+// cutSuffix removes the first of suffixes that s ends with.
+func cutSuffix(s string, suffixes ...string) (string, bool) {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return strings.TrimSuffix(s, suffix), true
+		}
+	}
+	return s, false
+}
+
+func (s Size) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Size) UnmarshalText(text []byte) error {
+	return s.Set(string(text))
+}
+
+// PortRange is an inclusive range of ports, written as "min-max". The zero
+// value means any port.
+type PortRange struct {
+	Min, Max uint16
+}
+
+func (r PortRange) String() string {
+	if r == (PortRange{}) {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+func (r *PortRange) Set(v string) error {
+	low, high, ok := strings.Cut(v, "-")
+	if !ok {
+		return fmt.Errorf("port range %q is not of the form min-max", v)
+	}
+	first, err := strconv.ParseUint(strings.TrimSpace(low), 10, 16)
+	if err != nil {
+		return err
+	}
+	last, err := strconv.ParseUint(strings.TrimSpace(high), 10, 16)
+	if err != nil {
+		return err
+	}
+	if first == 0 || first > last {
+		return fmt.Errorf("invalid port range %q", v)
+	}
+	*r = PortRange{Min: uint16(first), Max: uint16(last)}
+	return nil
+}
+
+func (r PortRange) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *PortRange) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*r = PortRange{}
+		return nil
+	}
+	return r.Set(string(text))
+}
+
+// stringList is a repeatable flag that also accepts comma-separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearEnv hides any configuration in the environment the tests run in.
+// Load ignores empty variables.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); strings.HasPrefix(name, EnvPrefix) {
+			t.Setenv(name, "")
+		}
+	}
+}
+
+// load runs Load on a new flag set with args.
+func load(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return Load(fs, args)
+}
+
+// writeConfigFile writes a JSON configuration file and returns its path.
+func writeConfigFile(t *testing.T, json string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(json), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	clearEnv(t)
+	c, err := load(t)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(c, Default()) {
+		t.Errorf("Load without settings = %+v, want the defaults %+v", c, Default())
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfigFile(t, `{"listen": ":1000", "limits": {"maxRecordingSize": "1GiB"}}`)
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		listen  string
+		maxSize Size
+	}{
+		{"default", nil, nil, ":8080", 0},
+		{"file", nil, []string{"-config", file}, ":1000", 1 << 30},
+		{"file from the environment", map[string]string{"WEBRTC_CONFIG": file}, nil, ":1000", 1 << 30},
+		{
+			"environment over file",
+			map[string]string{"WEBRTC_LISTEN": ":2000", "WEBRTC_MAX_RECORDING_SIZE": "2G"},
+			[]string{"-config", file},
+			":2000", 2 << 30,
+		},
+		{
+			"flag over environment",
+			map[string]string{"WEBRTC_LISTEN": ":2000", "WEBRTC_MAX_RECORDING_SIZE": "2G"},
+			[]string{"-config", file, "-listen", ":3000", "-max-recording-size", "3GiB"},
+			":3000", 3 << 30,
+		},
+		{
+			"flag over file",
+			nil,
+			[]string{"-config", file, "-max-recording-size", "512MiB"},
+			":1000", 512 << 20,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			c, err := load(t, tt.args...)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if c.Listen != tt.listen || c.Limits.MaxRecordingSize != tt.maxSize {
+				t.Errorf("listen %q, max recording size %s; want %q, %s", c.Listen, c.Limits.MaxRecordingSize, tt.listen, tt.maxSize)
+			}
+		})
+	}
+}
+
+func TestLoadTypes(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("WEBRTC_ICE_NETWORK_TYPES", "udp4, tcp4")
+	t.Setenv("WEBRTC_TLS_SELF_SIGNED", "true")
+	c, err := load(t,
+		"-ice-tcp-listen", ":8443",
+		"-ice-port-range", "10000-20000",
+		"-max-sessions-per-ip", "4",
+		"-max-session-duration", "2h",
+		"-allowed-origins", "https://a.example.com,https://b.example.com",
+	)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if want := []string{"udp4", "tcp4"}; !reflect.DeepEqual(c.ICE.NetworkTypes, want) {
+		t.Errorf("network types %q, want %q", c.ICE.NetworkTypes, want)
+	}
+	if !c.TLS.SelfSigned {
+		t.Error("TLS self-signed not set from the environment")
+	}
+	if c.ICE.PortRange != (PortRange{Min: 10000, Max: 20000}) {
+		t.Errorf("port range %s", c.ICE.PortRange)
+	}
+	if c.Limits.MaxSessionsPerIP != 4 || c.Limits.MaxSessionDuration != Duration(2*time.Hour) {
+		t.Errorf("limits %+v", c.Limits)
+	}
+	if len(c.Auth.AllowedOrigins) != 2 {
+		t.Errorf("allowed origins %q", c.Auth.AllowedOrigins)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want string
+	}{
+		{name: "unknown flag", args: []string{"-no-such-flag"}, want: "not defined"},
+		{name: "unknown field in file", file: `{"listne": ":1000"}`, want: "unknown field"},
+		{name: "malformed file", file: `{"listen": `, want: "config file"},
+		{name: "missing file", args: []string{"-config", "/nonexistent/config.json"}, want: "no such file"},
+		{name: "invalid size flag", args: []string{"-max-disk-usage", "lots"}, want: `invalid value "lots" for flag -max-disk-usage`},
+		{name: "invalid size in environment", env: map[string]string{"WEBRTC_MAX_DISK_USAGE": "9999999T"}, want: "invalid max-disk-usage"},
+		{name: "invalid size in file", file: `{"limits": {"maxRecordingSize": "1.5G"}}`, want: "invalid size"},
+		{name: "invalid integer in environment", env: map[string]string{"WEBRTC_MAX_SESSIONS_PER_IP": "four"}, want: "invalid max-sessions-per-ip"},
+		{name: "invalid bool in environment", env: map[string]string{"WEBRTC_S3_PATH_STYLE": "maybe"}, want: "invalid s3-path-style"},
+		{name: "invalid port range", args: []string{"-ice-port-range", "10-5"}, want: "invalid port range"},
+		{name: "invalid port range in environment", env: map[string]string{"WEBRTC_TURN_RELAY_PORTS": "0-10"}, want: "invalid turn-relay-ports"},
+		{name: "invalid duration in environment", env: map[string]string{"WEBRTC_TURN_TTL": "soon"}, want: "invalid turn-ttl"},
+		{name: "validation", args: []string{"-log-level", "loud"}, want: `unknown log level "loud"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+			_, err := load(t, args...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTURNCredentials(t *testing.T) {
+	file := writeConfigFile(t, `{"iceServers": [
+		{"urls": ["stun:stun.example.com:3478"]},
+		{"urls": ["turn:turn.example.com:3478"], "username": "file-user", "credential": "file-secret"},
+		{"urls": ["turns:turn.example.com:5349"], "username": "file-user", "credential": "file-secret"}
+	]}`)
+	tests := []struct {
+		name       string
+		env        map[string]string
+		args       []string
+		servers    []ICEServer
+		wantErrMsg string
+	}{
+		{
+			name: "from the file",
+			args: []string{"-config", file},
+			servers: []ICEServer{
+				{URLs: []string{"stun:stun.example.com:3478"}},
+				{URLs: []string{"turn:turn.example.com:3478"}, Username: "file-user", Credential: "file-secret"},
+				{URLs: []string{"turns:turn.example.com:5349"}, Username: "file-user", Credential: "file-secret"},
+			},
+		},
+		{
+			name: "credential from the environment",
+			env:  map[string]string{"WEBRTC_TURN_CREDENTIAL": "env-secret"},
+			args: []string{"-config", file},
+			servers: []ICEServer{
+				{URLs: []string{"stun:stun.example.com:3478"}},
+				{URLs: []string{"turn:turn.example.com:3478"}, Username: "file-user", Credential: "env-secret"},
+				{URLs: []string{"turns:turn.example.com:5349"}, Username: "file-user", Credential: "env-secret"},
+			},
+		},
+		{
+			name: "flags over the environment",
+			env:  map[string]string{"WEBRTC_TURN_USERNAME": "env-user", "WEBRTC_TURN_CREDENTIAL": "env-secret"},
+			args: []string{"-config", file, "-turn-username", "flag-user"},
+			servers: []ICEServer{
+				{URLs: []string{"stun:stun.example.com:3478"}},
+				{URLs: []string{"turn:turn.example.com:3478"}, Username: "flag-user", Credential: "env-secret"},
+				{URLs: []string{"turns:turn.example.com:5349"}, Username: "flag-user", Credential: "env-secret"},
+			},
+		},
+		{
+			name: "servers from flags",
+			args: []string{"-ice-server", "stun:a.example.com", "-ice-server", "turn:b.example.com", "-turn-username", "u", "-turn-credential", "c"},
+			servers: []ICEServer{
+				{URLs: []string{"stun:a.example.com"}},
+				{URLs: []string{"turn:b.example.com"}, Username: "u", Credential: "c"},
+			},
+		},
+		{
+			name: "servers from the environment",
+			env:  map[string]string{"WEBRTC_ICE_SERVERS": "stun:a.example.com, turn:b.example.com", "WEBRTC_TURN_USERNAME": "u", "WEBRTC_TURN_CREDENTIAL": "c"},
+			servers: []ICEServer{
+				{URLs: []string{"stun:a.example.com"}},
+				{URLs: []string{"turn:b.example.com"}, Username: "u", Credential: "c"},
+			},
+		},
+		{
+			name:       "TURN server without credentials",
+			args:       []string{"-ice-server", "turn:b.example.com"},
+			wantErrMsg: "needs a username and credential",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			c, err := load(t, tt.args...)
+			if tt.wantErrMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Fatalf("Load error = %v, want one containing %q", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if !reflect.DeepEqual(c.ICEServers, tt.servers) {
+				t.Errorf("ICE servers %+v\nwant %+v", c.ICEServers, tt.servers)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	key := strings.Repeat("ab", 32)
+	s3 := func(c *Config) {
+		c.Storage.Type = StorageS3
+		c.Storage.S3 = S3Config{
+			Endpoint: "https://s3.example.com", Region: "us-east-1", Bucket: "b",
+			AccessKeyID: "id", SecretAccessKey: "secret",
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"no listen address", func(c *Config) { c.Listen = "" }, "listen address is empty"},
+		{"admin on the public address", func(c *Config) { c.AdminListen = c.Listen }, "admin API needs a listen address"},
+		{"admin address without port", func(c *Config) { c.AdminListen = "localhost" }, "admin listen address"},
+		{"admin disabled", func(c *Config) { c.AdminListen = "" }, ""},
+		{"unknown log level", func(c *Config) { c.LogLevel = "verbose" }, "unknown log level"},
+		{"ICE server of another scheme", func(c *Config) { c.ICEServers = []ICEServer{{URLs: []string{"http://x"}}} }, "not a stun, stuns, turn or turns URL"},
+		{"ICE server without URLs", func(c *Config) { c.ICEServers = []ICEServer{{}} }, "has no URLs"},
+		{"port range with a UDP listener", func(c *Config) {
+			c.ICE.UDPListen = ":8443"
+			c.ICE.PortRange = PortRange{Min: 10000, Max: 20000}
+		}, "no effect with a UDP listen address"},
+		{"TCP without a listener", func(c *Config) { c.ICE.NetworkTypes = []string{"udp", "tcp"} }, "need a TCP listen address"},
+		{"TCP listener without TCP", func(c *Config) { c.ICE.TCPListen = ":8443"; c.ICE.NetworkTypes = []string{"udp4"} }, "needs a tcp network type"},
+		{"UDP listener without UDP", func(c *Config) {
+			c.ICE.UDPListen = ":8443"
+			c.ICE.TCPListen = ":8443"
+			c.ICE.NetworkTypes = []string{"tcp"}
+		}, "needs a udp network type"},
+		{"invalid NAT IP", func(c *Config) { c.ICE.NAT1To1IPs = []string{"203.0.113.1/nope"} }, "invalid NAT 1:1 IP"},
+		{"NAT IP mapping", func(c *Config) { c.ICE.NAT1To1IPs = []string{"203.0.113.1/10.0.0.1"} }, ""},
+		{"unknown mDNS mode", func(c *Config) { c.ICE.MDNS = "loud" }, "unknown mDNS mode"},
+		{"TURN on all interfaces", func(c *Config) { c.TURN.Listen = ":3478" }, "a public IP is needed"},
+		{"TURN with a public IP", func(c *Config) { c.TURN.Listen = ":3478"; c.TURN.PublicIP = "203.0.113.1" }, ""},
+		{"TURN without TTL", func(c *Config) { c.TURN.Listen = "203.0.113.1:3478"; c.TURN.CredentialTTL = 0 }, "credential TTL must be positive"},
+		{"certificate without key", func(c *Config) { c.TLS.CertFile = "cert.pem" }, "must be given together"},
+		{"certificate and self-signed", func(c *Config) {
+			c.TLS.CertFile, c.TLS.KeyFile, c.TLS.SelfSigned = "cert.pem", "key.pem", true
+		}, "mutually exclusive"},
+		{"redirect without HTTPS", func(c *Config) { c.TLS.RedirectListen = ":80" }, "needs a certificate"},
+		{"negative limit", func(c *Config) { c.Limits.MaxSessionsPerIP = -1 }, "must not be negative"},
+		{"disk limit in the working directory", func(c *Config) { c.Limits.MaxDiskUsage = 1 << 30 }, "recording directory of its own"},
+		{"disk limit in its own directory", func(c *Config) { c.Limits.MaxDiskUsage = 1 << 30; c.RecordingDir = "recordings" }, ""},
+		{"unknown placeholder", func(c *Config) { c.RecordingName = "{room}.webm" }, "unknown placeholder {room}"},
+		{"recording name outside the directory", func(c *Config) { c.RecordingName = "../{session}.webm" }, "not a relative path"},
+		{"absolute recording name", func(c *Config) { c.RecordingName = "/tmp/{session}.webm" }, "not a relative path"},
+		{"unknown storage", func(c *Config) { c.Storage.Type = "ftp" }, `unknown type "ftp"`},
+		{"S3", s3, ""},
+		{"S3 without bucket", func(c *Config) { s3(c); c.Storage.S3.Bucket = "" }, "needs a region and bucket"},
+		{"S3 endpoint without scheme", func(c *Config) { s3(c); c.Storage.S3.Endpoint = "s3.example.com" }, "not an http or https URL"},
+		{"S3 part too small", func(c *Config) { s3(c); c.Storage.S3.PartSize = 1 << 20 }, "at least 5MiB"},
+		{"encryption key", func(c *Config) { c.Storage.Encryption.Key = key }, ""},
+		{"short encryption key", func(c *Config) { c.Storage.Encryption.Key = "abcd" }, "32 bytes"},
+		{"encryption key and file", func(c *Config) { c.Storage.Encryption.Key, c.Storage.Encryption.KeyFile = key, "key" }, "mutually exclusive"},
+		{"origin without scheme", func(c *Config) { c.Auth.AllowedOrigins = []string{"example.com"} }, "not of the form scheme://host"},
+		{"origin with path", func(c *Config) { c.Auth.AllowedOrigins = []string{"https://example.com/app"} }, "not of the form scheme://host"},
+		{"any origin", func(c *Config) { c.Auth.AllowedOrigins = []string{"*", "https://example.com:8443"} }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.modify(c)
+			err := c.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("Validate: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("Validate error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSizeSet(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Size
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1000", 1000, true},
+		{"1000B", 1000, true},
+		{"2K", 2 << 10, true},
+		{"2KB", 2 << 10, true},
+		{"2KiB", 2 << 10, true},
+		{"512MiB", 512 << 20, true},
+		{"512 MiB", 512 << 20, true},
+		{"2G", 2 << 30, true},
+		{"2gb", 2 << 30, true},
+		{"1T", 1 << 40, true},
+		{"8388607T", 8388607 << 40, true},
+		{"9999999T", 0, false},
+		{"99999999999999999999", 0, false},
+		{"-1", 0, false},
+		{"1.5G", 0, false},
+		{"2P", 0, false},
+		{"", 0, false},
+		{"MiB", 0, false},
+	}
+	for _, tt := range tests {
+		var s Size
+		err := s.Set(tt.in)
+		if (err == nil) != tt.ok || s != tt.want {
+			t.Errorf("Set(%q) = %d, %v; want %d, ok %t", tt.in, s, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	tests := []struct {
+		size Size
+		want string
+	}{
+		{0, "0"},
+		{1000, "1000"},
+		{1536, "1536"},
+		{2 << 10, "2KiB"},
+		{512 << 20, "512MiB"},
+		{3 << 40, "3TiB"},
+		{2048 << 40, "2048TiB"},
+	}
+	for _, tt := range tests {
+		if got := tt.size.String(); got != tt.want {
+			t.Errorf("Size(%d).String() = %q, want %q", int64(tt.size), got, tt.want)
+		}
+		var back Size
+		if err := back.Set(tt.want); err != nil || back != tt.size {
+			t.Errorf("Set(%q) = %d, %v; want %d", tt.want, back, err, tt.size)
+		}
+	}
+}
+
+func TestPortRangeSet(t *testing.T) {
+	tests := []struct {
+		in   string
+		want PortRange
+		ok   bool
+	}{
+		{"10000-20000", PortRange{10000, 20000}, true},
+		{" 10 - 20 ", PortRange{10, 20}, true},
+		{"5-5", PortRange{5, 5}, true},
+		{"1-65535", PortRange{1, 65535}, true},
+		{"0-10", PortRange{}, false},
+		{"10-5", PortRange{}, false},
+		{"1-65536", PortRange{}, false},
+		{"10", PortRange{}, false},
+		{"-10", PortRange{}, false},
+		{"a-b", PortRange{}, false},
+		{"", PortRange{}, false},
+	}
+	for _, tt := range tests {
+		var r PortRange
+		err := r.Set(tt.in)
+		if (err == nil) != tt.ok || r != tt.want {
+			t.Errorf("Set(%q) = %v, %v; want %v, ok %t", tt.in, r, err, tt.want, tt.ok)
+		}
+	}
+
+	// An empty range in a file means any port.
+	r := PortRange{1, 2}
+	if err := r.UnmarshalText(nil); err != nil || r != (PortRange{}) {
+		t.Errorf("UnmarshalText of an empty range = %v, %v", r, err)
+	}
+}
+
+func TestRecordingFile(t *testing.T) {
+	c := Default()
+	c.RecordingName = "{user}/{time}-{session}-{take}.webm"
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.FixedZone("CEST", 2*3600))
+
+	tests := []struct {
+		user string
+		want string
+	}{
+		{"alice", "alice/20240501T103000Z-s1-2.webm"},
+		{"", "anonymous/20240501T103000Z-s1-2.webm"},
+		{"../../etc", ".._.._etc/20240501T103000Z-s1-2.webm"},
+		{"..", "_/20240501T103000Z-s1-2.webm"},
+	}
+	for _, tt := range tests {
+		if got := c.RecordingFile("s1", tt.user, "2", at); got != tt.want {
+			t.Errorf("RecordingFile for user %q = %q, want %q", tt.user, got, tt.want)
+		}
+	}
+}
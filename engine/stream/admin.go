@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const sessionsAPIPath = "/api/sessions"
+
+// startAdminServer serves the admin API on cfg.AdminListen. It is kept off
+// the public listener, since it can end any session and lists the session
+// IDs WHEP players ask for.
+func startAdminServer() error {
+	listener, err := net.Listen("tcp", cfg.AdminListen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(sessionsAPIPath, handleSessions)
+	mux.HandleFunc(sessionsAPIPath+"/", handleSessions)
+	go func() {
+		// The public server keeps running without the admin API.
+		log.Println("Admin API stopped:", http.Serve(listener, mux))
+	}()
+
+	fmt.Printf("Serving the admin API on %s\n", listener.Addr())
+	return nil
+}
+
+// handleSessions serves the admin API:
+//
+//	GET    /api/sessions       list live sessions
+//	GET    /api/sessions/{id}  fetch one session
+//	DELETE /api/sessions/{id}  force-close a session
+//
+// When tokens are required, requests need one with the admin claim.
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	if !authenticateAdmin(w, r) {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, sessionsAPIPath), "/")
+
+	if id == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		list := sessions.list()
+		infos := make([]sessionInfo, 0, len(list))
+		for _, s := range list {
+			infos = append(infos, s.info())
+		}
+		writeAPIJSON(w, http.StatusOK, infos)
+		return
+	}
+
+	s, ok := sessions.get(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeAPIJSON(w, http.StatusOK, s.info())
+	case http.MethodDelete:
+		s.logf("Closed through admin API by %s", r.RemoteAddr)
+		s.close()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Failed to write API response:", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, map[string]string{"error": message})
+}
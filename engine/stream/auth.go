@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mladenovic-13/pion-webrtc-app/auth"
+	"github.com/mladenovic-13/pion-webrtc-app/config"
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+)
+
+// authTimeout is how long a client that did not put its token in the
+// upgrade request has to send it in an auth message.
+const authTimeout = 10 * time.Second
+
+// checkOrigin is the upgrader's CheckOrigin. See auth.AllowsOrigin.
+func checkOrigin(r *http.Request) bool {
+	return auth.AllowsOrigin(r, cfg.Auth.AllowedOrigins)
+}
+
+// authenticate verifies a client's token. Without an auth secret every
+// client is let in, with nil claims.
+func authenticate(token string) (*auth.Claims, error) {
+	if !cfg.Auth.Required() {
+		return nil, nil
+	}
+	if token == "" {
+		return nil, auth.ErrMissingToken
+	}
+	return auth.Verify(token, []byte(cfg.Auth.Secret), time.Now())
+}
+
+// authenticateWebSocket verifies the token in the upgrade request or, if
+// there is none, in the first message on conn. Browsers cannot set headers
+// on a WebSocket, and a message keeps the token out of access logs.
+func authenticateWebSocket(conn *websocket.Conn, r *http.Request) (*auth.Claims, error) {
+	token := auth.FromRequest(r)
+	if token != "" || !cfg.Auth.Required() {
+		return authenticate(token)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, auth.ErrMissingToken
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	msg, err := signaling.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := msg.(*signaling.Auth)
+	if !ok {
+		return nil, errors.New("expected an auth message first")
+	}
+	return authenticate(m.Token)
+}
+
+// authenticateHTTP verifies the bearer token of an HTTP request, answering
+// 401 Unauthorized if it is not valid.
+func authenticateHTTP(w http.ResponseWriter, r *http.Request) (*auth.Claims, bool) {
+	claims, err := authenticate(auth.FromRequest(r))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return claims, true
+}
+
+// authorizeOwner verifies the bearer token of a request to change a WHIP
+// session or WHEP viewer opened by subject, answering 403 Forbidden if it is
+// for another client. Tokens without a subject only match each other, so it
+// is the unguessable resource URL that tells those clients apart.
+func authorizeOwner(w http.ResponseWriter, r *http.Request, subject string) bool {
+	claims, ok := authenticateHTTP(w, r)
+	if !ok {
+		return false
+	}
+	if claims != nil && claims.Subject != subject {
+		http.Error(w, "the token is for another client", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authenticateAdmin verifies the bearer token of an admin API request, which
+// must carry the admin claim when tokens are required.
+func authenticateAdmin(w http.ResponseWriter, r *http.Request) bool {
+	claims, ok := authenticateHTTP(w, r)
+	if !ok {
+		return false
+	}
+	if claims != nil && !claims.Admin {
+		writeAPIError(w, http.StatusForbidden, "the token does not permit the admin API")
+		return false
+	}
+	return true
+}
+
+// mayRecord reports whether the session's token permits recording.
+func (s *session) mayRecord() bool {
+	return s.claims == nil || s.claims.Record
+}
+
+// mayJoin reports whether the session's token permits joining the room
+// name.
+func (s *session) mayJoin(name string) bool {
+	return s.claims == nil || s.claims.AllowsRoom(name)
+}
+
+// mayWatch reports whether a WHEP player with claims may watch the session:
+// one of its client's own sessions, any session in the room its token is
+// for, or any session at all with the admin claim. A token without a subject
+// or room permits none but the last.
+func (s *session) mayWatch(claims *auth.Claims) bool {
+	switch {
+	case claims == nil, claims.Admin:
+		return true
+	case claims.Subject != "" && claims.Subject == s.subject():
+		return true
+	case claims.Room != "" && claims.Room == s.roomName():
+		return true
+	}
+	return false
+}
+
+// subject identifies the client for logging: the subject of its token, if
+// it has one.
+func (s *session) subject() string {
+	if s.claims == nil {
+		return ""
+	}
+	return s.claims.Subject
+}
+
+// runTokenCommand prints a token signed with the configured auth secret, for
+// testing or for backends that shell out to mint tokens:
+//
+//	stream token -auth-secret ... -subject alice -room demo -record -ttl 1h
+//	stream token -auth-secret ... -subject ops -admin
+func runTokenCommand(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	subject := fs.String("subject", "", "`name` of the client")
+	room := fs.String("room", "", "the only `room` the client may join")
+	maxDuration := fs.Duration("max-duration", 0, "how long each session may last, or 0 for no limit")
+	record := fs.Bool("record", false, "permit recording")
+	admin := fs.Bool("admin", false, "permit the admin API")
+	ttl := fs.Duration("ttl", time.Hour, "how long the token can open sessions, or 0 for ever")
+
+	c, err := config.Load(fs, args)
+	if err != nil {
+		return err
+	}
+	if !c.Auth.Required() {
+		return errors.New("no auth secret is configured")
+	}
+
+	claims := &auth.Claims{
+		Subject:     *subject,
+		Room:        *room,
+		MaxDuration: int64(maxDuration.Seconds()),
+		Record:      *record,
+		Admin:       *admin,
+	}
+	if *ttl > 0 {
+		claims.ExpiresAt = time.Now().Add(*ttl).Unix()
+	}
+	token, err := auth.Sign(claims, []byte(c.Auth.Secret))
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
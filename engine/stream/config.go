@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/mladenovic-13/pion-webrtc-app/config"
+	"github.com/mladenovic-13/pion-webrtc-app/storage"
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+const iceServersAPIPath = "/api/ice-servers"
+
+// cfg holds the server's settings. main loads them before anything else
+// runs.
+var cfg = config.Default()
+
+// api creates every PeerConnection, so that they all share the settings in
+// cfg. See newWebRTCAPI.
+var api *webrtc.API
+
+// newWebRTCAPI builds an API with pion's default codecs and interceptors, as
+// webrtc.NewPeerConnection would, and pion's logging and ICE set up as
+// configured.
+func newWebRTCAPI() (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	registry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, registry); err != nil {
+		return nil, err
+	}
+
+	loggerFactory := cfg.LoggerFactory()
+	settingEngine := webrtc.SettingEngine{
+		LoggerFactory: loggerFactory,
+	}
+	if err := configureICE(&settingEngine, loggerFactory); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(settingEngine),
+	), nil
+}
+
+// iceServers returns the configured ICE servers for pion.
+func iceServers() []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, 0, len(cfg.ICEServers))
+	for _, server := range cfg.ICEServers {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       server.URLs,
+			Username:   server.Username,
+			Credential: server.Credential,
+		})
+	}
+	return servers
+}
+
+// handleICEServers hands the browser the ICE servers the server uses, in the
+// shape of an RTCConfiguration:
+//
+//	GET /api/ice-servers  {"iceServers": [{"urls": ["stun:..."]}]}
+//
+// The list may hold the static credentials of TURN servers, so it takes the
+// same token as a session.
+func handleICEServers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if _, ok := authenticateHTTP(w, r); !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeAPIJSON(w, http.StatusOK, map[string]interface{}{
+		"iceServers": cfg.ICEServers,
+	})
+}
+
+// recordingPath returns where the file name is kept in the recording
+// directory, whatever the storage.
+func recordingPath(name string) string {
+	return filepath.Join(cfg.RecordingDir, name)
+}
+
+// recordings stores the recording files. main sets it up from cfg.Storage.
+var recordings storage.Sink
+
+// newRecordingSink returns the storage configured in cfg.Storage, encrypting
+// what it stores if a master key is configured.
+func newRecordingSink() (storage.Sink, error) {
+	var sink storage.Sink = storage.NewLocal(cfg.RecordingDir)
+	if cfg.Storage.Type == config.StorageS3 {
+		s3 := cfg.Storage.S3
+		var err error
+		sink, err = storage.NewS3(storage.S3Config{
+			Endpoint:        s3.Endpoint,
+			Region:          s3.Region,
+			Bucket:          s3.Bucket,
+			Prefix:          s3.Prefix,
+			AccessKeyID:     s3.AccessKeyID,
+			SecretAccessKey: s3.SecretAccessKey,
+			SessionToken:    s3.SessionToken,
+			PathStyle:       s3.PathStyle,
+			PartSize:        int(s3.PartSize),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !cfg.Storage.Encryption.Enabled() {
+		return sink, nil
+	}
+	key, err := masterKey(&cfg.Storage.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewEncrypted(sink, key), nil
+}
+
+// masterKey returns the master key recordings are encrypted with.
+func masterKey(encryption *config.EncryptionConfig) (*storage.MasterKey, error) {
+	key, err := encryption.MasterKey()
+	if err != nil {
+		return nil, fmt.Errorf("encryption key: %w", err)
+	}
+	return storage.NewMasterKey(key)
+}
+
+// plainRecordings returns the sink under the encryption of recordings, and
+// the master key if there is one, for uploads that encrypt what they write
+// themselves.
+func plainRecordings() (storage.Sink, *storage.MasterKey) {
+	if encrypted, ok := recordings.(*storage.Encrypted); ok {
+		return encrypted.Sink, encrypted.Key
+	}
+	return recordings, nil
+}
+
+// recordingFile names one of the session's recording files, from
+// cfg.RecordingName.
+func (s *session) recordingFile(take string) string {
+	return cfg.RecordingFile(s.id, s.subject(), take, time.Now())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mladenovic-13/pion-webrtc-app/config"
+	"github.com/mladenovic-13/pion-webrtc-app/storage"
+)
+
+// runDecryptCommand decrypts a recording encrypted at rest, for playback:
+//
+//	stream decrypt -encryption-key-file master.key -o take.webm output-1234-1.webm
+//	stream decrypt -encryption-key-file master.key output-1234-1.webm | ffplay -
+//
+// Recordings in S3 are downloaded first, or piped in as "-".
+func runDecryptCommand(args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	output := fs.String("o", "-", "`file` to write the decrypted recording to, or - for standard output")
+
+	c, err := config.Load(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: stream decrypt [flags] recording")
+	}
+	if !c.Storage.Encryption.Enabled() {
+		return errors.New("no encryption key is configured")
+	}
+	key, err := masterKey(&c.Storage.Encryption)
+	if err != nil {
+		return err
+	}
+
+	input := fs.Arg(0)
+	in := os.Stdin
+	if input != "-" {
+		if in, err = os.Open(input); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	w := bufio.NewWriter(out)
+
+	// What comes before a damaged or missing record is still written.
+	err = key.Decrypt(w, bufio.NewReader(in))
+	if flushErr := w.Flush(); flushErr != nil {
+		err = flushErr
+	}
+	if out != os.Stdout {
+		if closeErr := out.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+
+	switch {
+	case errors.Is(err, storage.ErrTruncated):
+		return fmt.Errorf("%s: %w; everything before the cut was decrypted", input, err)
+	case err != nil:
+		return fmt.Errorf("%s: %w", input, err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mladenovic-13/pion-webrtc-app/storage"
+)
+
+// writeKeyFile writes a new master key to a file in dir, as an operator
+// would, and returns the file and the key.
+func writeKeyFile(t *testing.T, dir, name string) (string, *storage.MasterKey) {
+	t.Helper()
+	raw := make([]byte, storage.KeySize)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(raw)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := storage.NewMasterKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, key
+}
+
+func TestDecryptCommand(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, key := writeKeyFile(t, dir, "master.key")
+	otherKeyFile, _ := writeKeyFile(t, dir, "other.key")
+
+	// The recording is written the way the server stores it.
+	data := bytes.Repeat([]byte("webm cluster "), 20000)
+	w, err := storage.NewEncrypted(storage.NewLocal(dir), key).Create("output-1234-1.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	recording := filepath.Join(dir, "output-1234-1.webm")
+
+	// A recording cut short loses its last, empty record of 32 bytes.
+	encrypted, err := os.ReadFile(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "truncated.webm")
+	if err := os.WriteFile(truncated, encrypted[:len(encrypted)-32], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		keyFile   string
+		input     string
+		wantErr   error
+		wantFail  bool
+		wantPlain bool
+	}{
+		{name: "complete", keyFile: keyFile, input: recording, wantPlain: true},
+		{name: "truncated", keyFile: keyFile, input: truncated, wantErr: storage.ErrTruncated, wantPlain: true},
+		{name: "wrong key", keyFile: otherKeyFile, input: recording, wantFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "take.webm")
+			err := runDecryptCommand([]string{"-encryption-key-file", tt.keyFile, "-o", output, tt.input})
+			switch {
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("decrypt error = %v, want %v", err, tt.wantErr)
+			case tt.wantFail && err == nil:
+				t.Error("decrypt succeeded")
+			case tt.wantErr == nil && !tt.wantFail && err != nil:
+				t.Errorf("decrypt: %v", err)
+			}
+
+			plain, readErr := os.ReadFile(output)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if tt.wantPlain && !bytes.Equal(plain, data) {
+				t.Errorf("decrypted %d bytes, want the %d recorded", len(plain), len(data))
+			}
+			if !tt.wantPlain && len(plain) > 0 {
+				t.Errorf("decrypted %d bytes with the wrong key", len(plain))
+			}
+		})
+	}
+}
+
+func TestDecryptCommandWithoutKey(t *testing.T) {
+	if err := runDecryptCommand([]string{"recording.webm"}); err == nil {
+		t.Error("decrypt succeeded without an encryption key")
+	}
+}
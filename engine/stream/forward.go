@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// publishedTrack is an incoming track that is forwarded to WHEP viewers and
+// to the other members of the publisher's room. Every packet read from
+// remote is written to each subscriber's own local track.
+type publishedTrack struct {
+	publisher *session
+	remote    *webrtc.TrackRemote
+
+	// mutex guards forwards and ended, which is set once the track is
+	// unpublished and keeps it from being forwarded again.
+	mutex    sync.RWMutex
+	forwards map[*webrtc.PeerConnection]*forwarding
+	ended    bool
+}
+
+// forwarding is the copy of a published track sent to one subscriber.
+type forwarding struct {
+	local  *webrtc.TrackLocalStaticRTP
+	sender *webrtc.RTPSender
+}
+
+// publish makes an incoming track available to viewers that subscribe from
+// now on, and forwards it to the other members of the session's room.
+func (s *session) publish(remote *webrtc.TrackRemote) *publishedTrack {
+	t := &publishedTrack{
+		publisher: s,
+		remote:    remote,
+		forwards:  make(map[*webrtc.PeerConnection]*forwarding),
+	}
+
+	// Adding the track under the rooms lock keeps a member joining at the
+	// same time from missing it: either the member is already in the
+	// snapshot, or joinRoom finds the track.
+	rooms.mutex.Lock()
+	s.tracksMutex.Lock()
+	s.tracks = append(s.tracks, t)
+	s.tracksMutex.Unlock()
+	others := s.roomMembersLocked()
+	rooms.mutex.Unlock()
+
+	for _, other := range others {
+		t.forwardToMember(other)
+	}
+	return t
+}
+
+// unpublish removes a track that has ended from the session and from every
+// subscriber's PeerConnection.
+func (s *session) unpublish(t *publishedTrack) {
+	s.tracksMutex.Lock()
+	for i, published := range s.tracks {
+		if published == t {
+			s.tracks = append(s.tracks[:i], s.tracks[i+1:]...)
+			break
+		}
+	}
+	s.tracksMutex.Unlock()
+
+	t.mutex.Lock()
+	t.ended = true
+	subscribers := make([]*webrtc.PeerConnection, 0, len(t.forwards))
+	for pc := range t.forwards {
+		subscribers = append(subscribers, pc)
+	}
+	t.mutex.Unlock()
+
+	for _, pc := range subscribers {
+		t.stopForwarding(pc)
+	}
+}
+
+// publishedTracks returns a snapshot of the session's published tracks.
+func (s *session) publishedTracks() []*publishedTrack {
+	s.tracksMutex.Lock()
+	defer s.tracksMutex.Unlock()
+
+	return append([]*publishedTrack(nil), s.tracks...)
+}
+
+// forward writes packet to every subscriber's copy of the track. Write
+// errors only mean that a subscriber is not connected (yet or any more) and
+// are ignored.
+func (t *publishedTrack) forward(packet *rtp.Packet) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for _, f := range t.forwards {
+		f.local.WriteRTP(packet)
+	}
+}
+
+// forwardTo adds a copy of the track to pc, unless it already has one or the
+// track has ended. The copy's stream ID is the publisher's session ID, so
+// subscribers can tell the publishers apart.
+func (t *publishedTrack) forwardTo(pc *webrtc.PeerConnection) error {
+	t.mutex.RLock()
+	_, forwarded := t.forwards[pc]
+	t.mutex.RUnlock()
+	if forwarded {
+		return nil
+	}
+
+	codec := t.remote.Codec()
+	local, err := webrtc.NewTrackLocalStaticRTP(codec.RTPCodecCapability, t.remote.ID(), t.publisher.id)
+	if err != nil {
+		return err
+	}
+	sender, err := pc.AddTrack(local)
+	if err != nil {
+		return err
+	}
+
+	// Another goroutine may have forwarded or ended the track while it was
+	// being added.
+	t.mutex.Lock()
+	_, forwarded = t.forwards[pc]
+	if forwarded || t.ended {
+		t.mutex.Unlock()
+		if err := pc.RemoveTrack(sender); err != nil && !errors.Is(err, webrtc.ErrConnectionClosed) {
+			return err
+		}
+		return nil
+	}
+	t.forwards[pc] = &forwarding{local: local, sender: sender}
+	t.mutex.Unlock()
+
+	go t.readRTCP(sender)
+	if t.remote.Kind() == webrtc.RTPCodecTypeVideo {
+		// Give the new subscriber a keyframe to start from.
+		t.publisher.requestKeyframe(t.remote.SSRC())
+	}
+	return nil
+}
+
+// forwardToMember forwards the track to another member of its publisher's
+// room. The two can leave the room while the track is being added, which
+// leaveRoom may not see, so the copy is taken off again if they have.
+func (t *publishedTrack) forwardToMember(member *session) {
+	if err := t.forwardTo(member.peerConnection); err != nil {
+		member.logf("Failed to forward track %s from %s: %v", t.remote.ID(), t.publisher.id, err)
+		return
+	}
+	if !t.publisher.sharesRoom(member) {
+		t.stopForwarding(member.peerConnection)
+	}
+}
+
+// stopForwarding removes the track's copy from pc, if it has one.
+func (t *publishedTrack) stopForwarding(pc *webrtc.PeerConnection) {
+	t.mutex.Lock()
+	f := t.forwards[pc]
+	delete(t.forwards, pc)
+	t.mutex.Unlock()
+
+	if f == nil {
+		return
+	}
+	if err := pc.RemoveTrack(f.sender); err != nil && !errors.Is(err, webrtc.ErrConnectionClosed) {
+		t.publisher.logf("Failed to remove forwarded track %s: %v", t.remote.ID(), err)
+	}
+}
+
+// readRTCP drains RTCP from a subscriber, which the interceptors need, and
+// passes keyframe requests on to the publisher.
+func (t *publishedTrack) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				t.publisher.requestKeyframe(t.remote.SSRC())
+			}
+		}
+	}
+}
+
+// subscribe forwards each of the session's published tracks to v and
+// registers v as a viewer. It fails once the session is closing, so that no
+// viewer outlives its publisher.
+//
+// A WHEP viewer cannot be sent a new offer, so it only ever gets the tracks
+// it subscribed to. Rather than leave it without the tracks that are still
+// to come, subscribe fails until every track the publisher has negotiated
+// has started.
+func (s *session) subscribe(v *viewer) error {
+	expected := s.negotiatedTracks()
+
+	s.tracksMutex.Lock()
+	defer s.tracksMutex.Unlock()
+
+	select {
+	case <-s.done:
+		return errSessionClosed
+	default:
+	}
+	if len(s.tracks) == 0 {
+		return errNoTracks
+	}
+	if len(s.tracks) < expected {
+		return errTracksPending
+	}
+
+	for _, t := range s.tracks {
+		if err := t.forwardTo(v.peerConnection); err != nil {
+			v.unsubscribeLocked()
+			return err
+		}
+		v.tracks = append(v.tracks, t)
+	}
+
+	s.viewers[v.id] = v
+	return nil
+}
+
+// negotiatedTracks returns how many audio and video tracks the publisher's
+// current remote description says it sends. Media sections without an msid
+// carry no track and are not counted.
+func (s *session) negotiatedTracks() int {
+	remote := s.peerConnection.CurrentRemoteDescription()
+	if remote == nil {
+		return 0
+	}
+	parsed, err := remote.Unmarshal()
+	if err != nil {
+		return 0
+	}
+
+	count := 0
+	for _, media := range parsed.MediaDescriptions {
+		kind := media.MediaName.Media
+		if (kind != "audio" && kind != "video") || media.MediaName.Port.Value == 0 {
+			continue
+		}
+		_, hasTrack := media.Attribute("msid")
+		_, recvonly := media.Attribute("recvonly")
+		_, inactive := media.Attribute("inactive")
+		if hasTrack && !recvonly && !inactive {
+			count++
+		}
+	}
+	return count
+}
+
+// unsubscribeLocked stops forwarding to v. The caller must hold the
+// publisher's tracksMutex.
+func (v *viewer) unsubscribeLocked() {
+	for _, t := range v.tracks {
+		t.stopForwarding(v.peerConnection)
+	}
+	v.tracks = nil
+	delete(v.publisher.viewers, v.id)
+}
+
+// getViewer returns the viewer of the session with the given ID.
+func (s *session) getViewer(id string) (*viewer, bool) {
+	s.tracksMutex.Lock()
+	defer s.tracksMutex.Unlock()
+
+	v, ok := s.viewers[id]
+	return v, ok
+}
+
+// closeViewers ends every viewer of the session. It is called once the
+// session is done, so subscribe adds no more.
+func (s *session) closeViewers() {
+	s.tracksMutex.Lock()
+	viewers := make([]*viewer, 0, len(s.viewers))
+	for _, v := range s.viewers {
+		viewers = append(viewers, v)
+	}
+	s.tracksMutex.Unlock()
+
+	for _, v := range viewers {
+		v.close()
+	}
+}
+
+func (s *session) viewerCount() int {
+	s.tracksMutex.Lock()
+	defer s.tracksMutex.Unlock()
+
+	return len(s.viewers)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+
+	"github.com/mladenovic-13/pion-webrtc-app/config"
+	"github.com/pion/ice/v4"
+	"github.com/pion/logging"
+	"github.com/pion/webrtc/v4"
+)
+
+// iceTCPReadBufferSize is the number of packets buffered for each ICE-TCP
+// connection before it is matched to a PeerConnection.
+const iceTCPReadBufferSize = 8
+
+// configureICE applies cfg.ICE to the setting engine shared by every
+// PeerConnection.
+func configureICE(settingEngine *webrtc.SettingEngine, loggerFactory logging.LoggerFactory) error {
+	c := cfg.ICE
+
+	var networkTypes []webrtc.NetworkType
+	for _, t := range []webrtc.NetworkType{
+		webrtc.NetworkTypeUDP4,
+		webrtc.NetworkTypeUDP6,
+		webrtc.NetworkTypeTCP4,
+		webrtc.NetworkTypeTCP6,
+	} {
+		if c.AllowsNetwork(t.String()) {
+			networkTypes = append(networkTypes, t)
+		}
+	}
+	settingEngine.SetNetworkTypes(networkTypes)
+	if len(c.Interfaces) > 0 {
+		settingEngine.SetInterfaceFilter(c.AllowsInterface)
+	}
+	if len(c.IPs) > 0 {
+		settingEngine.SetIPFilter(c.AllowsIP)
+	}
+	if c.PortRange.Max != 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(c.PortRange.Min, c.PortRange.Max); err != nil {
+			return err
+		}
+	}
+	switch c.MDNS {
+	case config.MDNSDisabled:
+		settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	case config.MDNSGather:
+		settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryAndGather)
+	default:
+		settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeQueryOnly)
+	}
+
+	// With a mux, every PeerConnection's candidates are on the same port and
+	// sessions are told apart by their ICE username fragments.
+	if c.UDPListen != "" {
+		mux, err := newICEUDPMux(c.UDPListen, loggerFactory.NewLogger("ice-udp-mux"))
+		if err != nil {
+			return err
+		}
+		settingEngine.SetICEUDPMux(mux)
+	}
+
+	if c.TCPListen != "" {
+		listener, err := net.Listen("tcp", c.TCPListen)
+		if err != nil {
+			return err
+		}
+		settingEngine.SetICETCPMux(webrtc.NewICETCPMux(loggerFactory.NewLogger("ice-tcp-mux"), listener, iceTCPReadBufferSize))
+	}
+
+	if len(c.NAT1To1IPs) > 0 {
+		candidateType := webrtc.ICECandidateTypeHost
+		if c.NAT1To1CandidateType == "srflx" {
+			candidateType = webrtc.ICECandidateTypeSrflx
+		}
+		settingEngine.SetNAT1To1IPs(c.NAT1To1IPs, candidateType)
+	}
+
+	return nil
+}
+
+// newICEUDPMux listens on address for the ICE traffic of every
+// PeerConnection.
+func newICEUDPMux(address string, logger logging.LeveledLogger) (ice.UDPMux, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// A socket bound to the unspecified address cannot tell which local
+	// address to put in candidates, so every local address gets its own,
+	// subject to the same filters as gathering.
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		c := cfg.ICE
+		var networks []ice.NetworkType
+		for _, t := range []ice.NetworkType{ice.NetworkTypeUDP4, ice.NetworkTypeUDP6} {
+			if c.AllowsNetwork(t.String()) {
+				networks = append(networks, t)
+			}
+		}
+		return ice.NewMultiUDPMuxFromPort(addr.Port,
+			ice.UDPMuxFromPortWithLogger(logger),
+			ice.UDPMuxFromPortWithNetworks(networks...),
+			ice.UDPMuxFromPortWithInterfaceFilter(c.AllowsInterface),
+			ice.UDPMuxFromPortWithIPFilter(c.AllowsIP),
+		)
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return webrtc.NewICEUDPMux(logger, conn), nil
+}
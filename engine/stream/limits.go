@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+	"github.com/mladenovic-13/pion-webrtc-app/storage"
+)
+
+// sessionCounts tracks the open sessions of every client IP and token
+// subject, for the limits in cfg.Limits.
+var sessionCounts = struct {
+	mutex     sync.Mutex
+	byIP      map[string]int
+	bySubject map[string]int
+}{
+	byIP:      make(map[string]int),
+	bySubject: make(map[string]int),
+}
+
+// recordingQuota guards what sessions have recorded and how much of the
+// recording directory is used, so that checking a write against the limits
+// and charging it for it are one step. used is what was in the directory on
+// startup, plus what has been written to it since, less what has been
+// truncated or removed.
+var recordingQuota struct {
+	mutex sync.Mutex
+	used  int64
+}
+
+// admitSession counts a new session against its client's limits, or
+// returns a quota-exceeded error if it would go over one. Every admitted
+// session is released by releaseSession.
+func admitSession(ip, subject string) error {
+	sessionCounts.mutex.Lock()
+	defer sessionCounts.mutex.Unlock()
+
+	limits := cfg.Limits
+	if limits.MaxSessionsPerIP > 0 && sessionCounts.byIP[ip] >= limits.MaxSessionsPerIP {
+		return signaling.NewError(signaling.CodeQuotaExceeded, "too many sessions from %s, the limit is %d", ip, limits.MaxSessionsPerIP)
+	}
+	if subject != "" && limits.MaxSessionsPerClient > 0 && sessionCounts.bySubject[subject] >= limits.MaxSessionsPerClient {
+		return signaling.NewError(signaling.CodeQuotaExceeded, "too many sessions for %s, the limit is %d", subject, limits.MaxSessionsPerClient)
+	}
+
+	sessionCounts.byIP[ip]++
+	if subject != "" {
+		sessionCounts.bySubject[subject]++
+	}
+	return nil
+}
+
+func releaseSession(ip, subject string) {
+	sessionCounts.mutex.Lock()
+	defer sessionCounts.mutex.Unlock()
+
+	if sessionCounts.byIP[ip]--; sessionCounts.byIP[ip] <= 0 {
+		delete(sessionCounts.byIP, ip)
+	}
+	if subject != "" {
+		if sessionCounts.bySubject[subject]--; sessionCounts.bySubject[subject] <= 0 {
+			delete(sessionCounts.bySubject, subject)
+		}
+	}
+}
+
+// remoteIP returns the IP of a host:port remote address.
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// maxDuration returns how long the session may last: the shorter of the
+// server's limit and its token's, or zero for no limit.
+func (s *session) maxDuration() time.Duration {
+	limit := time.Duration(cfg.Limits.MaxSessionDuration)
+	if s.claims != nil && s.claims.Duration() > 0 && (limit == 0 || s.claims.Duration() < limit) {
+		limit = s.claims.Duration()
+	}
+	return limit
+}
+
+// measureDiskUsage sets the disk usage to the size of the files already in
+// the recording directory. Config.Validate makes sure the directory is a
+// dedicated one when the disk usage is limited.
+func measureDiskUsage() error {
+	if cfg.Limits.MaxDiskUsage == 0 {
+		return nil
+	}
+
+	var total int64
+	err := filepath.WalkDir(cfg.RecordingDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	recordingQuota.mutex.Lock()
+	recordingQuota.used = total
+	recordingQuota.mutex.Unlock()
+	return err
+}
+
+// checkRecordingQuota returns a quota-exceeded error if n more bytes
+// recorded by the session would go over its recording size limit, or if
+// onDisk, the disk usage limit. The caller must hold recordingQuota.mutex.
+func (s *session) checkRecordingQuota(n int64, onDisk bool) error {
+	if limit := int64(cfg.Limits.MaxRecordingSize); limit > 0 && s.bytesRecorded.Load()+n > limit {
+		return signaling.NewError(signaling.CodeQuotaExceeded, "the session's recording limit of %s is reached", cfg.Limits.MaxRecordingSize)
+	}
+	if limit := int64(cfg.Limits.MaxDiskUsage); onDisk && limit > 0 && recordingQuota.used+n > limit {
+		return signaling.NewError(signaling.CodeQuotaExceeded, "the server's recording space of %s is used up", cfg.Limits.MaxDiskUsage)
+	}
+	return nil
+}
+
+// canRecord returns a quota-exceeded error if the session cannot record
+// anything more.
+func (s *session) canRecord() error {
+	recordingQuota.mutex.Lock()
+	defer recordingQuota.mutex.Unlock()
+	return s.checkRecordingQuota(1, recordingsOnDisk())
+}
+
+// reserveRecording accounts for n more bytes recorded by the session, and
+// if onDisk written to the recording directory, unless checkRecordingQuota
+// fails.
+func (s *session) reserveRecording(n int64, onDisk bool) error {
+	recordingQuota.mutex.Lock()
+	defer recordingQuota.mutex.Unlock()
+
+	if err := s.checkRecordingQuota(n, onDisk); err != nil {
+		return err
+	}
+	s.bytesRecorded.Add(n)
+	if onDisk {
+		recordingQuota.used += n
+	}
+	return nil
+}
+
+// releaseDisk gives back n bytes of the recording directory, for files that
+// were truncated, removed or uploaded.
+func releaseDisk(n int64) {
+	recordingQuota.mutex.Lock()
+	recordingQuota.used -= n
+	recordingQuota.mutex.Unlock()
+}
+
+// recordingsOnDisk reports whether the recording storage keeps files in the
+// recording directory, rather than uploading them as they are written.
+func recordingsOnDisk() bool {
+	sink, _ := plainRecordings()
+	_, ok := sink.(*storage.Local)
+	return ok
+}
+
+// recordingWriter writes one of a session's recording files, charging what
+// it writes to the session's quotas, and to the disk usage if the file is in
+// the recording directory. The first write that would go over a quota is
+// reported to the browser, and every write that would fails.
+type recordingWriter struct {
+	session *session
+	file    io.WriteCloser
+	onDisk  bool
+}
+
+func (s *session) recordingWriter(file io.WriteCloser, onDisk bool) io.WriteCloser {
+	return &recordingWriter{session: s, file: file, onDisk: onDisk}
+}
+
+func (r *recordingWriter) Write(p []byte) (int, error) {
+	if err := r.session.reserveRecording(int64(len(p)), r.onDisk); err != nil {
+		if r.session.quotaReported.CompareAndSwap(false, true) {
+			r.session.logf("Recording stopped: %s", signaling.AsError(err).Message)
+			r.session.reportError(err)
+		}
+		return 0, err
+	}
+	return r.file.Write(p)
+}
+
+func (r *recordingWriter) Close() error {
+	return r.file.Close()
+}
@@ -1,164 +1,233 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/mladenovic-13/pion-webrtc-app/config"
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
 	"github.com/pion/webrtc/v4"
 )
 
-// Define constants and variables
-const (
-	webPort = ":8080"
-)
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin:     checkOrigin,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		commands := map[string]func([]string) error{
+			"token":   runTokenCommand,
+			"recover": runRecoverCommand,
+			"decrypt": runDecryptCommand,
+		}
+		if command := commands[os.Args[1]]; command != nil {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
+	var err error
+	if cfg, err = config.Load(flag.CommandLine, os.Args[1:]); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if err := os.MkdirAll(cfg.RecordingDir, 0o755); err != nil {
+		log.Fatal("Failed to create recording directory: ", err)
+	}
+	if err := measureDiskUsage(); err != nil {
+		log.Fatal("Failed to measure recording directory: ", err)
+	}
+	if recordings, err = newRecordingSink(); err != nil {
+		log.Fatal("Failed to set up recording storage: ", err)
+	}
+	log.Printf("Storing recordings in %s", recordings)
+	if api, err = newWebRTCAPI(); err != nil {
+		log.Fatal("Failed to set up WebRTC: ", err)
+	}
+	if cfg.TURN.Listen != "" {
+		if err := startTURNServer(); err != nil {
+			log.Fatal("Failed to start TURN relay: ", err)
+		}
+	}
+
+	if cfg.AdminListen != "" {
+		if err := startAdminServer(); err != nil {
+			log.Fatal("Failed to start admin API: ", err)
+		}
+	}
+
 	http.HandleFunc("/ws", handleWebSocket)
-	fs := http.FileServer(http.Dir("./web"))
+	http.HandleFunc(iceServersAPIPath, handleICEServers)
+	http.HandleFunc(whipPath, handleWHIP)
+	http.HandleFunc(whipPath+"/", handleWHIP)
+	http.HandleFunc(whepPath+"/", handleWHEP)
+	fs := http.FileServer(http.Dir(cfg.StaticDir))
 	http.Handle("/", fs)
 
-	fmt.Printf("Starting server at http://localhost%s\n", webPort)
-	log.Fatal(http.ListenAndServe(webPort, nil))
+	log.Fatal(listenAndServe())
 }
 
+// sessionQueryParam names the session that a reconnecting browser picks up
+// again, and reconnectQueryParam carries the reconnect token it was given
+// for it, as in /ws?session=<id>&reconnect=<token>.
+const (
+	sessionQueryParam   = "session"
+	reconnectQueryParam = "reconnect"
+)
+
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("WebSocket Upgrade Error:", err)
 		return
 	}
-	defer conn.Close()
 
-	peerConnection, err := createPeerConnection()
+	// Nothing is allocated for a client until it has shown a valid token.
+	claims, err := authenticateWebSocket(conn, r)
 	if err != nil {
-		log.Println("Failed to create PeerConnection:", err)
+		log.Printf("Rejected WebSocket from %s: %v", r.RemoteAddr, err)
+		rejectWebSocket(conn, signaling.NewError(signaling.CodeUnauthorized, "%v", err))
 		return
 	}
 
-	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
+	var s *session
+	var reconnectToken string
+	if id := r.URL.Query().Get(sessionQueryParam); id != "" {
+		var ok bool
+		s, ok = sessions.get(id)
+		// A session can only be picked up again by the client that opened
+		// it, which alone was sent its reconnect token, and with a token for
+		// the same subject.
+		if ok && (!s.hasSecret(r.URL.Query().Get(reconnectQueryParam)) ||
+			(claims != nil && claims.Subject != s.subject())) {
+			log.Printf("Refused to reattach %s to session %s", r.RemoteAddr, id)
+			ok = false
+		}
+		if !ok || s.protocol != protocolWebSocket {
+			// The browser starts over with a new session when it gets this.
+			rejectWebSocket(conn, signaling.NewError(signaling.CodeUnknownSession, "no session %q", id))
 			return
 		}
-
-		if err := conn.WriteJSON(map[string]interface{}{
-			"type":      "candidate",
-			"candidate": candidate.ToJSON(),
-		}); err != nil {
-			log.Println("Failed to send ICE candidate:", err)
+		s.logf("Signaling reconnected from %s", r.RemoteAddr)
+		s.attach(conn)
+	} else {
+		s, err = newSession(protocolWebSocket, conn.RemoteAddr().String(), conn, claims)
+		if err != nil {
+			log.Printf("Failed to create session for %s: %v", r.RemoteAddr, err)
+			rejectWebSocket(conn, signaling.AsError(err))
+			return
 		}
-	})
+		if claims != nil && claims.Subject != "" {
+			s.logf("New session from %s for %s", r.RemoteAddr, claims.Subject)
+		} else {
+			s.logf("New session from %s", r.RemoteAddr)
+		}
+		reconnectToken = s.secret
+	}
+
+	// A reconnecting browser gets new TURN credentials, in case the old ones
+	// have expired, but it already has its reconnect token.
+	if err := s.writeMessage(&signaling.Session{
+		ID:             s.id,
+		ReconnectToken: reconnectToken,
+		ICEServers:     s.turnICEServers(),
+	}); err != nil {
+		s.logf("Failed to send session ID: %v", err)
+	}
+	s.resendPendingOffer()
+	s.serveWebSocket(conn)
+}
 
+// rejectWebSocket sends an error to a connection that has no session and
+// closes it.
+func rejectWebSocket(conn *websocket.Conn, e *signaling.Error) {
+	if data, err := signaling.Encode(e); err == nil {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		conn.WriteMessage(websocket.TextMessage, data)
+	}
+	conn.Close()
+}
+
+// serveWebSocket handles the browser's messages on conn until it closes. A
+// connection that breaks leaves the session waiting for the browser to
+// reconnect; see updateReconnectTimer.
+func (s *session) serveWebSocket(conn *websocket.Conn) {
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			log.Println("WebSocket Read Error:", err)
-			break
+			select {
+			case <-s.done:
+			default:
+				s.logf("WebSocket Read Error: %v", err)
+			}
+			s.detach(conn)
+			return
 		}
 
-		var msg map[string]interface{}
-		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Println("JSON Unmarshal Error:", err)
+		msg, err := signaling.Decode(message)
+		if err != nil {
+			s.logf("Rejected signaling message: %v", err)
+			if err := s.writeMessage(signaling.AsError(err)); err != nil {
+				s.logf("Failed to send error: %v", err)
+			}
 			continue
 		}
+		s.debugf("Received %s message", msg.Type())
 
-		switch msg["type"] {
-		case "offer":
-			offer := webrtc.SessionDescription{
-				Type: webrtc.SDPTypeOffer,
-				SDP:  msg["sdp"].(string),
-			}
-
-			if err := peerConnection.SetRemoteDescription(offer); err != nil {
-				log.Println("Failed to set remote description:", err)
+		switch msg := msg.(type) {
+		case *signaling.Offer:
+			if err := s.handleOffer(msg); err != nil {
+				s.logf("%v", err)
+				s.close()
 				return
 			}
 
-			answer, err := peerConnection.CreateAnswer(nil)
-			if err != nil {
-				log.Println("Failed to create answer:", err)
-				return
-			}
-			if err := peerConnection.SetLocalDescription(answer); err != nil {
-				log.Println("Failed to set local description:", err)
-				return
-			}
-
-			if err := conn.WriteJSON(map[string]interface{}{
-				"type": "answer",
-				"sdp":  answer.SDP,
-			}); err != nil {
-				log.Println("Failed to send answer:", err)
-			}
+		case *signaling.Answer:
+			s.handleAnswer(msg)
 
-		case "candidate":
-			candidate := webrtc.ICECandidateInit{
-				Candidate: msg["candidate"].(string),
-			}
-			if err := peerConnection.AddICECandidate(candidate); err != nil {
-				log.Println("Failed to add ICE candidate:", err)
-			}
+		case *signaling.Candidate:
+			s.handleCandidate(msg)
 
-		case "start-recording":
-			log.Println("Starting recording")
-
-		case "stop-recording":
-			log.Println("Stopping recording")
-		}
-	}
-}
+		case *signaling.EndOfCandidates:
+			s.handleEndOfCandidates()
 
-func createPeerConnection() (*webrtc.PeerConnection, error) {
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
+		case *signaling.StartRecording:
+			s.startTake(msg)
 
-	peerConnection, err := webrtc.NewPeerConnection(config)
-	if err != nil {
-		return nil, err
-	}
+		case *signaling.StopRecording:
+			s.stopTake()
 
-	webmFile, err := os.Create("output.webm")
-	if err != nil {
-		return nil, err
-	}
+		case *signaling.ResumeUpload:
+			s.handleResumeUpload(msg)
 
-	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
-		fmt.Printf("New DataChannel %s %d\n", d.Label(), d.ID())
+		case *signaling.Join:
+			s.joinRoom(msg)
 
-		d.OnMessage(func(msg webrtc.DataChannelMessage) {
-			if _, err := webmFile.Write(msg.Data); err != nil {
-				log.Println("Error writing to WebM file:", err)
-			}
-		})
-	})
+		case *signaling.Leave:
+			s.leaveRoom()
 
-	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		fmt.Printf("ICE Connection State has changed: %s\n", connectionState.String())
+		case *signaling.Bye:
+			s.logf("Peer said bye")
+			s.close()
+			return
 
-		if connectionState == webrtc.ICEConnectionStateDisconnected {
-			fmt.Println("Peer disconnected")
-			if err := webmFile.Close(); err != nil {
-				log.Println("Error closing WebM file:", err)
-			}
-			os.Exit(0)
+		default:
+			s.writeError(signaling.CodeUnknownType, "unexpected %s message", msg.Type())
 		}
-	})
+	}
+}
 
-	return peerConnection, nil
+// createPeerConnection builds a PeerConnection with the server's ICE
+// configuration. Callers attach their own handlers.
+func createPeerConnection() (*webrtc.PeerConnection, error) {
+	return api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: iceServers(),
+	})
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+	"github.com/pion/webrtc/v4"
+)
+
+// Either side may offer at any time during a session: the browser when it
+// adds tracks, the server when forwarded tracks or data channels are added or
+// removed. Offers that cross are resolved with perfect negotiation, in which
+// the server is the impolite peer: it ignores a browser offer that collides
+// with its own, and the browser rolls back its offer and answers the
+// server's instead, offering again afterwards.
+
+// handleOffer applies the browser's offer and replies with an answer. Any
+// candidates that arrived before the offer are applied once the remote
+// description is in place.
+func (s *session) handleOffer(msg *signaling.Offer) error {
+	s.negotiationMutex.Lock()
+	defer s.negotiationMutex.Unlock()
+
+	s.ignoreOffer = s.peerConnection.SignalingState() != webrtc.SignalingStateStable
+	if s.ignoreOffer {
+		s.logf("Ignoring offer that collided with ours in signaling state %s", s.peerConnection.SignalingState())
+		return nil
+	}
+
+	offer := webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  msg.SDP,
+	}
+
+	if err := s.peerConnection.SetRemoteDescription(offer); err != nil {
+		s.writeError(signaling.CodeInvalidMessage, "invalid offer: %v", err)
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+
+	answer, err := s.peerConnection.CreateAnswer(nil)
+	if err != nil {
+		s.writeError(signaling.CodeInternal, "failed to create answer")
+		return fmt.Errorf("failed to create answer: %w", err)
+	}
+	if err := s.peerConnection.SetLocalDescription(answer); err != nil {
+		s.writeError(signaling.CodeInternal, "failed to create answer")
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	if err := s.writeMessage(&signaling.Answer{SDP: answer.SDP}); err != nil {
+		s.logf("Failed to send answer: %v", err)
+	}
+
+	s.flushPendingCandidates()
+	return nil
+}
+
+// handleAnswer applies the browser's answer to an offer from renegotiate.
+func (s *session) handleAnswer(msg *signaling.Answer) {
+	s.negotiationMutex.Lock()
+	defer s.negotiationMutex.Unlock()
+
+	if state := s.peerConnection.SignalingState(); state != webrtc.SignalingStateHaveLocalOffer {
+		s.writeError(signaling.CodeInvalidState, "unexpected answer in signaling state %s", state)
+		return
+	}
+
+	if err := s.peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  msg.SDP,
+	}); err != nil {
+		s.logf("Failed to set remote description: %v", err)
+		s.writeError(signaling.CodeInvalidMessage, "invalid answer: %v", err)
+	}
+}
+
+// renegotiate sends the browser a new offer after tracks or data channels
+// were added to or removed from the PeerConnection. Nothing is sent before
+// the browser's own offer has been answered or while another exchange is in
+// progress; pion asks again once the signaling state is stable.
+func (s *session) renegotiate() {
+	s.sendOffer(nil)
+}
+
+// restartICE offers the browser new ICE credentials after the connection
+// was interrupted. The browser may restart ICE itself at the same time;
+// perfect negotiation sorts out which offer wins. While another exchange is
+// in progress the restart is put off until the signaling state is stable
+// again; see resumeICERestart.
+func (s *session) restartICE() {
+	s.negotiationMutex.Lock()
+	defer s.negotiationMutex.Unlock()
+
+	if s.peerConnection.SignalingState() != webrtc.SignalingStateStable {
+		s.restartPending = true
+		return
+	}
+	s.sendOfferLocked(&webrtc.OfferOptions{ICERestart: true})
+}
+
+// resumeICERestart sends the restart that restartICE put off, once the
+// signaling state is stable, unless ICE has recovered in the meantime.
+func (s *session) resumeICERestart() {
+	s.negotiationMutex.Lock()
+	defer s.negotiationMutex.Unlock()
+
+	if !s.restartPending || s.peerConnection.SignalingState() != webrtc.SignalingStateStable {
+		return
+	}
+	s.restartPending = false
+	if s.peerConnection.ICEConnectionState() != webrtc.ICEConnectionStateDisconnected {
+		return
+	}
+	s.sendOfferLocked(&webrtc.OfferOptions{ICERestart: true})
+}
+
+func (s *session) sendOffer(options *webrtc.OfferOptions) {
+	s.negotiationMutex.Lock()
+	defer s.negotiationMutex.Unlock()
+
+	s.sendOfferLocked(options)
+}
+
+// sendOfferLocked is sendOffer for a caller that holds negotiationMutex.
+func (s *session) sendOfferLocked(options *webrtc.OfferOptions) {
+	select {
+	case <-s.done:
+		// Leaving the room on close takes the forwarded tracks off this
+		// PeerConnection too; there is no one left to tell.
+		return
+	default:
+	}
+	if s.peerConnection.SignalingState() != webrtc.SignalingStateStable ||
+		s.peerConnection.RemoteDescription() == nil {
+		return
+	}
+
+	if s.protocol != protocolWebSocket {
+		// WHIP clients restart ICE themselves, with a PATCH request.
+		return
+	}
+
+	offer, err := s.peerConnection.CreateOffer(options)
+	if err != nil {
+		s.logf("Failed to create offer: %v", err)
+		return
+	}
+	if err := s.peerConnection.SetLocalDescription(offer); err != nil {
+		s.logf("Failed to set local description: %v", err)
+		return
+	}
+
+	if err := s.writeMessage(&signaling.Offer{SDP: offer.SDP}); err != nil {
+		// The offer is sent again when the browser reconnects.
+		s.logf("Failed to send offer: %v", err)
+		return
+	}
+	if options != nil && options.ICERestart {
+		s.logf("Sent ICE restart offer")
+	} else {
+		s.logf("Sent renegotiation offer")
+	}
+}
+
+// resendPendingOffer repeats an offer the browser has not answered yet, for
+// a browser that has just reconnected its WebSocket and may have missed it.
+func (s *session) resendPendingOffer() {
+	s.negotiationMutex.Lock()
+	defer s.negotiationMutex.Unlock()
+
+	if s.peerConnection.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		return
+	}
+	if err := s.writeMessage(&signaling.Offer{SDP: s.peerConnection.LocalDescription().SDP}); err != nil {
+		s.logf("Failed to resend offer: %v", err)
+	}
+}
+
+// handleCandidate adds a trickled candidate, keeping sdpMid, sdpMLineIndex
+// and usernameFragment intact.
+func (s *session) handleCandidate(msg *signaling.Candidate) {
+	s.negotiationMutex.Lock()
+	defer s.negotiationMutex.Unlock()
+
+	s.addICECandidate(webrtc.ICECandidateInit(*msg.Candidate))
+}
+
+// handleEndOfCandidates tells the ICE agent that the browser has finished
+// gathering. Pion treats an empty candidate as end-of-candidates.
+func (s *session) handleEndOfCandidates() {
+	s.negotiationMutex.Lock()
+	defer s.negotiationMutex.Unlock()
+
+	s.addICECandidate(webrtc.ICECandidateInit{})
+}
+
+// addICECandidate adds candidate to the PeerConnection, or queues it when
+// the remote description has not been set yet. The caller must hold
+// negotiationMutex, which also guards the queue and ignoreOffer: the read
+// loop of a replaced WebSocket can still be running when the browser
+// reattaches, and candidates must not be applied halfway through an offer.
+func (s *session) addICECandidate(candidate webrtc.ICECandidateInit) {
+	if s.peerConnection.RemoteDescription() == nil {
+		s.pendingCandidates = append(s.pendingCandidates, candidate)
+		return
+	}
+
+	if err := s.peerConnection.AddICECandidate(candidate); err != nil {
+		if s.ignoreOffer {
+			// Candidates for an ignored offer are expected to fail.
+			return
+		}
+		s.logf("Failed to add ICE candidate: %v", err)
+		s.writeError(signaling.CodeInvalidMessage, "invalid candidate: %v", err)
+	}
+}
+
+// flushPendingCandidates applies the queued candidates. The caller must hold
+// negotiationMutex.
+func (s *session) flushPendingCandidates() {
+	pending := s.pendingCandidates
+	s.pendingCandidates = nil
+
+	for _, candidate := range pending {
+		s.addICECandidate(candidate)
+	}
+}
+
+// sendLocalCandidate trickles a gathered candidate to the browser. A nil
+// candidate marks the end of gathering.
+func (s *session) sendLocalCandidate(candidate *webrtc.ICECandidate) {
+	var msg signaling.Message = &signaling.EndOfCandidates{}
+	if candidate != nil {
+		candidateInit := signaling.ICECandidateInit(candidate.ToJSON())
+		msg = &signaling.Candidate{Candidate: &candidateInit}
+	}
+
+	if err := s.writeMessage(msg); err != nil {
+		s.logf("Failed to send ICE candidate: %v", err)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/at-wat/ebml-go/webm"
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+const (
+	// maxLatePackets is how many packets the sample builders hold back
+	// waiting for reordered or retransmitted packets.
+	maxLatePackets = 128
+
+	// keyframeInterval is how often a picture loss indication is sent to
+	// the browser so that recordings get regular keyframes.
+	keyframeInterval = 3 * time.Second
+
+	// videoStartTimeout is how long audio waits for the first video keyframe
+	// before the recording is started without video.
+	videoStartTimeout = 5 * time.Second
+
+	audioTrackNumber = 1
+	videoTrackNumber = 2
+)
+
+// webmRecorder muxes a session's incoming Opus and VP8/VP9 RTP tracks into a
+// WebM file in the recording storage. The file is created lazily: when the
+// session has a video track the container is started on the first video
+// keyframe, because the frame size is only known then, otherwise on the first
+// audio frame. Audio stops waiting for video after videoStartTimeout, or as
+// soon as the video track turns out to be in a codec that cannot be muxed.
+type webmRecorder struct {
+	mutex sync.Mutex
+	name  string
+	// wrap is applied to the file before anything is written to it.
+	wrap func(io.WriteCloser) io.WriteCloser
+
+	hasAudio   bool
+	hasVideo   bool
+	videoCodec string
+
+	audioWriter    webm.BlockWriteCloser
+	videoWriter    webm.BlockWriteCloser
+	audioTimestamp time.Duration
+	videoTimestamp time.Duration
+
+	// audioWaiting is when the first audio frame arrived while the
+	// recorder was waiting for video.
+	audioWaiting time.Time
+
+	started bool
+	// failed is set once the file could not be started. Everything written
+	// afterwards is dropped.
+	failed bool
+	closed bool
+}
+
+func newWebMRecorder(name string, hasAudio, hasVideo bool, wrap func(io.WriteCloser) io.WriteCloser) *webmRecorder {
+	return &webmRecorder{
+		name:     name,
+		wrap:     wrap,
+		hasAudio: hasAudio,
+		hasVideo: hasVideo,
+	}
+}
+
+// videoFrameInfo is attached to video samples by the sample builder's head
+// packet handler.
+type videoFrameInfo struct {
+	keyframe      bool
+	width, height int
+}
+
+// handleTrack reads a remote track until it ends, forwards its packets to
+// any WHEP viewers and feeds its frames to the session's WebM recorder.
+func (s *session) handleTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	codec := track.Codec()
+	s.logf("New %s track %s (%s)", track.Kind(), track.ID(), codec.MimeType)
+
+	published := s.publish(track)
+	defer s.unpublish(published)
+
+	var builder *samplebuilder.SampleBuilder
+	var write func(*media.Sample) error
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		builder = samplebuilder.New(maxLatePackets, &codecs.OpusPacket{}, codec.ClockRate)
+		write = func(sample *media.Sample) error {
+			return s.webmRecorder().writeAudio(sample)
+		}
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		builder = samplebuilder.New(maxLatePackets, &codecs.VP8Packet{}, codec.ClockRate)
+		write = func(sample *media.Sample) error {
+			return s.webmRecorder().writeVideo("V_VP8", sample, vp8FrameInfo(sample.Data))
+		}
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+		builder = samplebuilder.New(maxLatePackets, &codecs.VP9Packet{}, codec.ClockRate,
+			samplebuilder.WithPacketHeadHandler(vp9FrameInfo))
+		write = func(sample *media.Sample) error {
+			info, _ := sample.Metadata.(videoFrameInfo)
+			return s.webmRecorder().writeVideo("V_VP9", sample, info)
+		}
+	default:
+		// The track can still be forwarded to viewers.
+		s.logf("Not recording track %s: unsupported codec %s", track.ID(), codec.MimeType)
+		if track.Kind() == webrtc.RTPCodecTypeVideo && s.mayRecord() {
+			s.webmRecorder().dropVideo()
+		}
+	}
+	if builder != nil && !s.mayRecord() {
+		s.logf("Not recording track %s: recording is not permitted", track.ID())
+		builder = nil
+	}
+
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		go s.requestKeyframes(track.SSRC())
+	}
+
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logf("Error reading RTP from track %s: %v", track.ID(), err)
+			}
+			return
+		}
+		s.bytesReceived.Add(int64(packet.MarshalSize()))
+		published.forward(packet)
+
+		if builder == nil {
+			continue
+		}
+		builder.Push(packet)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			if err := write(sample); err != nil {
+				// Keep forwarding even though the recording is lost.
+				s.logf("Error recording track %s: %v", track.ID(), err)
+				// Going over a quota has been reported by the recording
+				// writer already.
+				var quotaErr *signaling.Error
+				if !errors.As(err, &quotaErr) {
+					s.writeError(signaling.CodeInternal, "recording of track %s failed", track.ID())
+				}
+				builder = nil
+				break
+			}
+		}
+	}
+}
+
+// webmRecorder returns the session's RTP recorder, creating it on first use.
+// By the time tracks arrive the offer has been applied, so the negotiated
+// transceivers tell which tracks the file will contain.
+func (s *session) webmRecorder() *webmRecorder {
+	s.recorderOnce.Do(func() {
+		hasAudio, hasVideo := mediaKinds(s.peerConnection)
+		onDisk := recordingsOnDisk()
+		s.recorder = newWebMRecorder(s.recordingFile("rtp"), hasAudio, hasVideo, func(file io.WriteCloser) io.WriteCloser {
+			return s.recordingWriter(file, onDisk)
+		})
+	})
+	return s.recorder
+}
+
+// requestKeyframes sends a picture loss indication for ssrc every
+// keyframeInterval until the session ends.
+func (s *session) requestKeyframes(ssrc webrtc.SSRC) {
+	ticker := time.NewTicker(keyframeInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.requestKeyframe(ssrc); err != nil {
+			return
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// requestKeyframe sends a single picture loss indication for ssrc.
+func (s *session) requestKeyframe(ssrc webrtc.SSRC) error {
+	return s.peerConnection.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)},
+	})
+}
+
+// vp8FrameInfo reads the keyframe flag and, for keyframes, the frame size
+// from a VP8 frame header (RFC 6386, section 9.1).
+func vp8FrameInfo(frame []byte) videoFrameInfo {
+	if len(frame) < 10 || frame[0]&0x01 != 0 {
+		return videoFrameInfo{}
+	}
+	return videoFrameInfo{
+		keyframe: true,
+		width:    int(binary.LittleEndian.Uint16(frame[6:8]) & 0x3fff),
+		height:   int(binary.LittleEndian.Uint16(frame[8:10]) & 0x3fff),
+	}
+}
+
+// vp9FrameInfo reads the keyframe flag and frame size from the payload
+// descriptor of the first packet of a VP9 frame. Browsers include the
+// scalability structure, and with it the frame size, on every keyframe.
+func vp9FrameInfo(headPacket interface{}) interface{} {
+	packet, ok := headPacket.(*codecs.VP9Packet)
+	if !ok || packet.P {
+		return videoFrameInfo{}
+	}
+
+	info := videoFrameInfo{keyframe: true}
+	if packet.V && len(packet.Width) > 0 && len(packet.Height) > 0 {
+		info.width = int(packet.Width[0])
+		info.height = int(packet.Height[0])
+	}
+	return info
+}
+
+func (r *webmRecorder) writeAudio(sample *media.Sample) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed || r.failed {
+		return nil
+	}
+	if !r.started {
+		// Wait for the first video keyframe so both tracks start together,
+		// unless it is taking too long.
+		if r.hasVideo {
+			if r.audioWaiting.IsZero() {
+				r.audioWaiting = time.Now()
+			}
+			if time.Since(r.audioWaiting) < videoStartTimeout {
+				return nil
+			}
+			r.hasVideo = false
+		}
+		if err := r.start(0, 0); err != nil {
+			return err
+		}
+	}
+
+	if r.audioWriter == nil {
+		return nil
+	}
+	if _, err := r.audioWriter.Write(true, r.audioTimestamp.Milliseconds(), sample.Data); err != nil {
+		return err
+	}
+	r.audioTimestamp += sample.Duration
+	return nil
+}
+
+func (r *webmRecorder) writeVideo(codecID string, sample *media.Sample, info videoFrameInfo) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed || r.failed {
+		return nil
+	}
+	if !r.started {
+		if !r.hasVideo || !info.keyframe || info.width == 0 || info.height == 0 {
+			return nil
+		}
+		r.videoCodec = codecID
+		if err := r.start(info.width, info.height); err != nil {
+			return err
+		}
+	}
+
+	if r.videoWriter == nil {
+		return nil
+	}
+	if _, err := r.videoWriter.Write(info.keyframe, r.videoTimestamp.Milliseconds(), sample.Data); err != nil {
+		return err
+	}
+	r.videoTimestamp += sample.Duration
+	return nil
+}
+
+// dropVideo lets the recording start without video, for a session whose
+// video track cannot be muxed. It has no effect once the recording has
+// started.
+func (r *webmRecorder) dropVideo() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.started {
+		r.hasVideo = false
+	}
+}
+
+// start creates the file and the WebM block writers. A failure is returned
+// once, and the recorder drops everything written to it afterwards. The
+// caller must hold the mutex.
+func (r *webmRecorder) start(width, height int) error {
+	file, err := recordings.Create(r.name)
+	if err != nil {
+		r.failed = true
+		return fmt.Errorf("failed to create %s: %w", r.name, err)
+	}
+
+	var tracks []webm.TrackEntry
+	if r.hasAudio {
+		tracks = append(tracks, webm.TrackEntry{
+			Name:         "Audio",
+			TrackNumber:  audioTrackNumber,
+			TrackUID:     audioTrackNumber,
+			CodecID:      "A_OPUS",
+			CodecPrivate: opusHead(2, 48000),
+			// Default Opus encoder delay and seek pre-roll, in nanoseconds.
+			CodecDelay:  6500000,
+			SeekPreRoll: 80000000,
+			TrackType:   2,
+			Audio: &webm.Audio{
+				SamplingFrequency: 48000,
+				Channels:          2,
+			},
+		})
+	}
+	if r.hasVideo {
+		tracks = append(tracks, webm.TrackEntry{
+			Name:        "Video",
+			TrackNumber: videoTrackNumber,
+			TrackUID:    videoTrackNumber,
+			CodecID:     r.videoCodec,
+			TrackType:   1,
+			Video: &webm.Video{
+				PixelWidth:  uint64(width),
+				PixelHeight: uint64(height),
+			},
+		})
+	}
+
+	writers, err := webm.NewSimpleBlockWriter(r.wrap(file), tracks)
+	if err != nil {
+		file.Abort()
+		r.failed = true
+		return fmt.Errorf("failed to start WebM writer: %w", err)
+	}
+	r.started = true
+
+	for i, track := range tracks {
+		switch track.TrackNumber {
+		case audioTrackNumber:
+			r.audioWriter = writers[i]
+		case videoTrackNumber:
+			r.videoWriter = writers[i]
+		}
+	}
+	return nil
+}
+
+// opusHead builds the Opus identification header used as CodecPrivate
+// (RFC 7845, section 5.1).
+func opusHead(channels uint8, sampleRate uint32) []byte {
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = channels
+	binary.LittleEndian.PutUint16(head[10:12], 312) // pre-skip
+	binary.LittleEndian.PutUint32(head[12:16], sampleRate)
+	return head
+}
+
+// close finalizes the WebM file. The underlying file is closed by the block
+// writers once every track has been closed.
+func (r *webmRecorder) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	var errs []error
+	for _, w := range []webm.BlockWriteCloser{r.audioWriter, r.videoWriter} {
+		if w != nil {
+			errs = append(errs, w.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mediaKinds reports which kinds of media the browser is sending, based on
+// the transceivers negotiated from its offer.
+func mediaKinds(pc *webrtc.PeerConnection) (hasAudio, hasVideo bool) {
+	for _, transceiver := range pc.GetTransceivers() {
+		direction := transceiver.Direction()
+		if transceiver.Receiver() == nil ||
+			(direction != webrtc.RTPTransceiverDirectionRecvonly && direction != webrtc.RTPTransceiverDirectionSendrecv) {
+			continue
+		}
+		switch transceiver.Kind() {
+		case webrtc.RTPCodecTypeAudio:
+			hasAudio = true
+		case webrtc.RTPCodecTypeVideo:
+			hasVideo = true
+		}
+	}
+	return hasAudio, hasVideo
+}
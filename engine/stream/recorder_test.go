@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pion/rtp/codecs"
+)
+
+func TestVP8FrameInfo(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  videoFrameInfo
+	}{
+		{
+			// Frame tag (keyframe, version 0, shown, first partition of
+			// 0x2a1 bytes), start code, then 640x480.
+			name:  "keyframe",
+			frame: []byte{0x10, 0x54, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0, 0x01, 0x00, 0x47},
+			want:  videoFrameInfo{keyframe: true, width: 640, height: 480},
+		},
+		{
+			// The top two bits of each size are the scaling mode.
+			name:  "keyframe with scaling",
+			frame: []byte{0x10, 0x54, 0x00, 0x9d, 0x01, 0x2a, 0x00, 0x45, 0xd0, 0x82, 0x00},
+			want:  videoFrameInfo{keyframe: true, width: 1280, height: 720},
+		},
+		{
+			name:  "interframe",
+			frame: []byte{0x31, 0x0e, 0x00, 0x9e, 0x24, 0x11, 0x00, 0x0c, 0x52, 0xe1, 0x7a, 0x48},
+			want:  videoFrameInfo{},
+		},
+		{
+			name:  "keyframe cut short",
+			frame: []byte{0x10, 0x54, 0x00, 0x9d, 0x01, 0x2a, 0x80, 0x02, 0xe0},
+			want:  videoFrameInfo{},
+		},
+		{
+			name:  "empty",
+			frame: nil,
+			want:  videoFrameInfo{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := vp8FrameInfo(tt.frame); got != tt.want {
+				t.Errorf("vp8FrameInfo(% x) = %+v, want %+v", tt.frame, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVP9FrameInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet interface{}
+		want   videoFrameInfo
+	}{
+		{
+			name:   "interframe",
+			packet: &codecs.VP9Packet{P: true, B: true},
+			want:   videoFrameInfo{},
+		},
+		{
+			name:   "interframe with scalability structure",
+			packet: &codecs.VP9Packet{P: true, B: true, V: true, NS: 1, Y: true, Width: []uint16{1280}, Height: []uint16{720}},
+			want:   videoFrameInfo{},
+		},
+		{
+			name:   "keyframe with sizes",
+			packet: &codecs.VP9Packet{B: true, V: true, NS: 1, Y: true, Width: []uint16{1280}, Height: []uint16{720}},
+			want:   videoFrameInfo{keyframe: true, width: 1280, height: 720},
+		},
+		{
+			// With spatial layers the first size is the lowest layer's.
+			name:   "keyframe with spatial layers",
+			packet: &codecs.VP9Packet{B: true, V: true, NS: 2, Y: true, Width: []uint16{640, 1280}, Height: []uint16{360, 720}},
+			want:   videoFrameInfo{keyframe: true, width: 640, height: 360},
+		},
+		{
+			name:   "keyframe without sizes",
+			packet: &codecs.VP9Packet{B: true, V: true, NS: 1},
+			want:   videoFrameInfo{keyframe: true},
+		},
+		{
+			name:   "keyframe without scalability structure",
+			packet: &codecs.VP9Packet{B: true},
+			want:   videoFrameInfo{keyframe: true},
+		},
+		{
+			name:   "not a VP9 packet",
+			packet: &codecs.VP8Packet{},
+			want:   videoFrameInfo{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := vp9FrameInfo(tt.packet); got != tt.want {
+				t.Errorf("vp9FrameInfo = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
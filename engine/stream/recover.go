@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/mladenovic-13/pion-webrtc-app/config"
+	"github.com/mladenovic-13/pion-webrtc-app/storage"
+)
+
+// runRecoverCommand completes the recordings that a crash left as
+// incomplete uploads in the S3 bucket, with every part uploaded before it:
+//
+//	stream recover -config config.json -older-than 12h
+//
+// Recordings still being written by a running server would be cut short as
+// well, hence -older-than.
+func runRecoverCommand(args []string) error {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", 0, "only recover recordings started at least this `long` ago")
+	dryRun := fs.Bool("dry-run", false, "only list the incomplete recordings")
+
+	c, err := config.Load(fs, args)
+	if err != nil {
+		return err
+	}
+	if c.Storage.Type != config.StorageS3 {
+		return errors.New("recordings are not stored in S3")
+	}
+	cfg = c
+	if recordings, err = newRecordingSink(); err != nil {
+		return err
+	}
+	// Encrypted recordings are completed as they are; they decrypt to
+	// everything up to the last part, reported as truncated.
+	sink, _ := plainRecordings()
+	s3 := sink.(*storage.S3)
+
+	uploads, err := s3.IncompleteUploads()
+	if err != nil {
+		return err
+	}
+	var failed int
+	for _, upload := range uploads {
+		if time.Since(upload.Initiated) < *olderThan {
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("%s\tstarted %s\n", upload.Name, upload.Initiated.Format(time.RFC3339))
+			continue
+		}
+
+		size, err := s3.Recover(upload)
+		switch {
+		case err != nil:
+			fmt.Printf("%s\tfailed: %v\n", upload.Name, err)
+			failed++
+		case size < 0:
+			fmt.Printf("%s\tnothing was uploaded, discarded\n", upload.Name)
+		default:
+			fmt.Printf("%s\trecovered %d bytes\n", upload.Name, size)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d recordings could not be recovered", failed, len(uploads))
+	}
+	return nil
+}
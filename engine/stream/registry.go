@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// sessionManager is the registry of live sessions, keyed by session ID.
+type sessionManager struct {
+	mutex    sync.RWMutex
+	sessions map[string]*session
+}
+
+var sessions = newSessionManager()
+
+func newSessionManager() *sessionManager {
+	return &sessionManager{
+		sessions: make(map[string]*session),
+	}
+}
+
+func (m *sessionManager) add(s *session) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sessions[s.id] = s
+}
+
+func (m *sessionManager) remove(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.sessions, id)
+}
+
+func (m *sessionManager) get(id string) (*session, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+// list returns the live sessions ordered by creation time.
+func (m *sessionManager) list() []*session {
+	m.mutex.RLock()
+	list := make([]*session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		list = append(list, s)
+	}
+	m.mutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].createdAt.Before(list[j].createdAt)
+	})
+	return list
+}
+
+// sessionInfo is the admin API view of a session.
+type sessionInfo struct {
+	ID             string    `json:"id"`
+	CreatedAt      time.Time `json:"createdAt"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	Protocol       string    `json:"protocol"`
+	Room           string    `json:"room,omitempty"`
+	ICEState       string    `json:"iceState"`
+	DTLSState      string    `json:"dtlsState"`
+	SignalingState string    `json:"signalingState"`
+	BytesReceived  int64     `json:"bytesReceived"`
+	Viewers        int       `json:"viewers"`
+}
+
+func (s *session) info() sessionInfo {
+	dtlsState := "new"
+	if sctp := s.peerConnection.SCTP(); sctp != nil {
+		if dtls := sctp.Transport(); dtls != nil {
+			dtlsState = dtls.State().String()
+		}
+	}
+
+	return sessionInfo{
+		ID:             s.id,
+		CreatedAt:      s.createdAt,
+		RemoteAddr:     s.remoteAddr,
+		Protocol:       s.protocol,
+		Room:           s.roomName(),
+		ICEState:       s.peerConnection.ICEConnectionState().String(),
+		DTLSState:      dtlsState,
+		SignalingState: s.peerConnection.SignalingState().String(),
+		BytesReceived:  s.bytesReceived.Load(),
+		Viewers:        s.viewerCount(),
+	}
+}
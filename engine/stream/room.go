@@ -0,0 +1,173 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+)
+
+// roomNamePattern limits room names, as in the standalone signaling server.
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// roomManager is the registry of SFU rooms, keyed by name. The members of a
+// room get every other member's tracks forwarded to their own
+// PeerConnection, and the server renegotiates whenever those change.
+//
+// mutex only guards the membership. Nothing that can block, such as writing
+// to a WebSocket or adding a track to a PeerConnection, is done while it is
+// held. Lock it before any session's tracksMutex.
+type roomManager struct {
+	mutex sync.Mutex
+	rooms map[string]*room
+}
+
+type room struct {
+	name    string
+	members map[string]*session
+}
+
+var rooms = newRoomManager()
+
+func newRoomManager() *roomManager {
+	return &roomManager{
+		rooms: make(map[string]*room),
+	}
+}
+
+// joinRoom adds the session to the room named in msg. Members are known by
+// their session IDs.
+func (s *session) joinRoom(msg *signaling.Join) {
+	if !roomNamePattern.MatchString(msg.Room) {
+		s.writeError(signaling.CodeInvalidMessage, "invalid room name")
+		return
+	}
+	if !s.mayJoin(msg.Room) {
+		s.writeError(signaling.CodeForbidden, "room %q is not permitted", msg.Room)
+		return
+	}
+	if msg.PeerID != "" && msg.PeerID != s.id {
+		s.writeError(signaling.CodeInvalidMessage, "peer IDs are assigned by the server")
+		return
+	}
+
+	rooms.mutex.Lock()
+	if s.room != nil {
+		name := s.room.name
+		rooms.mutex.Unlock()
+		s.writeError(signaling.CodeInvalidState, "already in room %q", name)
+		return
+	}
+	select {
+	case <-s.done:
+		rooms.mutex.Unlock()
+		return
+	default:
+	}
+
+	r := rooms.rooms[msg.Room]
+	if r == nil {
+		r = &room{name: msg.Room, members: make(map[string]*session)}
+		rooms.rooms[r.name] = r
+	}
+	others := r.others(s.id)
+	r.members[s.id] = s
+	s.room = r
+
+	// Notifications are queued under the lock so that they arrive in the
+	// same order as the membership changes they describe, and sent by each
+	// session's own goroutine so that a slow browser holds up nobody else.
+	joined := &signaling.Joined{Room: r.name, PeerID: s.id, Peers: make([]string, 0, len(others))}
+	for _, other := range others {
+		joined.Peers = append(joined.Peers, other.id)
+		other.notify(&signaling.PeerJoined{Room: r.name, PeerID: s.id})
+	}
+	s.notify(joined)
+	rooms.mutex.Unlock()
+
+	s.logf("Joined room %s with %d other members", r.name, len(others))
+
+	for _, other := range others {
+		for _, t := range other.publishedTracks() {
+			t.forwardToMember(s)
+		}
+		for _, t := range s.publishedTracks() {
+			t.forwardToMember(other)
+		}
+	}
+}
+
+// leaveRoom removes the session from its room, if any, and takes its tracks
+// off the other members' PeerConnections.
+func (s *session) leaveRoom() {
+	rooms.mutex.Lock()
+	r := s.room
+	if r == nil {
+		rooms.mutex.Unlock()
+		return
+	}
+	delete(r.members, s.id)
+	s.room = nil
+	if len(r.members) == 0 {
+		delete(rooms.rooms, r.name)
+	}
+
+	others := r.others(s.id)
+	for _, other := range others {
+		other.notify(&signaling.PeerLeft{Room: r.name, PeerID: s.id})
+	}
+	rooms.mutex.Unlock()
+
+	for _, other := range others {
+		for _, t := range s.publishedTracks() {
+			t.stopForwarding(other.peerConnection)
+		}
+		for _, t := range other.publishedTracks() {
+			t.stopForwarding(s.peerConnection)
+		}
+	}
+	s.logf("Left room %s", r.name)
+}
+
+// sharesRoom reports whether the two sessions are members of the same room.
+func (s *session) sharesRoom(other *session) bool {
+	rooms.mutex.Lock()
+	defer rooms.mutex.Unlock()
+
+	return s.room != nil && s.room == other.room
+}
+
+// roomName returns the name of the session's room, or "" outside a room.
+func (s *session) roomName() string {
+	rooms.mutex.Lock()
+	defer rooms.mutex.Unlock()
+
+	if s.room == nil {
+		return ""
+	}
+	return s.room.name
+}
+
+// roomMembersLocked returns the other members of the session's room, if
+// any. The caller must hold rooms.mutex.
+func (s *session) roomMembersLocked() []*session {
+	if s.room == nil {
+		return nil
+	}
+	return s.room.others(s.id)
+}
+
+// others returns the members of r other than id, sorted by ID.
+func (r *room) others(id string) []*session {
+	members := make([]*session, 0, len(r.members))
+	for _, s := range r.members {
+		if s.id != id {
+			members = append(members, s)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].id < members[j].id
+	})
+	return members
+}
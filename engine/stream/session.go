@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mladenovic-13/pion-webrtc-app/auth"
+	"github.com/mladenovic-13/pion-webrtc-app/config"
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+	"github.com/pion/webrtc/v4"
+)
+
+// session ties one signaling connection to its own PeerConnection and
+// recording files. Sessions are independent: tearing one down never affects
+// the others or the HTTP listener.
+type session struct {
+	id         string
+	createdAt  time.Time
+	remoteAddr string
+	protocol   string
+	// claims are what the client's token permits, or nil when tokens are
+	// not required.
+	claims *auth.Claims
+	// secret proves that a request comes from the client that opened the
+	// session: it is the reconnect token of a WebSocket session, and part of
+	// the resource URL of a WHIP session. The session ID is no secret, since
+	// WHEP players and the admin API use it.
+	secret string
+
+	// conn is the WebSocket signaling connection. It is nil for WHIP
+	// sessions, which are signaled over plain HTTP requests, and while the
+	// browser of a WebSocket session is reconnecting. See attach.
+	conn           *websocket.Conn
+	peerConnection *webrtc.PeerConnection
+
+	// bytesReceived counts media bytes received from the peer, and
+	// bytesRecorded the bytes written to its recordings. quotaReported is
+	// set once the browser has been told it hit a recording quota.
+	bytesReceived atomic.Int64
+	bytesRecorded atomic.Int64
+	quotaReported atomic.Bool
+
+	// writeMutex guards conn and serializes writes to it, which
+	// gorilla/websocket does not allow from more than one goroutine at a
+	// time.
+	writeMutex sync.Mutex
+
+	// reconnectTimer runs while the session has lost its ICE connection
+	// (iceDown) or its signaling connection, and closes the session unless
+	// both are back within reconnectGracePeriod. Lock reconnectMutex before
+	// writeMutex.
+	reconnectMutex sync.Mutex
+	iceDown        bool
+	reconnectTimer *time.Timer
+
+	// deadline ends the session when it has lasted as long as the server
+	// or its token allows.
+	deadline *time.Timer
+
+	// take is the recording started by the browser, if any, and upload is
+	// the data channel transfer writing it. See startTake and
+	// handleDataChannel. Lock uploadMutex before upload.mutex.
+	uploadMutex sync.Mutex
+	take        *take
+	takeCount   int
+	upload      *upload
+
+	// recorder muxes the incoming RTP tracks. See webmRecorder.
+	recorderOnce sync.Once
+	recorder     *webmRecorder
+
+	// tracks are the incoming tracks available to WHEP viewers, and viewers
+	// the subscribers they are forwarded to, by viewer ID. Lock tracksMutex
+	// before a track's mutex.
+	tracksMutex sync.Mutex
+	tracks      []*publishedTrack
+	viewers     map[string]*viewer
+
+	// room is the SFU room the session has joined, if any. It is guarded by
+	// rooms.mutex. notifications queues the room's membership messages for
+	// sendNotifications, in the order the membership changed.
+	room          *room
+	notifications chan signaling.Message
+
+	// negotiationMutex serializes offers, answers and remote candidates, so
+	// that an offer from the server never overlaps one from the browser. It
+	// guards everything below. ignoreOffer is set while the browser's last
+	// offer was dropped for colliding with ours; see handleOffer.
+	// restartPending is set while an ICE restart waits for the signaling
+	// state to become stable; see restartICE.
+	negotiationMutex sync.Mutex
+	ignoreOffer      bool
+	restartPending   bool
+
+	// pendingCandidates holds remote candidates received before the offer.
+	pendingCandidates []webrtc.ICECandidateInit
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// writeTimeout bounds every write to a signaling connection, so that a
+// browser that stops reading cannot hold up whoever is writing to it.
+const writeTimeout = 10 * time.Second
+
+// maxQueuedNotifications is how many room notifications may wait for a slow
+// browser before further ones are dropped.
+const maxQueuedNotifications = 64
+
+// reconnectGracePeriod is how long a session waits for a peer that lost its
+// connection to come back before the session is closed and its recordings
+// are finalized.
+const reconnectGracePeriod = 15 * time.Second
+
+// Session protocols, as reported by the admin API.
+const (
+	protocolWebSocket = "websocket"
+	protocolWHIP      = "whip"
+)
+
+// newSession creates and registers a session. conn is nil for sessions that
+// are not signaled over a WebSocket, and claims nil when tokens are not
+// required. A client over its session limits gets a quota-exceeded
+// *signaling.Error.
+func newSession(protocol, remoteAddr string, conn *websocket.Conn, claims *auth.Claims) (*session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		id:         id,
+		secret:     secret,
+		createdAt:  time.Now(),
+		remoteAddr: remoteAddr,
+		protocol:   protocol,
+		claims:     claims,
+		conn:       conn,
+		viewers:    make(map[string]*viewer),
+		done:       make(chan struct{}),
+
+		notifications: make(chan signaling.Message, maxQueuedNotifications),
+	}
+
+	if err := admitSession(remoteIP(remoteAddr), s.subject()); err != nil {
+		return nil, err
+	}
+	s.peerConnection, err = createPeerConnection()
+	if err != nil {
+		releaseSession(remoteIP(remoteAddr), s.subject())
+		return nil, err
+	}
+
+	// Without a WebSocket there is nowhere to trickle candidates to; they
+	// go in the answer instead.
+	if protocol == protocolWebSocket {
+		go s.sendNotifications()
+		s.peerConnection.OnICECandidate(s.sendLocalCandidate)
+		s.peerConnection.OnNegotiationNeeded(func() {
+			// Like the state handlers, this runs on pion's own goroutine.
+			go s.renegotiate()
+		})
+	}
+
+	s.peerConnection.OnSignalingStateChange(func(state webrtc.SignalingState) {
+		s.debugf("Signaling state has changed: %s", state)
+		if state == webrtc.SignalingStateStable {
+			s.resumeICERestart()
+		}
+	})
+
+	s.peerConnection.OnTrack(s.handleTrack)
+
+	s.peerConnection.OnDataChannel(s.handleDataChannel)
+
+	s.peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		s.logf("ICE Connection State has changed: %s", connectionState.String())
+
+		switch connectionState {
+		case webrtc.ICEConnectionStateConnected,
+			webrtc.ICEConnectionStateCompleted:
+			s.setICEDown(false)
+
+		case webrtc.ICEConnectionStateDisconnected:
+			// The connection may still recover, by itself or through an ICE
+			// restart, so the recordings are kept open for now.
+			s.setICEDown(true)
+			go s.restartICE()
+
+		case webrtc.ICEConnectionStateFailed,
+			webrtc.ICEConnectionStateClosed:
+			s.logf("Peer disconnected")
+			// The handler runs on the ICE agent's goroutine, and closing the
+			// PeerConnection from here would wait on that same goroutine.
+			go s.close()
+		}
+	})
+
+	if limit := s.maxDuration(); limit > 0 {
+		s.deadline = time.AfterFunc(limit, func() {
+			s.logf("Session reached its time limit of %s", limit)
+			s.writeError(signaling.CodeSessionExpired, "session time limit of %s reached", limit)
+			s.close()
+		})
+	}
+
+	sessions.add(s)
+	return s, nil
+}
+
+// newSessionID returns a random 16 character hex identifier.
+func newSessionID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newSecret returns a random 32 character hex string, too long to guess.
+func newSecret() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hasSecret reports whether secret is the session's, in constant time.
+func (s *session) hasSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(s.secret)) == 1
+}
+
+func (s *session) logf(format string, v ...interface{}) {
+	log.Printf("[%s] "+format, append([]interface{}{s.id}, v...)...)
+}
+
+// debugf logs only at the debug log level and above.
+func (s *session) debugf(format string, v ...interface{}) {
+	if cfg.Logs(config.LevelDebug) {
+		s.logf(format, v...)
+	}
+}
+
+var errNoSignaling = errors.New("session has no signaling connection")
+
+func (s *session) writeMessage(m signaling.Message) error {
+	data, err := signaling.Encode(m)
+	if err != nil {
+		return err
+	}
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if s.conn == nil {
+		return errNoSignaling
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return s.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// notify queues a message for sendNotifications without blocking, so it
+// can be called with rooms.mutex held. A browser that has fallen so far
+// behind that the queue is full misses the message.
+func (s *session) notify(m signaling.Message) {
+	select {
+	case s.notifications <- m:
+	default:
+		s.logf("Dropped %s, the browser is not keeping up", m.Type())
+	}
+}
+
+// sendNotifications writes the queued notifications until the session is
+// closed.
+func (s *session) sendNotifications() {
+	for {
+		select {
+		case m := <-s.notifications:
+			if err := s.writeMessage(m); err != nil {
+				s.logf("Failed to send %s: %v", m.Type(), err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// writeError reports a problem to the browser. Failures are only logged since
+// the session is usually being torn down anyway. Sessions without a
+// WebSocket report errors in their HTTP responses instead.
+func (s *session) writeError(code, format string, v ...interface{}) {
+	s.reportError(signaling.NewError(code, format, v...))
+}
+
+// reportError is like writeError for an error that may already be a
+// *signaling.Error.
+func (s *session) reportError(err error) {
+	if err := s.writeMessage(signaling.AsError(err)); err != nil && !errors.Is(err, errNoSignaling) {
+		s.logf("Failed to send error: %v", err)
+	}
+}
+
+// attach makes conn the session's signaling connection, closing the one it
+// replaces, if any.
+func (s *session) attach(conn *websocket.Conn) {
+	s.writeMutex.Lock()
+	old := s.conn
+	s.conn = conn
+	s.writeMutex.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	s.updateReconnectTimer()
+}
+
+// detach forgets conn once its read loop has ended, unless it has already
+// been replaced by a newer connection.
+func (s *session) detach(conn *websocket.Conn) {
+	s.writeMutex.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	s.writeMutex.Unlock()
+
+	s.updateReconnectTimer()
+}
+
+func (s *session) setICEDown(down bool) {
+	s.reconnectMutex.Lock()
+	s.iceDown = down
+	s.reconnectMutex.Unlock()
+
+	s.updateReconnectTimer()
+}
+
+// updateReconnectTimer starts the reconnect grace period when the session has
+// lost its ICE or signaling connection, and stops it once both are back.
+func (s *session) updateReconnectTimer() {
+	s.reconnectMutex.Lock()
+	defer s.reconnectMutex.Unlock()
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	s.writeMutex.Lock()
+	lost := s.iceDown || (s.protocol == protocolWebSocket && s.conn == nil)
+	s.writeMutex.Unlock()
+
+	switch {
+	case lost && s.reconnectTimer == nil:
+		s.logf("Connection lost, waiting %s for the peer to reconnect", reconnectGracePeriod)
+		s.reconnectTimer = time.AfterFunc(reconnectGracePeriod, func() {
+			s.logf("Peer did not reconnect within %s", reconnectGracePeriod)
+			s.close()
+		})
+	case !lost && s.reconnectTimer != nil:
+		s.reconnectTimer.Stop()
+		s.reconnectTimer = nil
+		s.logf("Peer reconnected")
+	}
+}
+
+// close releases everything the session owns. It is safe to call more than
+// once and from any goroutine.
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		sessions.remove(s.id)
+
+		s.reconnectMutex.Lock()
+		if s.reconnectTimer != nil {
+			s.reconnectTimer.Stop()
+			s.reconnectTimer = nil
+		}
+		s.reconnectMutex.Unlock()
+		if s.deadline != nil {
+			s.deadline.Stop()
+		}
+		releaseSession(remoteIP(s.remoteAddr), s.subject())
+
+		s.leaveRoom()
+
+		if err := s.peerConnection.Close(); err != nil {
+			s.logf("Error closing peer connection: %v", err)
+		}
+		s.closeViewers()
+
+		// The track readers can still be running until their next ReadRTP
+		// fails. Using up recorderOnce keeps them from creating a recorder
+		// from here on, and the recorder drops their samples once it is
+		// closed.
+		s.recorderOnce.Do(func() {})
+		if s.recorder != nil {
+			if err := s.recorder.close(); err != nil {
+				s.logf("Error finalizing RTP recording: %v", err)
+			}
+		}
+
+		s.uploadMutex.Lock()
+		if s.take != nil {
+			s.logf("Take %d ended by disconnect", s.take.number)
+			s.take = nil
+		}
+		s.finishUpload()
+		s.uploadMutex.Unlock()
+
+		// Closing the socket unblocks the read loop in serveWebSocket.
+		s.writeMutex.Lock()
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.writeMutex.Unlock()
+		s.logf("Session closed")
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+)
+
+// take is one start-recording/stop-recording span of a session. The
+// browser's upload for the take is stored as name.
+type take struct {
+	number      int
+	recordingID string
+	name        string
+	startedAt   time.Time
+}
+
+// startTake begins a new numbered take. Uploads are only accepted while a
+// take is in progress.
+func (s *session) startTake(msg *signaling.StartRecording) {
+	s.uploadMutex.Lock()
+	defer s.uploadMutex.Unlock()
+
+	if !s.mayRecord() {
+		s.writeError(signaling.CodeForbidden, "recording is not permitted")
+		return
+	}
+	if s.take != nil {
+		s.writeError(signaling.CodeInvalidState, "take %d is already recording", s.take.number)
+		return
+	}
+	if err := s.canRecord(); err != nil {
+		s.reportError(err)
+		return
+	}
+	if msg.RecordingID != "" && !recordingIDPattern.MatchString(msg.RecordingID) {
+		s.writeError(signaling.CodeInvalidMessage, "invalid recording ID")
+		return
+	}
+
+	s.takeCount++
+	t := &take{
+		number:      s.takeCount,
+		recordingID: msg.RecordingID,
+		name:        s.recordingFile(strconv.Itoa(s.takeCount)),
+		startedAt:   time.Now(),
+	}
+	if t.recordingID != "" {
+		if name, ok := resumedName(uploadKey{owner: s.uploadOwner(), recordingID: t.recordingID}); ok {
+			t.name = name
+		}
+	}
+	s.take = t
+	s.logf("Started take %d into %s", t.number, t.name)
+
+	if err := s.writeMessage(&signaling.RecordingStarted{
+		Take:        t.number,
+		RecordingID: t.recordingID,
+		File:        t.name,
+	}); err != nil {
+		s.logf("Failed to send recording-started: %v", err)
+	}
+}
+
+// stopTake finalizes the current take, closing its upload if the browser
+// has not finished it.
+func (s *session) stopTake() {
+	s.uploadMutex.Lock()
+	defer s.uploadMutex.Unlock()
+
+	if s.take == nil {
+		s.writeError(signaling.CodeInvalidState, "not recording")
+		return
+	}
+
+	t := s.take
+	s.take = nil
+	s.finishUpload()
+
+	duration := time.Since(t.startedAt)
+	s.logf("Stopped take %d after %s", t.number, duration.Round(time.Millisecond))
+
+	if err := s.writeMessage(&signaling.RecordingStopped{
+		Take:        t.number,
+		RecordingID: t.recordingID,
+		File:        t.name,
+		Duration:    duration.Seconds(),
+	}); err != nil {
+		s.logf("Failed to send recording-stopped: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// selfSignedValidity is how long a generated development certificate is
+// valid. A new one is generated on every start anyway.
+const selfSignedValidity = 30 * 24 * time.Hour
+
+// listenAndServe serves the default mux on cfg.Listen, over HTTPS if it is
+// configured.
+func listenAndServe() error {
+	if !cfg.TLS.Enabled() {
+		fmt.Printf("Starting server on %s\n", cfg.Listen)
+		return http.ListenAndServe(cfg.Listen, nil)
+	}
+
+	server := &http.Server{Addr: cfg.Listen}
+	if cfg.TLS.SelfSigned {
+		certificate, err := selfSignedCertificate()
+		if err != nil {
+			return fmt.Errorf("generating a self-signed certificate: %w", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{certificate}}
+		fmt.Printf("Using a self-signed certificate with SHA-256 fingerprint %X\n", sha256.Sum256(certificate.Certificate[0]))
+	}
+
+	if cfg.TLS.RedirectListen != "" {
+		// Listening here reports a port that is taken before anything is
+		// served. Once it is running, the redirect failing only leaves the
+		// HTTPS server without it.
+		listener, err := net.Listen("tcp", cfg.TLS.RedirectListen)
+		if err != nil {
+			return fmt.Errorf("listening for the HTTPS redirect: %w", err)
+		}
+		go func() {
+			log.Println("HTTPS redirect stopped:", http.Serve(listener, http.HandlerFunc(redirectToHTTPS)))
+		}()
+		fmt.Printf("Redirecting HTTP on %s to HTTPS\n", cfg.TLS.RedirectListen)
+	}
+
+	fmt.Printf("Starting HTTPS server on %s\n", cfg.Listen)
+	// The files are empty, and ignored, with a self-signed certificate.
+	return server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+}
+
+// redirectToHTTPS sends a plain HTTP request to the same URL on the HTTPS
+// server. 308 keeps the method and body, so that WHIP and WHEP POSTs
+// survive the redirect.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if _, port, _ := net.SplitHostPort(cfg.Listen); port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// selfSignedCertificate generates a certificate for localhost, the loopback
+// addresses, the machine's host name and the host in cfg.Listen.
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"pion-webrtc-app development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if host, _, err := net.SplitHostPort(cfg.Listen); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if ip == nil && host != "" && host != "localhost" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
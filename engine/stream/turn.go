@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/mladenovic-13/pion-webrtc-app/config"
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+	"github.com/pion/turn/v4"
+)
+
+// The embedded TURN relay lets browsers that cannot reach the server
+// directly relay their media through it. Every session is handed its own
+// credentials in the TURN REST API style: the username is the expiry time
+// and the session ID, and the password an HMAC of the username keyed with
+// turnSecret, so the relay needs no state to check them.
+var (
+	turnServer *turn.Server
+	turnSecret string
+)
+
+// startTURNServer starts the relay configured in cfg.TURN.
+func startTURNServer() error {
+	t := cfg.TURN
+
+	turnSecret = t.Secret
+	if turnSecret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		turnSecret = hex.EncodeToString(b)
+	}
+
+	conn, err := net.ListenPacket("udp", t.Listen)
+	if err != nil {
+		return err
+	}
+
+	relayIP := t.RelayIP()
+	relayAddress := "0.0.0.0"
+	if relayIP.To4() == nil {
+		relayAddress = "::"
+	}
+	var generator turn.RelayAddressGenerator = &turn.RelayAddressGeneratorStatic{
+		RelayAddress: relayIP,
+		Address:      relayAddress,
+	}
+	if t.RelayPorts.Max != 0 {
+		generator = &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: relayIP,
+			Address:      relayAddress,
+			MinPort:      t.RelayPorts.Min,
+			MaxPort:      t.RelayPorts.Max,
+		}
+	}
+
+	loggerFactory := cfg.LoggerFactory()
+	turnServer, err = turn.NewServer(turn.ServerConfig{
+		Realm:       t.Realm,
+		AuthHandler: turn.LongTermTURNRESTAuthHandler(turnSecret, loggerFactory.NewLogger("turn")),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            conn,
+			RelayAddressGenerator: generator,
+			PermissionHandler:     allowTURNPeer,
+		}},
+		LoggerFactory: loggerFactory,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	fmt.Printf("TURN relay listening on %s as %s\n", t.Listen, t.URL())
+	return nil
+}
+
+// allowTURNPeer decides which peers clients may relay to. Unless
+// cfg.TURN.AllowPrivatePeers is set, addresses that are not publicly
+// routable are refused, so that the relay cannot reach the server itself,
+// its network or a cloud metadata service such as 169.254.169.254.
+func allowTURNPeer(clientAddr net.Addr, peerIP net.IP) bool {
+	if cfg.TURN.AllowPrivatePeers {
+		return true
+	}
+	if peerIP.IsLoopback() || peerIP.IsPrivate() || peerIP.IsUnspecified() ||
+		peerIP.IsLinkLocalUnicast() || peerIP.IsLinkLocalMulticast() ||
+		peerIP.IsInterfaceLocalMulticast() || peerIP.IsMulticast() {
+		if cfg.Logs(config.LevelDebug) {
+			log.Printf("TURN relay refused peer %s for %s", peerIP, clientAddr)
+		}
+		return false
+	}
+	return true
+}
+
+// turnCredentialTTL returns how long a session's relay credentials stay
+// valid: until the session reaches its time limit, with time for the
+// browser to reconnect, or else for cfg.TURN.CredentialTTL.
+func (s *session) turnCredentialTTL() time.Duration {
+	if limit := s.maxDuration(); limit > 0 {
+		return limit - time.Since(s.createdAt) + reconnectGracePeriod
+	}
+	return time.Duration(cfg.TURN.CredentialTTL)
+}
+
+// turnICEServers returns the embedded relay with fresh credentials for a
+// session, or nil when the relay is disabled.
+func (s *session) turnICEServers() []signaling.ICEServer {
+	if turnServer == nil {
+		return nil
+	}
+
+	username, password, err := turn.GenerateLongTermTURNRESTCredentials(turnSecret, s.id, s.turnCredentialTTL())
+	if err != nil {
+		s.logf("Failed to create TURN credentials: %v", err)
+		return nil
+	}
+	return []signaling.ICEServer{{
+		URLs:       []string{cfg.TURN.URL()},
+		Username:   username,
+		Credential: password,
+	}}
+}
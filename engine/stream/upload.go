@@ -0,0 +1,703 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+	"github.com/mladenovic-13/pion-webrtc-app/storage"
+	"github.com/mladenovic-13/pion-webrtc-app/transfer"
+	"github.com/pion/webrtc/v4"
+)
+
+// recordingIDPattern limits client-supplied recording IDs to something safe
+// to put in a file name.
+var recordingIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// upload is a recording being received over the data channel with the
+// transfer protocol.
+//
+// Uploads without a recording ID are written straight to the recording
+// storage as name. Uploads with one survive the session: their progress is
+// saved after every chunk, so a browser that reconnects can begin the same
+// recording again and continue where it left off, as long as it has the same
+// owner (see uploadOwner). They are written to path in
+// the recording directory and moved to the recording storage once complete,
+// or with S3 storage uploaded as they arrive, with path spooling less than a
+// part. With encryption at rest they are encrypted before they are written,
+// a chunk at a time.
+type upload struct {
+	owner       string
+	recordingID string
+	name        string
+	path        string
+	statePath   string
+
+	// mutex guards everything below. A reconnecting browser can take the
+	// upload over from a session that has not noticed the disconnect yet.
+	mutex     sync.Mutex
+	file      io.WriteCloser
+	spool     *storage.Spooled
+	encrypter *storage.EncryptWriter
+	receiver  *transfer.Receiver
+	closed    bool
+	// stored is set once a resumable upload is in the recording storage.
+	stored bool
+}
+
+// uploadState is the progress record kept in statePath for a resumable
+// upload. It stays behind once the upload is complete, so that the browser
+// is not asked to send it again.
+type uploadState struct {
+	Owner       string `json:"owner"`
+	RecordingID string `json:"recordingId"`
+	Name        string `json:"name,omitempty"`
+	NextSeq     uint32 `json:"nextSeq"`
+	Size        uint64 `json:"size"`
+	Complete    bool   `json:"complete,omitempty"`
+	// UploadID continues an upload spooled to S3, and Encryption an
+	// encrypted one. Neither can be read back to restore the checksum, so it
+	// is saved in Checksum.
+	UploadID   string                `json:"uploadId,omitempty"`
+	Encryption *storage.EncryptState `json:"encryption,omitempty"`
+	Checksum   []byte                `json:"checksum,omitempty"`
+}
+
+// storedSize returns how much of the upload has been written to its file,
+// which Size does not count the encryption of.
+func (state *uploadState) storedSize() int64 {
+	if state.Encryption != nil {
+		return state.Encryption.Size
+	}
+	return int64(state.Size)
+}
+
+// uploadKey identifies a resumable upload. Recording IDs are chosen by the
+// browser, so they are only unique per owner.
+type uploadKey struct {
+	owner       string
+	recordingID string
+}
+
+// activeUploads maps resumable uploads to the upload receiving them.
+var (
+	activeUploadsMutex sync.Mutex
+	activeUploads      = map[uploadKey]*upload{}
+)
+
+// uploadOwner returns who may resume the session's uploads: the subject of
+// its token, or on a server without tokens the session itself, since nothing
+// else tells two browsers apart.
+func (s *session) uploadOwner() string {
+	if subject := s.subject(); subject != "" {
+		return "subject:" + subject
+	}
+	return "session:" + s.id
+}
+
+func (u *upload) key() uploadKey {
+	return uploadKey{owner: u.owner, recordingID: u.recordingID}
+}
+
+// handleDataChannel wires a browser data channel to the session's uploads.
+// Every message gets a transfer control message in reply.
+func (s *session) handleDataChannel(d *webrtc.DataChannel) {
+	s.logf("New DataChannel %s %d", d.Label(), d.ID())
+
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		reply := s.handleUploadMessage(msg)
+		if err := d.SendText(string(reply.Marshal())); err != nil {
+			s.logf("Failed to send %s on data channel: %v", reply.Type, err)
+		}
+	})
+}
+
+func (s *session) handleUploadMessage(msg webrtc.DataChannelMessage) transfer.Control {
+	s.uploadMutex.Lock()
+	defer s.uploadMutex.Unlock()
+
+	if !msg.IsString {
+		s.bytesReceived.Add(int64(len(msg.Data)))
+
+		if s.upload == nil {
+			return s.noUpload()
+		}
+		return s.upload.handleChunk(s, msg.Data)
+	}
+
+	control, err := transfer.ParseControl(msg.Data)
+	if err != nil {
+		return transfer.Control{Type: transfer.TypeFailed, Reason: err.Error()}
+	}
+
+	switch control.Type {
+	case transfer.TypeBegin:
+		return s.beginUpload(control.RecordingID)
+
+	case transfer.TypeManifest:
+		if s.upload == nil {
+			return s.noUpload()
+		}
+
+		reply := s.upload.handleManifest(s, control)
+		if reply.Type == transfer.TypeComplete {
+			s.upload = nil
+		}
+		return reply
+
+	default:
+		return transfer.Control{Type: transfer.TypeFailed, Reason: fmt.Sprintf("unexpected %q message", control.Type)}
+	}
+}
+
+// noUpload rejects data that arrives without a transfer to write it to. The
+// caller must hold uploadMutex.
+func (s *session) noUpload() transfer.Control {
+	if s.take == nil {
+		return transfer.Control{Type: transfer.TypeFailed, Reason: "not recording"}
+	}
+	return transfer.Control{Type: transfer.TypeFailed, Reason: "no transfer in progress"}
+}
+
+// beginUpload starts receiving the current take, abandoning any upload of
+// this session that never completed. Without a recording ID the take's file
+// is written from scratch; with one any earlier partial upload is resumed.
+// The caller must hold uploadMutex.
+func (s *session) beginUpload(recordingID string) transfer.Control {
+	if s.take == nil {
+		return transfer.Control{Type: transfer.TypeFailed, Reason: "not recording"}
+	}
+	if recordingID != s.take.recordingID {
+		return transfer.Control{Type: transfer.TypeFailed, Reason: "recording ID does not match the current take"}
+	}
+
+	s.finishUpload()
+
+	var u *upload
+	var err error
+	if recordingID == "" {
+		u, err = newAnonymousUpload(s, s.take.name)
+	} else {
+		u, err = openResumableUpload(s, recordingID, s.take.name)
+	}
+	if errors.Is(err, errUploadComplete) || errors.Is(err, errUploadOwned) {
+		return transfer.Control{Type: transfer.TypeFailed, RecordingID: recordingID, Reason: err.Error()}
+	}
+	if err != nil {
+		s.logf("Failed to start upload: %v", err)
+		return transfer.Control{Type: transfer.TypeFailed, Reason: "failed to start transfer"}
+	}
+
+	s.upload = u
+	if u.receiver.Size() > 0 {
+		s.logf("Resuming upload into %s at chunk %d, offset %d", u.name, u.receiver.NextSeq(), u.receiver.Size())
+	} else {
+		s.logf("Receiving upload into %s", u.name)
+	}
+
+	return transfer.Control{
+		Type:        transfer.TypeReady,
+		RecordingID: recordingID,
+		Seq:         u.receiver.NextSeq(),
+		Offset:      u.receiver.Size(),
+	}
+}
+
+// newAnonymousUpload creates the file for an upload without a recording ID.
+// What it writes counts against s's quotas.
+func newAnonymousUpload(s *session, name string) (*upload, error) {
+	file, err := recordings.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upload{
+		name:     name,
+		file:     file,
+		receiver: transfer.NewReceiver(s.recordingWriter(file, recordingsOnDisk())),
+	}, nil
+}
+
+var (
+	errUploadComplete = errors.New("recording already uploaded")
+	errUploadOwned    = errors.New("recording ID belongs to another client")
+)
+
+// path returns the file in the recording directory the upload is written
+// to. The owner is hashed into the name, since a subject can be anything.
+func (k uploadKey) path() string {
+	sum := sha256.Sum256([]byte(k.owner))
+	return recordingPath(fmt.Sprintf("output-%s-%s.webm", hex.EncodeToString(sum[:8]), k.recordingID))
+}
+
+// statePath returns the file the progress of the upload is saved in.
+func (k uploadKey) statePath() string {
+	return k.path() + ".upload.json"
+}
+
+// loadState reads the progress of the upload, refusing it if it was saved
+// for another owner.
+func (k uploadKey) loadState() (uploadState, error) {
+	state, err := loadUploadState(k.statePath())
+	if err == nil && state.Owner != k.owner {
+		return uploadState{}, errUploadOwned
+	}
+	return state, err
+}
+
+// resumedName returns the name the recording ID was first given, if its
+// owner has uploaded to it before, so that a resumed take keeps it.
+func resumedName(key uploadKey) (string, bool) {
+	state, err := key.loadState()
+	return state.Name, err == nil && state.Name != ""
+}
+
+// openResumableUpload opens s's file for recordingID, taking it over from
+// any session of the same owner still holding it, and restores its progress
+// from the state file. The complete recording is stored as name. What it
+// writes from now on counts against s's quotas.
+func openResumableUpload(s *session, recordingID, name string) (*upload, error) {
+	activeUploadsMutex.Lock()
+	defer activeUploadsMutex.Unlock()
+
+	k := uploadKey{owner: s.uploadOwner(), recordingID: recordingID}
+	if previous := activeUploads[k]; previous != nil {
+		previous.closeLocked()
+	}
+
+	u := &upload{
+		owner:       k.owner,
+		recordingID: recordingID,
+		name:        name,
+		path:        k.path(),
+		statePath:   k.statePath(),
+	}
+
+	state, err := k.loadState()
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// A recording file without a state file has been completed.
+		if _, err := os.Stat(u.path); err == nil {
+			return nil, errUploadComplete
+		}
+		state = uploadState{Owner: k.owner, RecordingID: recordingID}
+	case err != nil:
+		return nil, err
+	case state.Complete:
+		return nil, errUploadComplete
+	}
+	if state.Name != "" {
+		u.name = state.Name
+	}
+
+	sink, key := plainRecordings()
+	if state.Size > 0 && (state.Encryption != nil) != (key != nil) {
+		return nil, errors.New("encryption at rest was turned on or off since the upload started")
+	}
+	if sink, ok := sink.(*storage.S3); ok {
+		err = u.openSpool(s, sink, key, state)
+	} else {
+		err = u.openFile(s, key, state)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := u.saveState(); err != nil {
+		u.file.Close()
+		return nil, err
+	}
+
+	activeUploads[k] = u
+	return u, nil
+}
+
+// openFile opens the file in the recording directory a resumable upload is
+// written to.
+func (u *upload) openFile(s *session, key *storage.MasterKey, state uploadState) error {
+	file, err := os.OpenFile(u.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+
+	// Anything past the last acknowledged chunk is discarded; the browser
+	// still has it.
+	info, err := file.Stat()
+	if err != nil || info.Size() < state.storedSize() {
+		state = uploadState{Owner: u.owner, RecordingID: u.recordingID}
+	}
+	if err := file.Truncate(state.storedSize()); err != nil {
+		file.Close()
+		return err
+	}
+	if info != nil {
+		releaseDisk(info.Size() - state.storedSize())
+	}
+
+	u.file = file
+	w, err := u.newWriter(s, key, state)
+	if err == nil {
+		if u.encrypter == nil {
+			// Reading the file back leaves it at its end.
+			u.receiver, err = transfer.ResumeReceiver(w, file, state.NextSeq)
+		} else if _, err = file.Seek(0, io.SeekEnd); err == nil {
+			u.receiver, err = restoreReceiver(w, state)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return nil
+}
+
+// openSpool starts or continues a resumable upload into the S3 bucket.
+// What has not been uploaded as a part yet is spooled next to the state
+// file, which is only ever a few parts at most.
+func (u *upload) openSpool(s *session, sink *storage.S3, key *storage.MasterKey, state uploadState) error {
+	u.path += ".spool"
+
+	// Resuming cuts the spool down to what the bucket does not have yet.
+	spooled := fileSize(u.path)
+	var err error
+	if state.UploadID == "" {
+		u.spool, err = sink.CreateSpooled(u.name, u.path)
+	} else {
+		u.spool, err = sink.ResumeSpooled(u.name, state.UploadID, u.path, state.storedSize())
+	}
+	if err != nil {
+		return err
+	}
+	releaseDisk(spooled - fileSize(u.path))
+	u.spool.OnUpload(releaseDisk)
+
+	u.file = u.spool
+	w, err := u.newWriter(s, key, state)
+	if err == nil {
+		u.receiver, err = restoreReceiver(w, state)
+	}
+	if err != nil {
+		u.spool.Close()
+		return err
+	}
+	return nil
+}
+
+// newWriter returns what the receiver of a resumable upload writes to:
+// u.file, through an encrypter continuing from state if key is set. Both the
+// file and the spool are in the recording directory.
+func (u *upload) newWriter(s *session, key *storage.MasterKey, state uploadState) (io.Writer, error) {
+	w := s.recordingWriter(u.file, true)
+	if key == nil {
+		return w, nil
+	}
+
+	var err error
+	if state.Encryption == nil {
+		u.encrypter, err = key.NewWriter(w)
+	} else {
+		u.encrypter, err = key.ResumeWriter(w, *state.Encryption)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u.encrypter, nil
+}
+
+// restoreReceiver continues a transfer from the checksum saved in state, for
+// uploads whose file cannot be read back.
+func restoreReceiver(w io.Writer, state uploadState) (*transfer.Receiver, error) {
+	if state.Checksum == nil {
+		return transfer.NewReceiver(w), nil
+	}
+	return transfer.RestoreReceiver(w, state.NextSeq, state.Size, state.Checksum)
+}
+
+// fileSize returns the size of the file at path, or zero if there is none.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func loadUploadState(path string) (uploadState, error) {
+	var state uploadState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// saveState records how much of a resumable upload has been written. The
+// caller must hold u.mutex or own u exclusively.
+func (u *upload) saveState() error {
+	if u.statePath == "" {
+		return nil
+	}
+
+	state := uploadState{
+		Owner:       u.owner,
+		RecordingID: u.recordingID,
+		Name:        u.name,
+		NextSeq:     u.receiver.NextSeq(),
+		Size:        u.receiver.Size(),
+		Complete:    u.stored,
+	}
+	if u.spool != nil {
+		state.UploadID = u.spool.UploadID()
+	}
+	if u.encrypter != nil {
+		encryption := u.encrypter.State()
+		state.Encryption = &encryption
+	}
+	if u.spool != nil || u.encrypter != nil {
+		checksum, err := u.receiver.ChecksumState()
+		if err != nil {
+			return err
+		}
+		state.Checksum = checksum
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmp := u.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, u.statePath)
+}
+
+func (u *upload) handleChunk(s *session, frame []byte) transfer.Control {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.closed {
+		return transfer.Control{Type: transfer.TypeFailed, Reason: "transfer taken over by another connection"}
+	}
+
+	nextSeq := u.receiver.NextSeq()
+	reply, err := u.receiver.HandleChunk(frame)
+	var quotaErr *signaling.Error
+	if errors.As(err, &quotaErr) {
+		return transfer.Control{Type: transfer.TypeFailed, Reason: quotaErr.Message}
+	}
+	if err != nil {
+		s.logf("Error writing to %s: %v", u.name, err)
+		return transfer.Control{Type: transfer.TypeFailed, Reason: "failed to store chunk"}
+	}
+
+	if u.receiver.NextSeq() != nextSeq {
+		// The chunk is encrypted as a record of its own, so that the file
+		// holds all of it when the state is saved.
+		if u.encrypter != nil {
+			if err := u.encrypter.Flush(); err != nil {
+				s.logf("Error writing to %s: %v", u.name, err)
+				return transfer.Control{Type: transfer.TypeFailed, Reason: "failed to store chunk"}
+			}
+		}
+		if err := u.saveState(); err != nil {
+			s.logf("Failed to save upload state for %s: %v", u.name, err)
+			return transfer.Control{Type: transfer.TypeFailed, Reason: "failed to store chunk"}
+		}
+		// Parts are only queued for upload once the state is saved, so that
+		// they are never ahead of it. They are sent in the background.
+		if u.spool != nil {
+			if err := u.spool.Flush(); err != nil {
+				s.logf("Failed to upload %s: %v", u.name, err)
+				return transfer.Control{Type: transfer.TypeFailed, Reason: "failed to store chunk"}
+			}
+		}
+	}
+	return reply
+}
+
+// handleManifest verifies the upload. A verified upload is closed and, if it
+// is resumable, moved to the recording storage.
+func (u *upload) handleManifest(s *session, manifest transfer.Control) transfer.Control {
+	u.mutex.Lock()
+	if u.closed {
+		u.mutex.Unlock()
+		return transfer.Control{Type: transfer.TypeFailed, Reason: "transfer taken over by another connection"}
+	}
+
+	reply := u.receiver.HandleManifest(manifest)
+	reply.RecordingID = u.recordingID
+	if reply.Type != transfer.TypeComplete {
+		u.mutex.Unlock()
+		s.logf("Upload %s failed verification: %s", u.name, reply.Reason)
+		return reply
+	}
+
+	s.logf("Upload %s complete: %d chunks, %d bytes, sha256 %s", u.name, reply.Chunks, reply.Size, reply.SHA256)
+	if u.statePath == "" {
+		u.closeFile(s)
+	} else {
+		// The state file still says the upload is incomplete if this
+		// fails, so a retry of the manifest stores it again.
+		if err := u.store(s); err != nil {
+			u.mutex.Unlock()
+			u.unregister()
+			s.logf("Failed to store %s: %v", u.name, err)
+			return transfer.Control{Type: transfer.TypeFailed, RecordingID: u.recordingID, Reason: "failed to store recording"}
+		}
+		u.stored = true
+		if err := u.saveState(); err != nil {
+			s.logf("Failed to save upload state for %s: %v", u.name, err)
+		}
+	}
+	u.mutex.Unlock()
+
+	u.unregister()
+	return reply
+}
+
+// store closes a complete resumable upload and puts it in the recording
+// storage. The caller must hold u.mutex.
+func (u *upload) store(s *session) error {
+	if u.encrypter != nil {
+		if err := u.encrypter.Close(); err != nil {
+			u.closeFile(s)
+			return err
+		}
+	}
+	if u.spool != nil {
+		spooled := fileSize(u.path)
+		err := u.spool.Complete()
+		releaseDisk(spooled - fileSize(u.path))
+		u.closeFile(s)
+		return err
+	}
+	u.closeFile(s)
+	sink, _ := plainRecordings()
+	return storage.Store(sink, u.path, u.name)
+}
+
+// finishUpload closes the session's current upload, leaving a resumable one
+// ready to be continued. The caller must hold uploadMutex.
+func (s *session) finishUpload() {
+	if s.upload == nil {
+		return
+	}
+
+	u := s.upload
+	s.upload = nil
+
+	u.mutex.Lock()
+	if !u.closed {
+		s.logf("Closing incomplete upload %s", u.name)
+		u.closeFile(s)
+	}
+	u.mutex.Unlock()
+
+	u.unregister()
+}
+
+// closeFile closes the upload file. The caller must hold u.mutex.
+func (u *upload) closeFile(s *session) {
+	if err := u.file.Close(); err != nil {
+		s.logf("Error closing %s: %v", u.name, err)
+	}
+	u.closed = true
+}
+
+// unregister removes the upload from activeUploads unless another session
+// has taken it over. It must not be called with u.mutex held,
+// since openResumableUpload locks the two the other way round.
+func (u *upload) unregister() {
+	if u.recordingID == "" {
+		return
+	}
+
+	activeUploadsMutex.Lock()
+	if activeUploads[u.key()] == u {
+		delete(activeUploads, u.key())
+	}
+	activeUploadsMutex.Unlock()
+}
+
+// closeLocked closes an upload that another session is taking over. The
+// caller must hold activeUploadsMutex.
+func (u *upload) closeLocked() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if !u.closed {
+		u.file.Close()
+		u.closed = true
+	}
+	delete(activeUploads, u.key())
+}
+
+// handleResumeUpload tells a reconnecting browser how much of a recording
+// the server already holds. The upload itself is resumed by a "begin" with
+// the same recording ID on the new data channel.
+func (s *session) handleResumeUpload(msg *signaling.ResumeUpload) {
+	if !recordingIDPattern.MatchString(msg.RecordingID) {
+		s.writeError(signaling.CodeInvalidMessage, "invalid recording ID")
+		return
+	}
+
+	reply, err := uploadOffset(uploadKey{owner: s.uploadOwner(), recordingID: msg.RecordingID})
+	if errors.Is(err, errUploadOwned) {
+		s.writeError(signaling.CodeForbidden, "%v", err)
+		return
+	}
+	if err != nil {
+		s.logf("Failed to look up upload %s: %v", msg.RecordingID, err)
+		s.writeError(signaling.CodeInternal, "failed to look up recording")
+		return
+	}
+
+	if err := s.writeMessage(reply); err != nil {
+		s.logf("Failed to send upload offset: %v", err)
+	}
+}
+
+func uploadOffset(key uploadKey) (*signaling.UploadOffset, error) {
+	reply := &signaling.UploadOffset{RecordingID: key.recordingID}
+
+	activeUploadsMutex.Lock()
+	u := activeUploads[key]
+	activeUploadsMutex.Unlock()
+
+	if u != nil {
+		u.mutex.Lock()
+		reply.Seq = u.receiver.NextSeq()
+		reply.Offset = u.receiver.Size()
+		u.mutex.Unlock()
+		return reply, nil
+	}
+
+	path := key.path()
+	state, err := key.loadState()
+	switch {
+	case err == nil:
+		reply.Seq = state.NextSeq
+		reply.Offset = state.Size
+		reply.Complete = state.Complete
+	case errors.Is(err, fs.ErrNotExist):
+		if info, err := os.Stat(path); err == nil {
+			reply.Complete = true
+			reply.Offset = uint64(info.Size())
+		}
+	default:
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mladenovic-13/pion-webrtc-app/auth"
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+	"github.com/pion/webrtc/v4"
+)
+
+const whepPath = "/whep"
+
+var (
+	errSessionClosed = errors.New("session is closed")
+	errNoTracks      = errors.New("session has no tracks to play")
+	errTracksPending = errors.New("session has not started all of its tracks yet")
+)
+
+// viewer is a WHEP subscriber to one session. It has its own
+// PeerConnection, with a local track for each track the publisher sends.
+// Viewers count against the session limits of the client watching, like
+// sessions do.
+type viewer struct {
+	id             string
+	publisher      *session
+	remoteIP       string
+	subject        string
+	peerConnection *webrtc.PeerConnection
+
+	// tracks are the publisher's tracks forwarded to this viewer. They are
+	// guarded by the publisher's tracksMutex.
+	tracks []*publishedTrack
+
+	closeOnce sync.Once
+}
+
+// handleWHEP serves WebRTC-HTTP Egress Protocol players, which watch a live
+// session:
+//
+//	POST   /whep/{session}           SDP offer in, SDP answer out, viewer at Location
+//	PATCH  /whep/{session}/{viewer}  trickle ICE candidates or an ICE restart
+//	DELETE /whep/{session}/{viewer}  stop watching
+func handleWHEP(w http.ResponseWriter, r *http.Request) {
+	sessionID, viewerID, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, whepPath), "/"), "/")
+
+	if r.Method == http.MethodOptions {
+		if viewerID == "" {
+			w.Header().Set("Accept-Post", mimeTypeSDP)
+		} else {
+			w.Header().Set("Accept-Patch", mimeTypeSDPFragment)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	s, ok := sessions.get(sessionID)
+	if !ok {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+
+	if viewerID == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleWHEPOffer(w, r)
+		return
+	}
+
+	v, ok := s.getViewer(viewerID)
+	if !ok {
+		http.Error(w, "viewer not found", http.StatusNotFound)
+		return
+	}
+	if !authorizeOwner(w, r, v.subject) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		patchICE(v.peerConnection, w, r, v.logf)
+	case http.MethodDelete:
+		v.logf("Viewer left")
+		v.close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Allow", "PATCH, DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *session) handleWHEPOffer(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+	if !s.mayWatch(claims) {
+		http.Error(w, "the token does not permit watching this session", http.StatusForbidden)
+		return
+	}
+	if !hasContentType(r, mimeTypeSDP) {
+		http.Error(w, "expected "+mimeTypeSDP, http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil {
+		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		return
+	}
+
+	v, err := newViewer(s, r.RemoteAddr, claims)
+	var quotaErr *signaling.Error
+	if errors.As(err, &quotaErr) && quotaErr.Code == signaling.CodeQuotaExceeded {
+		http.Error(w, quotaErr.Message, http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		s.logf("Failed to create viewer: %v", err)
+		http.Error(w, "failed to create viewer", http.StatusInternalServerError)
+		return
+	}
+
+	// The offer goes in first so that the tracks are added to the
+	// transceivers the player asked for.
+	if err := v.peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(offer),
+	}); err != nil {
+		v.logf("Failed to set remote description: %v", err)
+		v.close()
+		http.Error(w, "invalid offer", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.subscribe(v); err != nil {
+		v.logf("Failed to subscribe: %v", err)
+		v.close()
+		switch {
+		case errors.Is(err, errNoTracks), errors.Is(err, errTracksPending):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, errSessionClosed):
+			http.Error(w, "session not found", http.StatusNotFound)
+		default:
+			http.Error(w, "failed to subscribe", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	answer, err := answerRemoteOffer(v.peerConnection)
+	if err != nil {
+		v.logf("%v", err)
+		v.close()
+		http.Error(w, "failed to create answer", http.StatusInternalServerError)
+		return
+	}
+	v.logf("New viewer from %s", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", mimeTypeSDP)
+	w.Header().Set("Location", whepPath+"/"+s.id+"/"+v.id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// newViewer creates a viewer of publisher for the client at remoteAddr,
+// whose claims are nil when tokens are not required. A client over its
+// session limits gets a quota-exceeded *signaling.Error.
+func newViewer(publisher *session, remoteAddr string, claims *auth.Claims) (*viewer, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &viewer{
+		id:        id,
+		publisher: publisher,
+		remoteIP:  remoteIP(remoteAddr),
+	}
+	if claims != nil {
+		v.subject = claims.Subject
+	}
+
+	if err := admitSession(v.remoteIP, v.subject); err != nil {
+		return nil, err
+	}
+	v.peerConnection, err = createPeerConnection()
+	if err != nil {
+		releaseSession(v.remoteIP, v.subject)
+		return nil, err
+	}
+
+	v.peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		v.logf("ICE Connection State has changed: %s", connectionState.String())
+
+		// A disconnected viewer can still restart ICE with a PATCH request.
+		switch connectionState {
+		case webrtc.ICEConnectionStateFailed,
+			webrtc.ICEConnectionStateClosed:
+			go v.close()
+		}
+	})
+
+	return v, nil
+}
+
+func (v *viewer) logf(format string, args ...interface{}) {
+	log.Printf("[%s/%s] "+format, append([]interface{}{v.publisher.id, v.id}, args...)...)
+}
+
+// close stops forwarding to the viewer and closes its PeerConnection. It is
+// safe to call more than once and from any goroutine.
+func (v *viewer) close() {
+	v.closeOnce.Do(func() {
+		v.publisher.tracksMutex.Lock()
+		v.unsubscribeLocked()
+		v.publisher.tracksMutex.Unlock()
+
+		if err := v.peerConnection.Close(); err != nil {
+			v.logf("Error closing peer connection: %v", err)
+		}
+		releaseSession(v.remoteIP, v.subject)
+		v.logf("Viewer closed")
+	})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+	"github.com/pion/webrtc/v4"
+)
+
+const whipPath = "/whip"
+
+// maxSDPSize bounds the body of WHIP and WHEP requests.
+const maxSDPSize = 1 << 20
+
+const (
+	mimeTypeSDP         = "application/sdp"
+	mimeTypeSDPFragment = "application/trickle-ice-sdpfrag"
+)
+
+// handleWHIP serves WebRTC-HTTP Ingestion Protocol publishers such as OBS:
+//
+//	POST   /whip                SDP offer in, SDP answer out, session at Location
+//	PATCH  /whip/{id}/{secret}  trickle ICE candidates or an ICE restart
+//	DELETE /whip/{id}/{secret}  end the session
+//
+// The session's secret in the resource URL keeps those who only know its
+// ID, such as WHEP players, from changing it. WHIP sessions are recorded
+// like any other; they just have no WebSocket.
+func handleWHIP(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, whipPath), "/"), "/")
+
+	if r.Method == http.MethodOptions {
+		if id == "" {
+			w.Header().Set("Accept-Post", mimeTypeSDP)
+		} else {
+			w.Header().Set("Accept-Patch", mimeTypeSDPFragment)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if id == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleWHIPOffer(w, r)
+		return
+	}
+
+	s, ok := sessions.get(id)
+	if !ok || s.protocol != protocolWHIP || !s.hasSecret(secret) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if !authorizeOwner(w, r, s.subject()) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		s.handleWHIPPatch(w, r)
+	case http.MethodDelete:
+		s.logf("WHIP session ended by %s", r.RemoteAddr)
+		s.close()
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.Header().Set("Allow", "PATCH, DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleWHIPOffer(w http.ResponseWriter, r *http.Request) {
+	claims, ok := authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+	if !hasContentType(r, mimeTypeSDP) {
+		http.Error(w, "expected "+mimeTypeSDP, http.StatusUnsupportedMediaType)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil {
+		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		return
+	}
+
+	s, err := newSession(protocolWHIP, r.RemoteAddr, nil, claims)
+	var quotaErr *signaling.Error
+	if errors.As(err, &quotaErr) && quotaErr.Code == signaling.CodeQuotaExceeded {
+		http.Error(w, quotaErr.Message, http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		return
+	}
+	s.logf("New WHIP session from %s", r.RemoteAddr)
+
+	answer, err := answerWithCandidates(s.peerConnection, string(offer))
+	if err != nil {
+		s.logf("%v", err)
+		s.close()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeTypeSDP)
+	w.Header().Set("Location", whipPath+"/"+s.id+"/"+s.secret)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// answerWithCandidates applies an offer and returns the answer with all
+// local candidates in it, since WHIP and WHEP servers do not trickle.
+func answerWithCandidates(pc *webrtc.PeerConnection, offer string) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	}); err != nil {
+		return "", fmt.Errorf("failed to set remote description: %w", err)
+	}
+	return answerRemoteOffer(pc)
+}
+
+// answerRemoteOffer answers the remote description already applied to pc,
+// waiting for ICE gathering to finish.
+func answerRemoteOffer(pc *webrtc.PeerConnection) (string, error) {
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create answer: %w", err)
+	}
+
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("failed to set local description: %w", err)
+	}
+	<-gatherComplete
+
+	return pc.LocalDescription().SDP, nil
+}
+
+func (s *session) handleWHIPPatch(w http.ResponseWriter, r *http.Request) {
+	patchICE(s.peerConnection, w, r, s.logf)
+}
+
+// patchICE applies a trickle ICE fragment to pc. A fragment with new ICE
+// credentials is an ICE restart, answered with the server's new credentials
+// and candidates.
+func patchICE(pc *webrtc.PeerConnection, w http.ResponseWriter, r *http.Request, logf func(string, ...interface{})) {
+	if !hasContentType(r, mimeTypeSDPFragment) {
+		http.Error(w, "expected "+mimeTypeSDPFragment, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil {
+		http.Error(w, "failed to read fragment", http.StatusBadRequest)
+		return
+	}
+
+	frag := parseSDPFragment(string(body))
+	remote := pc.RemoteDescription()
+	if remote == nil {
+		http.Error(w, "session has no offer", http.StatusConflict)
+		return
+	}
+
+	if frag.ufrag != "" && frag.ufrag != sdpAttribute(remote.SDP, "ice-ufrag") {
+		answer, err := restartICE(pc, remote.SDP, frag, logf)
+		if err != nil {
+			logf("ICE restart failed: %v", err)
+			http.Error(w, "ICE restart failed", http.StatusInternalServerError)
+			return
+		}
+		logf("ICE restarted")
+
+		w.Header().Set("Content-Type", mimeTypeSDPFragment)
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, localSDPFragment(answer))
+		return
+	}
+
+	for _, candidate := range frag.candidates {
+		if err := pc.AddICECandidate(candidate); err != nil {
+			logf("Failed to add ICE candidate: %v", err)
+			http.Error(w, "invalid candidate", http.StatusBadRequest)
+			return
+		}
+	}
+	if frag.endOfCandidates {
+		if err := pc.AddICECandidate(webrtc.ICECandidateInit{}); err != nil {
+			logf("Failed to add end-of-candidates: %v", err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restartICE renegotiates with the client's new ICE credentials by applying
+// its original offer with the credentials swapped in.
+func restartICE(pc *webrtc.PeerConnection, offer string, frag sdpFragment, logf func(string, ...interface{})) (string, error) {
+	if frag.pwd == "" {
+		return "", errors.New("ICE restart without ice-pwd")
+	}
+
+	offer = replaceSDPAttribute(offer, "ice-ufrag", frag.ufrag)
+	offer = replaceSDPAttribute(offer, "ice-pwd", frag.pwd)
+	answer, err := answerWithCandidates(pc, offer)
+	if err != nil {
+		return "", err
+	}
+
+	for _, candidate := range frag.candidates {
+		if err := pc.AddICECandidate(candidate); err != nil {
+			logf("Failed to add ICE candidate: %v", err)
+		}
+	}
+	return answer, nil
+}
+
+// sdpFragment is the content of an application/trickle-ice-sdpfrag body.
+type sdpFragment struct {
+	ufrag           string
+	pwd             string
+	candidates      []webrtc.ICECandidateInit
+	endOfCandidates bool
+}
+
+func parseSDPFragment(body string) sdpFragment {
+	var frag sdpFragment
+	var mid *string
+	var mLineIndex *uint16
+
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			frag.pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "m="):
+			index := uint16(0)
+			if mLineIndex != nil {
+				index = *mLineIndex + 1
+			}
+			mLineIndex = &index
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			frag.candidates = append(frag.candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        mid,
+				SDPMLineIndex: mLineIndex,
+			})
+		case line == "a=end-of-candidates":
+			frag.endOfCandidates = true
+		}
+	}
+	return frag
+}
+
+// localSDPFragment extracts the ICE credentials and candidates of each
+// media section from a local description.
+func localSDPFragment(sdp string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		for _, prefix := range []string{"a=ice-ufrag:", "a=ice-pwd:", "m=", "a=mid:", "a=candidate:", "a=end-of-candidates"} {
+			if strings.HasPrefix(line, prefix) {
+				b.WriteString(line + "\r\n")
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+// sdpAttribute returns the value of the first a=name: line in sdp.
+func sdpAttribute(sdp, name string) string {
+	prefix := "a=" + name + ":"
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return ""
+}
+
+// replaceSDPAttribute sets every a=name: line in sdp to value.
+func replaceSDPAttribute(sdp, name, value string) string {
+	prefix := "a=" + name + ":"
+	lines := strings.Split(sdp, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), prefix) {
+			lines[i] = prefix + value + "\r"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func hasContentType(r *http.Request, mimeType string) bool {
+	contentType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	return strings.EqualFold(strings.TrimSpace(contentType), mimeType)
+}
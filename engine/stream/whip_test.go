@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func strPtr(s string) *string { return &s }
+func u16Ptr(n uint16) *uint16 { return &n }
+
+func TestParseSDPFragment(t *testing.T) {
+	const (
+		host  = "candidate:1 1 udp 2122260223 192.0.2.1 54400 typ host"
+		relay = "candidate:2 1 udp 41885439 203.0.113.7 3478 typ relay raddr 0.0.0.0 rport 0"
+	)
+	tests := []struct {
+		name string
+		body string
+		want sdpFragment
+	}{
+		{
+			name: "candidate",
+			body: "a=ice-ufrag:EsAw\r\n" +
+				"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+				"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+				"a=mid:0\r\n" +
+				"a=" + host + "\r\n",
+			want: sdpFragment{
+				ufrag: "EsAw",
+				pwd:   "P2uYro0UCOQ4zxjKXaWCBui1",
+				candidates: []webrtc.ICECandidateInit{
+					{Candidate: host, SDPMid: strPtr("0"), SDPMLineIndex: u16Ptr(0)},
+				},
+			},
+		},
+		{
+			name: "ICE restart",
+			body: "a=ice-ufrag:ysXw\r\n" +
+				"a=ice-pwd:vw5LmwG4y/e6dPP/zAP9Gp5k\r\n" +
+				"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+				"a=mid:0\r\n",
+			want: sdpFragment{ufrag: "ysXw", pwd: "vw5LmwG4y/e6dPP/zAP9Gp5k"},
+		},
+		{
+			name: "several media sections",
+			body: "a=ice-ufrag:EsAw\r\n" +
+				"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+				"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+				"a=mid:0\r\n" +
+				"a=" + host + "\r\n" +
+				"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+				"a=mid:video\r\n" +
+				"a=" + host + "\r\n" +
+				"a=" + relay + "\r\n" +
+				"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n" +
+				"a=" + relay + "\r\n",
+			want: sdpFragment{
+				ufrag: "EsAw",
+				pwd:   "P2uYro0UCOQ4zxjKXaWCBui1",
+				candidates: []webrtc.ICECandidateInit{
+					{Candidate: host, SDPMid: strPtr("0"), SDPMLineIndex: u16Ptr(0)},
+					{Candidate: host, SDPMid: strPtr("video"), SDPMLineIndex: u16Ptr(1)},
+					{Candidate: relay, SDPMid: strPtr("video"), SDPMLineIndex: u16Ptr(1)},
+					// A section without a=mid has only its index.
+					{Candidate: relay, SDPMLineIndex: u16Ptr(2)},
+				},
+			},
+		},
+		{
+			name: "end of candidates",
+			body: "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+				"a=mid:0\r\n" +
+				"a=end-of-candidates\r\n",
+			want: sdpFragment{endOfCandidates: true},
+		},
+		{
+			name: "LF line endings",
+			body: "a=ice-ufrag:EsAw\n" +
+				"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\n" +
+				"m=audio 9 UDP/TLS/RTP/SAVPF 111\n" +
+				"a=mid:0\n" +
+				"a=" + host + "\n" +
+				"a=end-of-candidates",
+			want: sdpFragment{
+				ufrag: "EsAw",
+				pwd:   "P2uYro0UCOQ4zxjKXaWCBui1",
+				candidates: []webrtc.ICECandidateInit{
+					{Candidate: host, SDPMid: strPtr("0"), SDPMLineIndex: u16Ptr(0)},
+				},
+				endOfCandidates: true,
+			},
+		},
+		{
+			name: "candidate before any media section",
+			body: "a=" + host + "\r\n",
+			want: sdpFragment{
+				candidates: []webrtc.ICECandidateInit{{Candidate: host}},
+			},
+		},
+		{
+			name: "empty",
+			body: "",
+			want: sdpFragment{},
+		},
+		{
+			name: "garbage",
+			body: "not an sdp fragment\x00\xff\r\n\r\na=\r\n=\nm\r\na=ice-ufrag\r\na=candidatex\r\n",
+			want: sdpFragment{},
+		},
+		{
+			name: "JSON",
+			body: `{"candidate":"` + host + `","sdpMid":"0"}`,
+			want: sdpFragment{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSDPFragment(tt.body); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSDPFragment(%q) =\n%#v\nwant\n%#v", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplaceSDPAttribute(t *testing.T) {
+	offer := "v=0\r\n" +
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+		"a=ice-ufrag:EsAw\r\n" +
+		"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+		"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+		"a=ice-ufrag:EsAw\r\n" +
+		"a=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n"
+	got := replaceSDPAttribute(offer, "ice-ufrag", "ysXw")
+	if want := strings.ReplaceAll(offer, "EsAw", "ysXw"); got != want {
+		t.Errorf("replaceSDPAttribute =\n%q\nwant\n%q", got, want)
+	}
+	if ufrag := sdpAttribute(got, "ice-ufrag"); ufrag != "ysXw" {
+		t.Errorf("sdpAttribute(ice-ufrag) = %q, want the new ufrag", ufrag)
+	}
+}
@@ -0,0 +1,197 @@
+package signaling
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// Encode validates m and returns its wire form, stamped with Version and the
+// message type.
+func Encode(m Message) ([]byte, error) {
+	return EncodeRoute(m, Route{})
+}
+
+// EncodeRoute is like Encode but also adds the non-empty fields of r.
+func EncodeRoute(m Message, r Route) ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+
+	if fields["version"], err = json.Marshal(Version); err != nil {
+		return nil, err
+	}
+	if fields["type"], err = json.Marshal(m.Type()); err != nil {
+		return nil, err
+	}
+	if r.From != "" {
+		if fields["from"], err = json.Marshal(r.From); err != nil {
+			return nil, err
+		}
+	}
+	if r.To != "" {
+		if fields["to"], err = json.Marshal(r.To); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+// Decode parses and validates a message. Unknown versions, unknown types,
+// unknown fields and missing required fields are all rejected. Any error
+// returned is an *Error suitable for sending back to the peer.
+//
+// Routing fields are accepted and ignored; use DecodeRoute to read them.
+func Decode(data []byte) (Message, error) {
+	m, _, err := DecodeRoute(data)
+	return m, err
+}
+
+// DecodeRoute is like Decode but also returns the message's routing fields.
+func DecodeRoute(data []byte) (Message, Route, error) {
+	var route Route
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, route, NewError(CodeInvalidMessage, "malformed message: %v", err)
+	}
+
+	var version int
+	if raw, ok := fields["version"]; !ok {
+		return nil, route, NewError(CodeUnsupportedVersion, "message has no version, expected %d", Version)
+	} else if err := json.Unmarshal(raw, &version); err != nil {
+		return nil, route, NewError(CodeInvalidMessage, "invalid version: %v", err)
+	}
+	if version != Version {
+		return nil, route, NewError(CodeUnsupportedVersion, "unsupported version %d, expected %d", version, Version)
+	}
+
+	var typ Type
+	if raw, ok := fields["type"]; !ok {
+		return nil, route, NewError(CodeInvalidMessage, "message has no type")
+	} else if err := json.Unmarshal(raw, &typ); err != nil {
+		return nil, route, NewError(CodeInvalidMessage, "invalid type: %v", err)
+	}
+
+	for name, field := range map[string]*string{"from": &route.From, "to": &route.To} {
+		if raw, ok := fields[name]; ok {
+			if err := json.Unmarshal(raw, field); err != nil {
+				return nil, route, NewError(CodeInvalidMessage, "invalid %s: %v", name, err)
+			}
+		}
+	}
+
+	m := newMessage(typ)
+	if m == nil {
+		return nil, route, NewError(CodeUnknownType, "unknown message type %q", typ)
+	}
+
+	delete(fields, "version")
+	delete(fields, "type")
+	delete(fields, "from")
+	delete(fields, "to")
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, route, NewError(CodeInvalidMessage, "malformed %s message: %v", typ, err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(m); err != nil {
+		return nil, route, NewError(CodeInvalidMessage, "malformed %s message: %v", typ, err)
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, route, err
+	}
+	return m, route, nil
+}
+
+// UnmarshalJSON accepts either an RTCIceCandidateInit object or a bare
+// candidate string. Objects are decoded strictly, like the rest of a message.
+func (c *ICECandidateInit) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var candidate string
+		if err := json.Unmarshal(data, &candidate); err != nil {
+			return err
+		}
+		*c = ICECandidateInit{Candidate: candidate}
+		return nil
+	}
+
+	// plain has the same fields but no UnmarshalJSON method, which keeps
+	// the decoder below from recursing into this function.
+	type plain ICECandidateInit
+	var p plain
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return err
+	}
+	*c = ICECandidateInit(p)
+	return nil
+}
+
+// AsError converts err into an *Error that can be sent to a peer.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return NewError(CodeInternal, "%v", err)
+}
+
+func newMessage(typ Type) Message {
+	switch typ {
+	case TypeOffer:
+		return &Offer{}
+	case TypeAnswer:
+		return &Answer{}
+	case TypeCandidate:
+		return &Candidate{}
+	case TypeEndOfCandidates:
+		return &EndOfCandidates{}
+	case TypeStartRecording:
+		return &StartRecording{}
+	case TypeStopRecording:
+		return &StopRecording{}
+	case TypeRecordingStarted:
+		return &RecordingStarted{}
+	case TypeRecordingStopped:
+		return &RecordingStopped{}
+	case TypeResumeUpload:
+		return &ResumeUpload{}
+	case TypeUploadOffset:
+		return &UploadOffset{}
+	case TypeJoin:
+		return &Join{}
+	case TypeJoined:
+		return &Joined{}
+	case TypePeerJoined:
+		return &PeerJoined{}
+	case TypePeerLeft:
+		return &PeerLeft{}
+	case TypeLeave:
+		return &Leave{}
+	case TypeSession:
+		return &Session{}
+	case TypeAuth:
+		return &Auth{}
+	case TypeBye:
+		return &Bye{}
+	case TypeError:
+		return &Error{}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package signaling
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func strPtr(s string) *string { return &s }
+func u16Ptr(n uint16) *uint16 { return &n }
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		code string
+	}{
+		{"not JSON", `offer`, CodeInvalidMessage},
+		{"not an object", `["offer"]`, CodeInvalidMessage},
+		{"no version", `{"type":"bye"}`, CodeUnsupportedVersion},
+		{"old version", `{"version":0,"type":"bye"}`, CodeUnsupportedVersion},
+		{"future version", `{"version":2,"type":"bye"}`, CodeUnsupportedVersion},
+		{"version not a number", `{"version":"1","type":"bye"}`, CodeInvalidMessage},
+		{"no type", `{"version":1}`, CodeInvalidMessage},
+		{"type not a string", `{"version":1,"type":7}`, CodeInvalidMessage},
+		{"unknown type", `{"version":1,"type":"hangup"}`, CodeUnknownType},
+		{"unknown field", `{"version":1,"type":"offer","sdp":"v=0","sdpType":"offer"}`, CodeInvalidMessage},
+		{"unknown field in empty message", `{"version":1,"type":"bye","reason":"done"}`, CodeInvalidMessage},
+		{"unknown candidate field", `{"version":1,"type":"candidate","candidate":{"candidate":"c","foo":1}}`, CodeInvalidMessage},
+		{"wrong field type", `{"version":1,"type":"offer","sdp":1}`, CodeInvalidMessage},
+		{"offer without sdp", `{"version":1,"type":"offer"}`, CodeInvalidMessage},
+		{"offer with empty sdp", `{"version":1,"type":"offer","sdp":""}`, CodeInvalidMessage},
+		{"answer without sdp", `{"version":1,"type":"answer"}`, CodeInvalidMessage},
+		{"candidate without candidate", `{"version":1,"type":"candidate"}`, CodeInvalidMessage},
+		{"join without room", `{"version":1,"type":"join"}`, CodeInvalidMessage},
+		{"route not a string", `{"version":1,"type":"bye","to":1}`, CodeInvalidMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Decode([]byte(tt.data))
+			if err == nil {
+				t.Fatalf("Decode(%s) = %#v, want an error", tt.data, m)
+			}
+			e, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("Decode error %v is a %T, not an *Error", err, err)
+			}
+			if e.Code != tt.code {
+				t.Errorf("Decode error code = %q (%s), want %q", e.Code, e.Message, tt.code)
+			}
+		})
+	}
+}
+
+func TestDecodeCandidate(t *testing.T) {
+	const line = "candidate:1 1 udp 2122260223 192.0.2.1 54400 typ host"
+	tests := []struct {
+		name string
+		data string
+		want ICECandidateInit
+	}{
+		{
+			"string",
+			`{"version":1,"type":"candidate","candidate":"` + line + `"}`,
+			ICECandidateInit{Candidate: line},
+		},
+		{
+			"object",
+			`{"version":1,"type":"candidate","candidate":{"candidate":"` + line + `","sdpMid":"0","sdpMLineIndex":0,"usernameFragment":"abcd"}}`,
+			ICECandidateInit{Candidate: line, SDPMid: strPtr("0"), SDPMLineIndex: u16Ptr(0), UsernameFragment: strPtr("abcd")},
+		},
+		{
+			"object with nulls",
+			`{"version":1,"type":"candidate","candidate":{"candidate":"` + line + `","sdpMid":null,"sdpMLineIndex":null}}`,
+			ICECandidateInit{Candidate: line},
+		},
+		{
+			"end of candidates",
+			`{"version":1,"type":"candidate","candidate":{"candidate":""}}`,
+			ICECandidateInit{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := Decode([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			c, ok := m.(*Candidate)
+			if !ok {
+				t.Fatalf("Decode returned a %T, want *Candidate", m)
+			}
+			if !reflect.DeepEqual(*c.Candidate, tt.want) {
+				t.Errorf("candidate = %+v, want %+v", *c.Candidate, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	messages := []Message{
+		&Offer{SDP: "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\n"},
+		&Answer{SDP: "v=0\r\n"},
+		&Candidate{Candidate: &ICECandidateInit{Candidate: "candidate:1 1 udp 1 192.0.2.1 9 typ host", SDPMid: strPtr("0"), SDPMLineIndex: u16Ptr(1)}},
+		&EndOfCandidates{},
+		&StartRecording{},
+		&StartRecording{RecordingID: "rec-1"},
+		&StopRecording{},
+		&RecordingStarted{Take: 1, RecordingID: "rec-1", File: "output-1-1.webm"},
+		&RecordingStopped{Take: 2, File: "output-1-2.webm", Duration: 12.5},
+		&ResumeUpload{RecordingID: "rec-1"},
+		&UploadOffset{RecordingID: "rec-1", Seq: 3, Offset: 49152, Complete: true},
+		&Join{Room: "demo"},
+		&Join{Room: "demo", PeerID: "alice"},
+		&Joined{Room: "demo", PeerID: "alice", Peers: []string{"bob", "carol"}},
+		&PeerJoined{Room: "demo", PeerID: "bob"},
+		&PeerLeft{Room: "demo", PeerID: "bob"},
+		&Leave{},
+		&Session{ID: "s1", ReconnectToken: "secret", ICEServers: []ICEServer{{URLs: []string{"turn:192.0.2.1:3478"}, Username: "u", Credential: "c"}}},
+		&Auth{Token: "token"},
+		&Bye{},
+		&Error{Code: CodeUnknownPeer, Message: "no peer bob"},
+	}
+	seen := map[Type]bool{}
+	for _, want := range messages {
+		seen[want.Type()] = true
+		t.Run(string(want.Type()), func(t *testing.T) {
+			route := Route{From: "alice", To: "bob"}
+			data, err := EncodeRoute(want, route)
+			if err != nil {
+				t.Fatalf("EncodeRoute: %v", err)
+			}
+
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if string(fields["version"]) != "1" || string(fields["type"]) != `"`+string(want.Type())+`"` {
+				t.Errorf("encoded version %s, type %s", fields["version"], fields["type"])
+			}
+
+			got, gotRoute, err := DecodeRoute(data)
+			if err != nil {
+				t.Fatalf("DecodeRoute(%s): %v", data, err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %#v, want %#v", got, want)
+			}
+			if gotRoute != route {
+				t.Errorf("decoded route %+v, want %+v", gotRoute, route)
+			}
+
+			// Without a route neither field is written.
+			data, err = Encode(want)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if _, gotRoute, err := DecodeRoute(data); err != nil || gotRoute != (Route{}) {
+				t.Errorf("DecodeRoute(%s) = route %+v, %v", data, gotRoute, err)
+			}
+		})
+	}
+	for _, typ := range []Type{
+		TypeOffer, TypeAnswer, TypeCandidate, TypeEndOfCandidates, TypeStartRecording,
+		TypeStopRecording, TypeRecordingStarted, TypeRecordingStopped, TypeResumeUpload,
+		TypeUploadOffset, TypeJoin, TypeJoined, TypePeerJoined, TypePeerLeft, TypeLeave,
+		TypeSession, TypeAuth, TypeBye, TypeError,
+	} {
+		if !seen[typ] {
+			t.Errorf("no round trip for %s", typ)
+		}
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	for _, m := range []Message{&Offer{}, &Answer{}, &Candidate{}, &Join{}, &Error{}} {
+		if data, err := Encode(m); err == nil {
+			t.Errorf("Encode(%T) = %s, want an error", m, data)
+		}
+	}
+}
+
+func TestAsError(t *testing.T) {
+	e := NewError(CodeForbidden, "not yours")
+	if AsError(e) != e {
+		t.Error("AsError did not return the *Error it was given")
+	}
+	if got := AsError(json.Unmarshal([]byte("x"), new(int))); got.Code != CodeInternal {
+		t.Errorf("AsError of a plain error has code %q, want %q", got.Code, CodeInternal)
+	}
+}
@@ -0,0 +1,294 @@
+// Package server implements a room-based signaling server for the messages
+// in package signaling.
+//
+// A client connects over WebSocket and sends a join message naming a room and,
+// optionally, the peer ID it wants. The server answers with joined, listing
+// the other peers in the room, and tells those peers with peer-joined; when
+// the client leaves or disconnects they get peer-left. Every other message
+// must name its recipient in "to" and is delivered only to that peer, with
+// "from" set to the sender's ID.
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+)
+
+// maxMessageSize bounds a single signaling message. SDP with many
+// candidates is still well under this.
+const maxMessageSize = 1 << 20
+
+// writeTimeout bounds every write to a peer, and sendQueueSize is how many
+// messages may wait for it. A peer that falls further behind is
+// disconnected rather than holding up the peers writing to it.
+const (
+	writeTimeout  = 10 * time.Second
+	sendQueueSize = 64
+)
+
+// namePattern limits room names and peer IDs.
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Server relays signaling messages between the peers of each room. It is an
+// http.Handler for the WebSocket endpoint.
+type Server struct {
+	upgrader websocket.Upgrader
+
+	mutex sync.Mutex
+	rooms map[string]*room
+}
+
+type room struct {
+	name  string
+	peers map[string]*peer
+}
+
+type peer struct {
+	id   string
+	room *room
+	conn *websocket.Conn
+
+	// send queues messages for writeLoop, the only goroutine that writes to
+	// conn, since gorilla/websocket does not allow more than one at a time.
+	// Queuing never blocks, so messages can be sent with Server.mutex held.
+	send chan []byte
+	done chan struct{}
+}
+
+// New returns a Server with no rooms.
+func New() *Server {
+	return &Server{
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		rooms: make(map[string]*room),
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket and serves one client until
+// it disconnects.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("WebSocket Upgrade Error:", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxMessageSize)
+
+	p := &peer{
+		conn: conn,
+		send: make(chan []byte, sendQueueSize),
+		done: make(chan struct{}),
+	}
+	go p.writeLoop()
+	defer close(p.done)
+	defer s.leave(p)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("[%s] WebSocket Read Error: %v", p.id, err)
+			}
+			return
+		}
+
+		msg, route, err := signaling.DecodeRoute(data)
+		if err != nil {
+			p.write(signaling.AsError(err), signaling.Route{})
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *signaling.Join:
+			s.join(p, msg)
+
+		case *signaling.Leave:
+			s.leave(p)
+
+		case *signaling.Joined, *signaling.PeerJoined, *signaling.PeerLeft:
+			p.write(signaling.NewError(signaling.CodeInvalidMessage, "%s is only sent by the server", msg.Type()), signaling.Route{})
+
+		default:
+			s.relay(p, msg, route.To)
+		}
+	}
+}
+
+// join adds p to the room named in msg, creating the room if needed.
+func (s *Server) join(p *peer, msg *signaling.Join) {
+	if !namePattern.MatchString(msg.Room) {
+		p.write(signaling.NewError(signaling.CodeInvalidMessage, "invalid room name"), signaling.Route{})
+		return
+	}
+	if msg.PeerID != "" && !namePattern.MatchString(msg.PeerID) {
+		p.write(signaling.NewError(signaling.CodeInvalidMessage, "invalid peer ID"), signaling.Route{})
+		return
+	}
+
+	s.mutex.Lock()
+	if p.room != nil {
+		s.mutex.Unlock()
+		p.write(signaling.NewError(signaling.CodeInvalidState, "already in room %q", p.room.name), signaling.Route{})
+		return
+	}
+
+	r := s.rooms[msg.Room]
+	if r == nil {
+		r = &room{name: msg.Room, peers: make(map[string]*peer)}
+	}
+
+	id := msg.PeerID
+	if id == "" {
+		var err error
+		if id, err = newPeerID(); err != nil {
+			s.mutex.Unlock()
+			log.Println("Failed to create peer ID:", err)
+			p.write(signaling.NewError(signaling.CodeInternal, "failed to create peer ID"), signaling.Route{})
+			return
+		}
+	}
+	if _, taken := r.peers[id]; taken {
+		s.mutex.Unlock()
+		p.write(signaling.NewError(signaling.CodePeerIDTaken, "peer ID %q is already in room %q", id, msg.Room), signaling.Route{})
+		return
+	}
+
+	others := r.others(id)
+	p.id = id
+	p.room = r
+	r.peers[id] = p
+	s.rooms[r.name] = r
+
+	// Queuing while holding the lock keeps notifications in the same order
+	// as the membership changes they describe.
+	joined := &signaling.Joined{Room: r.name, PeerID: id, Peers: make([]string, 0, len(others))}
+	for _, other := range others {
+		joined.Peers = append(joined.Peers, other.id)
+		other.write(&signaling.PeerJoined{Room: r.name, PeerID: id}, signaling.Route{})
+	}
+	p.write(joined, signaling.Route{})
+	s.mutex.Unlock()
+
+	log.Printf("[%s] Joined room %s with %d other peers", id, r.name, len(others))
+}
+
+// leave removes p from its room, if any, and tells the remaining peers.
+func (s *Server) leave(p *peer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r := p.room
+	if r == nil {
+		return
+	}
+
+	delete(r.peers, p.id)
+	for _, other := range r.others(p.id) {
+		other.write(&signaling.PeerLeft{Room: r.name, PeerID: p.id}, signaling.Route{})
+	}
+	if len(r.peers) == 0 {
+		delete(s.rooms, r.name)
+	}
+
+	log.Printf("[%s] Left room %s", p.id, r.name)
+	p.room = nil
+}
+
+// relay delivers msg from p to the peer named to in the same room.
+func (s *Server) relay(p *peer, msg signaling.Message, to string) {
+	s.mutex.Lock()
+	if p.room == nil {
+		s.mutex.Unlock()
+		p.write(signaling.NewError(signaling.CodeInvalidState, "join a room first"), signaling.Route{})
+		return
+	}
+	if to == "" {
+		s.mutex.Unlock()
+		p.write(signaling.NewError(signaling.CodeInvalidMessage, "%s message has no recipient", msg.Type()), signaling.Route{})
+		return
+	}
+	target := p.room.peers[to]
+	s.mutex.Unlock()
+
+	if target == nil || target == p {
+		p.write(signaling.NewError(signaling.CodeUnknownPeer, "no peer %q in room", to), signaling.Route{})
+		return
+	}
+
+	target.write(msg, signaling.Route{From: p.id, To: to})
+}
+
+// others returns the peers of r other than id, sorted by ID.
+func (r *room) others(id string) []*peer {
+	peers := make([]*peer, 0, len(r.peers))
+	for _, p := range r.peers {
+		if p.id != id {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].id < peers[j].id
+	})
+	return peers
+}
+
+// write queues a message for the peer without blocking. A peer whose queue
+// is full is disconnected; a broken connection is cleaned up by its own read
+// loop.
+func (p *peer) write(m signaling.Message, route signaling.Route) {
+	data, err := signaling.EncodeRoute(m, route)
+	if err != nil {
+		log.Printf("[%s] Failed to encode %s: %v", p.id, m.Type(), err)
+		return
+	}
+
+	select {
+	case p.send <- data:
+	default:
+		log.Printf("[%s] Disconnecting %s, it is not keeping up with its messages", p.id, p.conn.RemoteAddr())
+		p.conn.Close()
+	}
+}
+
+// writeLoop sends the queued messages until the peer's read loop ends or a
+// write fails.
+func (p *peer) writeLoop() {
+	for {
+		select {
+		case data := <-p.send:
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := p.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("Failed to write to %s: %v", p.conn.RemoteAddr(), err)
+				// Closing the connection ends the read loop too.
+				p.conn.Close()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// newPeerID returns a random 16 character hex identifier.
+func newPeerID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
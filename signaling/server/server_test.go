@@ -0,0 +1,217 @@
+package server
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mladenovic-13/pion-webrtc-app/signaling"
+)
+
+// client is a WebSocket connection to the server under test.
+type client struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func newServer(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(New())
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dial(t *testing.T, url string) *client {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn}
+}
+
+func (c *client) send(m signaling.Message, route signaling.Route) {
+	c.t.Helper()
+	data, err := signaling.EncodeRoute(m, route)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.sendRaw(string(data))
+}
+
+func (c *client) sendRaw(data string) {
+	c.t.Helper()
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(data)); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// receive returns the next message from the server.
+func (c *client) receive() (signaling.Message, signaling.Route) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := c.conn.ReadMessage()
+	if err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	m, route, err := signaling.DecodeRoute(data)
+	if err != nil {
+		c.t.Fatalf("decoding %s: %v", data, err)
+	}
+	return m, route
+}
+
+// expect checks that the next message from the server is want, sent by from.
+func (c *client) expect(want signaling.Message, from string) {
+	c.t.Helper()
+	got, route := c.receive()
+	if !reflect.DeepEqual(got, want) || route.From != from {
+		c.t.Fatalf("received %#v from %q, want %#v from %q", got, route.From, want, from)
+	}
+}
+
+// expectError checks that the next message from the server is an error with
+// the given code.
+func (c *client) expectError(code string) {
+	c.t.Helper()
+	got, _ := c.receive()
+	e, ok := got.(*signaling.Error)
+	if !ok || e.Code != code {
+		c.t.Fatalf("received %#v, want a %s error", got, code)
+	}
+}
+
+// join joins room as id and checks the reply.
+func (c *client) join(room, id string, others ...string) {
+	c.t.Helper()
+	c.send(&signaling.Join{Room: room, PeerID: id}, signaling.Route{})
+	if others == nil {
+		others = []string{}
+	}
+	c.expect(&signaling.Joined{Room: room, PeerID: id, Peers: others}, "")
+}
+
+func TestJoinAndLeave(t *testing.T) {
+	url := newServer(t)
+	alice, bob, carol := dial(t, url), dial(t, url), dial(t, url)
+
+	alice.join("demo", "alice")
+	bob.join("demo", "bob", "alice")
+	alice.expect(&signaling.PeerJoined{Room: "demo", PeerID: "bob"}, "")
+	carol.join("demo", "carol", "alice", "bob")
+	alice.expect(&signaling.PeerJoined{Room: "demo", PeerID: "carol"}, "")
+	bob.expect(&signaling.PeerJoined{Room: "demo", PeerID: "carol"}, "")
+
+	// Leaving keeps the connection, and the ID can be taken again.
+	bob.send(&signaling.Leave{}, signaling.Route{})
+	alice.expect(&signaling.PeerLeft{Room: "demo", PeerID: "bob"}, "")
+	carol.expect(&signaling.PeerLeft{Room: "demo", PeerID: "bob"}, "")
+	bob.join("demo", "bob", "alice", "carol")
+	alice.expect(&signaling.PeerJoined{Room: "demo", PeerID: "bob"}, "")
+	carol.expect(&signaling.PeerJoined{Room: "demo", PeerID: "bob"}, "")
+
+	// Disconnecting leaves too.
+	carol.conn.Close()
+	alice.expect(&signaling.PeerLeft{Room: "demo", PeerID: "carol"}, "")
+	bob.expect(&signaling.PeerLeft{Room: "demo", PeerID: "carol"}, "")
+}
+
+func TestJoinGeneratedID(t *testing.T) {
+	url := newServer(t)
+	alice := dial(t, url)
+	alice.send(&signaling.Join{Room: "demo"}, signaling.Route{})
+	m, _ := alice.receive()
+	joined, ok := m.(*signaling.Joined)
+	if !ok || len(joined.PeerID) != 16 || len(joined.Peers) != 0 {
+		t.Fatalf("received %#v, want joined with a generated peer ID", m)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	url := newServer(t)
+	alice, bob, carol := dial(t, url), dial(t, url), dial(t, url)
+	alice.join("demo", "alice")
+	bob.join("demo", "bob", "alice")
+	alice.expect(&signaling.PeerJoined{Room: "demo", PeerID: "bob"}, "")
+	carol.join("demo", "carol", "alice", "bob")
+	alice.expect(&signaling.PeerJoined{Room: "demo", PeerID: "carol"}, "")
+	bob.expect(&signaling.PeerJoined{Room: "demo", PeerID: "carol"}, "")
+
+	offer := &signaling.Offer{SDP: "v=0\r\n"}
+	alice.send(offer, signaling.Route{To: "bob"})
+	bob.expect(offer, "alice")
+
+	// A "from" set by the sender is replaced with its own ID.
+	answer := &signaling.Answer{SDP: "v=0\r\n"}
+	bob.send(answer, signaling.Route{From: "carol", To: "alice"})
+	alice.expect(answer, "bob")
+
+	// Carol got neither: the next message she receives is the one sent to
+	// her after them.
+	bye := &signaling.Bye{}
+	alice.send(bye, signaling.Route{To: "carol"})
+	carol.expect(bye, "alice")
+}
+
+func TestRelayRejected(t *testing.T) {
+	url := newServer(t)
+	alice, bob := dial(t, url), dial(t, url)
+
+	// Nothing is relayed before joining.
+	alice.send(&signaling.Bye{}, signaling.Route{To: "bob"})
+	alice.expectError(signaling.CodeInvalidState)
+
+	alice.join("demo", "alice")
+	bob.join("other", "bob")
+
+	tests := []struct {
+		name string
+		to   string
+		code string
+	}{
+		{"unknown peer", "dave", signaling.CodeUnknownPeer},
+		{"peer in another room", "bob", signaling.CodeUnknownPeer},
+		{"itself", "alice", signaling.CodeUnknownPeer},
+		{"no recipient", "", signaling.CodeInvalidMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice.send(&signaling.Offer{SDP: "v=0\r\n"}, signaling.Route{To: tt.to})
+			alice.expectError(tt.code)
+		})
+	}
+}
+
+func TestJoinRejected(t *testing.T) {
+	url := newServer(t)
+	alice, impostor := dial(t, url), dial(t, url)
+	alice.join("demo", "alice")
+
+	impostor.send(&signaling.Join{Room: "demo", PeerID: "alice"}, signaling.Route{})
+	impostor.expectError(signaling.CodePeerIDTaken)
+	// The same ID in another room is fine.
+	impostor.join("other", "alice")
+
+	tests := []struct {
+		name string
+		data string
+		code string
+	}{
+		{"already in a room", `{"version":1,"type":"join","room":"demo"}`, signaling.CodeInvalidState},
+		{"invalid room", `{"version":1,"type":"join","room":"../demo"}`, signaling.CodeInvalidMessage},
+		{"invalid peer ID", `{"version":1,"type":"join","room":"demo","peerId":"a b"}`, signaling.CodeInvalidMessage},
+		{"server message", `{"version":1,"type":"peer-left","room":"demo","peerId":"bob"}`, signaling.CodeInvalidMessage},
+		{"malformed message", `{"version":1,"type":"offer"}`, signaling.CodeInvalidMessage},
+		{"unknown type", `{"version":1,"type":"hangup"}`, signaling.CodeUnknownType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alice.sendRaw(tt.data)
+			alice.expectError(tt.code)
+		})
+	}
+}
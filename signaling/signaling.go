@@ -0,0 +1,350 @@
+// Package signaling defines the JSON messages exchanged over the signaling
+// WebSocket between browsers and the Go peers in this repository.
+//
+// Every message is a flat JSON object carrying the protocol version and a
+// type, plus the fields of that type:
+//
+//	{"version":1,"type":"offer","sdp":"v=0..."}
+//	{"version":1,"type":"candidate","candidate":{"candidate":"candidate:...","sdpMid":"0","sdpMLineIndex":0}}
+//
+// Messages relayed by a room-based signaling server (see package
+// signaling/server) also carry routing fields: "to" names the peer a message
+// is for, and the server fills in "from" when delivering it.
+//
+// The package does not depend on pion so that programs built against
+// different pion/webrtc major versions can share it. ICECandidateInit has the
+// same fields as webrtc.ICECandidateInit and converts to it directly.
+package signaling
+
+import "fmt"
+
+// Version is the protocol version written by Encode and required by Decode.
+const Version = 1
+
+// Type identifies the kind of a signaling message.
+type Type string
+
+// Message types understood by the Go peers.
+const (
+	TypeOffer            Type = "offer"
+	TypeAnswer           Type = "answer"
+	TypeCandidate        Type = "candidate"
+	TypeEndOfCandidates  Type = "end-of-candidates"
+	TypeStartRecording   Type = "start-recording"
+	TypeStopRecording    Type = "stop-recording"
+	TypeRecordingStarted Type = "recording-started"
+	TypeRecordingStopped Type = "recording-stopped"
+	TypeResumeUpload     Type = "resume-upload"
+	TypeUploadOffset     Type = "upload-offset"
+	TypeJoin             Type = "join"
+	TypeJoined           Type = "joined"
+	TypePeerJoined       Type = "peer-joined"
+	TypePeerLeft         Type = "peer-left"
+	TypeLeave            Type = "leave"
+	TypeSession          Type = "session"
+	TypeAuth             Type = "auth"
+	TypeBye              Type = "bye"
+	TypeError            Type = "error"
+)
+
+// Message is implemented by every typed signaling message.
+type Message interface {
+	// Type returns the wire type of the message.
+	Type() Type
+	// Validate reports whether the message is well formed.
+	Validate() error
+}
+
+// Route holds the routing fields of a message relayed between peers in a
+// room. Both are empty for messages exchanged directly with a server.
+type Route struct {
+	From string
+	To   string
+}
+
+// ICECandidateInit mirrors RTCIceCandidateInit and webrtc.ICECandidateInit.
+// On the wire it is normally an object, but the bare candidate string sent by
+// older clients is accepted as well.
+type ICECandidateInit struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex"`
+	UsernameFragment *string `json:"usernameFragment"`
+}
+
+// Offer carries an SDP offer.
+type Offer struct {
+	SDP string `json:"sdp"`
+}
+
+// Answer carries an SDP answer.
+type Answer struct {
+	SDP string `json:"sdp"`
+}
+
+// Candidate carries a trickled ICE candidate.
+type Candidate struct {
+	Candidate *ICECandidateInit `json:"candidate"`
+}
+
+// EndOfCandidates signals that no further candidates will be trickled.
+type EndOfCandidates struct{}
+
+// StartRecording asks the receiving peer to start a new take. A take with a
+// RecordingID can be resumed after a reconnect by starting it again.
+type StartRecording struct {
+	RecordingID string `json:"recordingId,omitempty"`
+}
+
+// StopRecording asks the receiving peer to finish the current take.
+type StopRecording struct{}
+
+// RecordingStarted confirms StartRecording. Take numbers count up from 1
+// within a session.
+type RecordingStarted struct {
+	Take        int    `json:"take"`
+	RecordingID string `json:"recordingId,omitempty"`
+	File        string `json:"file"`
+}
+
+// RecordingStopped confirms StopRecording. Duration is the length of the
+// take in seconds.
+type RecordingStopped struct {
+	Take        int     `json:"take"`
+	RecordingID string  `json:"recordingId,omitempty"`
+	File        string  `json:"file"`
+	Duration    float64 `json:"duration"`
+}
+
+// ResumeUpload asks the server how much of a data channel recording it
+// already holds, after the browser reconnects.
+type ResumeUpload struct {
+	RecordingID string `json:"recordingId"`
+}
+
+// UploadOffset answers ResumeUpload with the next chunk sequence number and
+// byte offset to continue from. Complete is set when the server already has
+// the whole recording.
+type UploadOffset struct {
+	RecordingID string `json:"recordingId"`
+	Seq         uint32 `json:"seq"`
+	Offset      uint64 `json:"offset"`
+	Complete    bool   `json:"complete,omitempty"`
+}
+
+// Join asks a signaling server to add the sender to Room. PeerID requests a
+// name for the sender; the server picks one when it is empty.
+type Join struct {
+	Room   string `json:"room"`
+	PeerID string `json:"peerId,omitempty"`
+}
+
+// Joined confirms Join with the sender's peer ID and the other peers
+// already in the room.
+type Joined struct {
+	Room   string   `json:"room"`
+	PeerID string   `json:"peerId"`
+	Peers  []string `json:"peers"`
+}
+
+// PeerJoined tells the peers in a room that another peer has joined.
+type PeerJoined struct {
+	Room   string `json:"room"`
+	PeerID string `json:"peerId"`
+}
+
+// PeerLeft tells the peers in a room that another peer has left.
+type PeerLeft struct {
+	Room   string `json:"room"`
+	PeerID string `json:"peerId"`
+}
+
+// Leave removes the sender from its room without closing the connection.
+type Leave struct{}
+
+// Session tells the browser the ID of its stream engine session. A browser
+// whose WebSocket drops reconnects with this ID and ReconnectToken to pick
+// the session up again; the token is only sent on the WebSocket that opened
+// the session. ICEServers lists servers with credentials minted for this
+// session, such as the server's own TURN relay, for the browser to add to
+// its own.
+type Session struct {
+	ID             string      `json:"sessionId"`
+	ReconnectToken string      `json:"reconnectToken,omitempty"`
+	ICEServers     []ICEServer `json:"iceServers,omitempty"`
+}
+
+// ICEServer is a STUN or TURN server, in the shape of the browser's
+// RTCIceServer.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// Auth presents a token, as the first message on a connection to a server
+// that requires one. Clients that can set headers or the URL may pass the
+// token there instead.
+type Auth struct {
+	Token string `json:"token"`
+}
+
+// Bye tells the other side that the call is over.
+type Bye struct{}
+
+// Error codes sent back to a peer whose message was rejected.
+const (
+	CodeInvalidMessage     = "invalid-message"
+	CodeUnsupportedVersion = "unsupported-version"
+	CodeUnknownType        = "unknown-type"
+	CodeInvalidState       = "invalid-state"
+	CodePeerIDTaken        = "peer-id-taken"
+	CodeUnknownPeer        = "unknown-peer"
+	CodeUnknownSession     = "unknown-session"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeSessionExpired     = "session-expired"
+	CodeQuotaExceeded      = "quota-exceeded"
+	CodeInternal           = "internal-error"
+)
+
+// Error reports a rejected message to the peer that sent it. It is both a
+// Message and an error, so decoding failures can be sent back as they are.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewError returns an Error with a formatted message.
+func NewError(code, format string, v ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, v...)}
+}
+
+func (*Offer) Type() Type            { return TypeOffer }
+func (*Answer) Type() Type           { return TypeAnswer }
+func (*Candidate) Type() Type        { return TypeCandidate }
+func (*EndOfCandidates) Type() Type  { return TypeEndOfCandidates }
+func (*StartRecording) Type() Type   { return TypeStartRecording }
+func (*StopRecording) Type() Type    { return TypeStopRecording }
+func (*RecordingStarted) Type() Type { return TypeRecordingStarted }
+func (*RecordingStopped) Type() Type { return TypeRecordingStopped }
+func (*ResumeUpload) Type() Type     { return TypeResumeUpload }
+func (*UploadOffset) Type() Type     { return TypeUploadOffset }
+func (*Join) Type() Type             { return TypeJoin }
+func (*Joined) Type() Type           { return TypeJoined }
+func (*PeerJoined) Type() Type       { return TypePeerJoined }
+func (*PeerLeft) Type() Type         { return TypePeerLeft }
+func (*Leave) Type() Type            { return TypeLeave }
+func (*Session) Type() Type          { return TypeSession }
+func (*Auth) Type() Type             { return TypeAuth }
+func (*Bye) Type() Type              { return TypeBye }
+func (*Error) Type() Type            { return TypeError }
+
+func (m *Offer) Validate() error {
+	if m.SDP == "" {
+		return NewError(CodeInvalidMessage, "offer is missing sdp")
+	}
+	return nil
+}
+
+func (m *Answer) Validate() error {
+	if m.SDP == "" {
+		return NewError(CodeInvalidMessage, "answer is missing sdp")
+	}
+	return nil
+}
+
+func (m *Candidate) Validate() error {
+	if m.Candidate == nil {
+		return NewError(CodeInvalidMessage, "candidate message is missing candidate")
+	}
+	return nil
+}
+
+func (m *ResumeUpload) Validate() error {
+	if m.RecordingID == "" {
+		return NewError(CodeInvalidMessage, "resume-upload is missing recordingId")
+	}
+	return nil
+}
+
+func (m *UploadOffset) Validate() error {
+	if m.RecordingID == "" {
+		return NewError(CodeInvalidMessage, "upload-offset is missing recordingId")
+	}
+	return nil
+}
+
+func (m *Join) Validate() error {
+	if m.Room == "" {
+		return NewError(CodeInvalidMessage, "join is missing room")
+	}
+	return nil
+}
+
+func (m *Joined) Validate() error {
+	if m.Room == "" || m.PeerID == "" {
+		return NewError(CodeInvalidMessage, "joined is missing room or peerId")
+	}
+	return nil
+}
+
+func (m *PeerJoined) Validate() error {
+	if m.PeerID == "" {
+		return NewError(CodeInvalidMessage, "peer-joined is missing peerId")
+	}
+	return nil
+}
+
+func (m *PeerLeft) Validate() error {
+	if m.PeerID == "" {
+		return NewError(CodeInvalidMessage, "peer-left is missing peerId")
+	}
+	return nil
+}
+
+func (*EndOfCandidates) Validate() error { return nil }
+func (*StartRecording) Validate() error  { return nil }
+func (*StopRecording) Validate() error   { return nil }
+
+func (m *RecordingStarted) Validate() error {
+	if m.File == "" {
+		return NewError(CodeInvalidMessage, "recording-started is missing file")
+	}
+	return nil
+}
+
+func (m *RecordingStopped) Validate() error {
+	if m.File == "" {
+		return NewError(CodeInvalidMessage, "recording-stopped is missing file")
+	}
+	return nil
+}
+
+func (m *Session) Validate() error {
+	if m.ID == "" {
+		return NewError(CodeInvalidMessage, "session is missing sessionId")
+	}
+	return nil
+}
+
+func (m *Auth) Validate() error {
+	if m.Token == "" {
+		return NewError(CodeInvalidMessage, "auth is missing token")
+	}
+	return nil
+}
+
+func (*Leave) Validate() error { return nil }
+func (*Bye) Validate() error   { return nil }
+
+func (m *Error) Validate() error {
+	if m.Code == "" {
+		return NewError(CodeInvalidMessage, "error message is missing code")
+	}
+	return nil
+}
+
+func (m *Error) Error() string {
+	return fmt.Sprintf("signaling: %s: %s", m.Code, m.Message)
+}
@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted files start with a header holding a data key of their own,
+// wrapped with the master key, followed by the file in records of at most
+// recordSize bytes, each sealed with AES-256-GCM under the data key:
+//
+//	header: "WRTCENC" | version 1 | nonce (12 bytes) | wrapped data key (48 bytes)
+//	record: length of the sealed data (4 bytes, big-endian) | nonce (12 bytes) | sealed data
+//
+// Every record is authenticated together with its index and whether it is
+// the last one, which is empty, so records cannot be reordered or dropped
+// and a file that was cut short is told apart from a complete one.
+const (
+	encryptMagic      = "WRTCENC\x01"
+	nonceSize         = 12
+	encryptHeaderSize = len(encryptMagic) + nonceSize + KeySize + 16
+	recordSize        = 64 << 10
+)
+
+// KeySize is the size of master keys: AES-256.
+const KeySize = 32
+
+// ErrTruncated is returned by Decrypt for a file that ends before its last
+// record, as files do that were being written when the server stopped.
+var ErrTruncated = errors.New("encrypted file is truncated")
+
+// MasterKey encrypts files with envelope encryption: each file is encrypted
+// with a random data key, which is stored in the file wrapped with the
+// master key. Only the master key needs to be kept secret.
+type MasterKey struct {
+	aead cipher.AEAD
+}
+
+// NewMasterKey returns the master key key, which must be KeySize bytes.
+func NewMasterKey(key []byte) (*MasterKey, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &MasterKey{aead: aead}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, not %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewWriter starts an encrypted file in w with a new data key, writing its
+// header.
+func (k *MasterKey) NewWriter(w io.Writer) (*EncryptWriter, error) {
+	dataKey := make([]byte, KeySize)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(encryptMagic), nonce...)
+	header = k.aead.Seal(header, nonce, dataKey, []byte(encryptMagic))
+	data, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ew := &EncryptWriter{w: w, data: data, state: EncryptState{Header: header}}
+	if err := ew.write(header); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+// ResumeWriter continues the encrypted file in w from the state an
+// EncryptWriter had when everything up to it was written.
+func (k *MasterKey) ResumeWriter(w io.Writer, state EncryptState) (*EncryptWriter, error) {
+	data, err := k.unwrap(state.Header)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptWriter{w: w, data: data, state: state}, nil
+}
+
+// unwrap returns the cipher of the data key in header.
+func (k *MasterKey) unwrap(header []byte) (cipher.AEAD, error) {
+	if len(header) != encryptHeaderSize || string(header[:len(encryptMagic)]) != encryptMagic {
+		return nil, errors.New("not an encrypted file")
+	}
+	nonce := header[len(encryptMagic) : len(encryptMagic)+nonceSize]
+	dataKey, err := k.aead.Open(nil, nonce, header[len(encryptMagic)+nonceSize:], []byte(encryptMagic))
+	if err != nil {
+		return nil, errors.New("the file's data key cannot be unwrapped: wrong master key or damaged file")
+	}
+	return newGCM(dataKey)
+}
+
+// Decrypt writes the contents of the encrypted file read from r to w. What
+// comes before a damaged record or the end of a truncated file is written
+// before the error is returned.
+func (k *MasterKey) Decrypt(w io.Writer, r io.Reader) error {
+	header := make([]byte, encryptHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errors.New("not an encrypted file")
+		}
+		return err
+	}
+	data, err := k.unwrap(header)
+	if err != nil {
+		return err
+	}
+
+	var length [4]byte
+	for index := uint64(0); ; index++ {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return ErrTruncated
+			}
+			return err
+		}
+		n := int(binary.BigEndian.Uint32(length[:]))
+		if n < data.Overhead() || n > recordSize+data.Overhead() {
+			return fmt.Errorf("record %d of the encrypted file is damaged", index)
+		}
+
+		record := make([]byte, nonceSize+n)
+		if _, err := io.ReadFull(r, record); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return ErrTruncated
+			}
+			return err
+		}
+		// Only the last record is empty.
+		last := n == data.Overhead()
+		plain, err := data.Open(nil, record[:nonceSize], record[nonceSize:], recordData(index, last))
+		if err != nil {
+			return fmt.Errorf("record %d of the encrypted file is damaged", index)
+		}
+
+		if last {
+			if _, err := io.ReadFull(r, length[:1]); err != io.EOF {
+				return errors.New("encrypted file continues after its last record")
+			}
+			return nil
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+	}
+}
+
+// recordData is the additional data a record is authenticated with.
+func recordData(index uint64, last bool) []byte {
+	data := make([]byte, 9)
+	binary.BigEndian.PutUint64(data, index)
+	if last {
+		data[8] = 1
+	}
+	return data
+}
+
+// EncryptState is where an EncryptWriter is in its file, for ResumeWriter.
+// It holds the data key only wrapped, so it can be stored with the file.
+type EncryptState struct {
+	// Header is the file's header, with the wrapped data key.
+	Header []byte `json:"header"`
+	// Records is the number of records written.
+	Records uint64 `json:"records"`
+	// Size is the number of bytes written to the file.
+	Size int64 `json:"size"`
+}
+
+// EncryptWriter encrypts what is written to it into an underlying writer,
+// a record at a time.
+type EncryptWriter struct {
+	w      io.Writer
+	data   cipher.AEAD
+	state  EncryptState
+	buffer []byte
+	closed bool
+	err    error
+}
+
+// Write encrypts p, writing every record it fills.
+func (w *EncryptWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	n := 0
+	for n < len(p) {
+		free := recordSize - len(w.buffer)
+		if free > len(p)-n {
+			free = len(p) - n
+		}
+		w.buffer = append(w.buffer, p[n:n+free]...)
+		n += free
+
+		if len(w.buffer) == recordSize {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes what is buffered as a record of its own, so that everything
+// written so far is in the underlying writer.
+func (w *EncryptWriter) Flush() error {
+	if len(w.buffer) == 0 {
+		return w.err
+	}
+	return w.seal(false)
+}
+
+// State returns the state to resume from once everything written so far
+// has been flushed.
+func (w *EncryptWriter) State() EncryptState {
+	return w.state
+}
+
+// Close writes what is buffered and the last record. It does not close the
+// underlying writer.
+func (w *EncryptWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := w.seal(true); err != nil {
+		return err
+	}
+	w.closed = true
+	return nil
+}
+
+// seal writes the buffer as the next record.
+func (w *EncryptWriter) seal(last bool) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	record := make([]byte, 4, 4+nonceSize+len(w.buffer)+w.data.Overhead())
+	binary.BigEndian.PutUint32(record, uint32(len(w.buffer)+w.data.Overhead()))
+	record = append(record, nonce...)
+	record = w.data.Seal(record, nonce, w.buffer, recordData(w.state.Records, last))
+
+	if err := w.write(record); err != nil {
+		w.err = err
+		return err
+	}
+	w.state.Records++
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+func (w *EncryptWriter) write(p []byte) error {
+	n, err := w.w.Write(p)
+	w.state.Size += int64(n)
+	return err
+}
+
+// Encrypted encrypts every file written to Sink with Key.
+type Encrypted struct {
+	Sink Sink
+	Key  *MasterKey
+}
+
+// NewEncrypted returns a sink encrypting the files it writes to sink.
+func NewEncrypted(sink Sink, key *MasterKey) *Encrypted {
+	return &Encrypted{Sink: sink, Key: key}
+}
+
+func (e *Encrypted) String() string {
+	return e.Sink.String() + ", encrypted"
+}
+
+func (e *Encrypted) Create(name string) (Writer, error) {
+	w, err := e.Sink.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	ew, err := e.Key.NewWriter(w)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return &encryptedWriter{EncryptWriter: ew, file: w}, nil
+}
+
+// encryptedWriter is a file being written to an Encrypted sink.
+type encryptedWriter struct {
+	*EncryptWriter
+	file Writer
+}
+
+func (w *encryptedWriter) Close() error {
+	if err := w.EncryptWriter.Close(); err != nil {
+		w.file.Abort()
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *encryptedWriter) Abort() error {
+	return w.file.Abort()
+}
@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestKey(t *testing.T) *MasterKey {
+	t.Helper()
+	raw := make([]byte, KeySize)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewMasterKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// encrypt returns data encrypted with key, written in pieces of the given
+// size.
+func encrypt(t *testing.T, key *MasterKey, data []byte, piece int) []byte {
+	t.Helper()
+	var file bytes.Buffer
+	w, err := key.NewWriter(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), piece)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file.Bytes()
+}
+
+// splitRecords splits an encrypted file into its header and its records,
+// each with its length prefix.
+func splitRecords(t *testing.T, file []byte) ([]byte, [][]byte) {
+	t.Helper()
+	header, rest := file[:encryptHeaderSize], file[encryptHeaderSize:]
+	var records [][]byte
+	for len(rest) > 0 {
+		n := 4 + nonceSize + int(binary.BigEndian.Uint32(rest))
+		records = append(records, rest[:n])
+		rest = rest[n:]
+	}
+	return header, records
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := newTestKey(t)
+	tests := []struct {
+		name  string
+		size  int
+		piece int
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"just under a record", recordSize - 1, 1000},
+		{"one record", recordSize, recordSize},
+		{"just over a record", recordSize + 1, 7777},
+		{"several records", 3*recordSize + 17, recordSize + 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testData(tt.size)
+			file := encrypt(t, key, data, tt.piece)
+
+			var plain bytes.Buffer
+			if err := key.Decrypt(&plain, bytes.NewReader(file)); err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if !bytes.Equal(plain.Bytes(), data) {
+				t.Errorf("decrypted %d bytes differ from the %d written", plain.Len(), len(data))
+			}
+		})
+	}
+}
+
+func TestEncryptResume(t *testing.T) {
+	key := newTestKey(t)
+	data := testData(2*recordSize + 100)
+
+	var file bytes.Buffer
+	w, err := key.NewWriter(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[:recordSize+50]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	state := w.State()
+	if state.Size != int64(file.Len()) || state.Records != 2 {
+		t.Fatalf("state says %d bytes in %d records, the file has %d bytes", state.Size, state.Records, file.Len())
+	}
+
+	// Anything written after the state was taken is lost with the
+	// connection.
+	w.Write(data[recordSize+50:])
+	w.Flush()
+	file.Truncate(int(state.Size))
+
+	w, err = key.ResumeWriter(&file, state)
+	if err != nil {
+		t.Fatalf("ResumeWriter: %v", err)
+	}
+	if _, err := w.Write(data[recordSize+50:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var plain bytes.Buffer
+	if err := key.Decrypt(&plain, &file); err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if !bytes.Equal(plain.Bytes(), data) {
+		t.Error("resumed file differs from what was written")
+	}
+}
+
+func TestDecryptDamaged(t *testing.T) {
+	key := newTestKey(t)
+	data := testData(3 * recordSize)
+	file := encrypt(t, key, data, recordSize)
+	header, records := splitRecords(t, file)
+	if len(records) != 4 {
+		t.Fatalf("file has %d records, want 3 and the last", len(records))
+	}
+	dataKey, err := key.unwrap(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reseal seals plain as a record authenticated with index and last.
+	reseal := func(plain []byte, index uint64, last bool) []byte {
+		nonce := make([]byte, nonceSize)
+		record := binary.BigEndian.AppendUint32(nil, uint32(len(plain)+dataKey.Overhead()))
+		record = append(record, nonce...)
+		return dataKey.Seal(record, nonce, plain, recordData(index, last))
+	}
+	flipped := append([]byte(nil), records[1]...)
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		file    []byte
+		wantErr error
+		errText string
+		// plain is how many records are decrypted before the error.
+		plain int
+	}{
+		{
+			name:    "last record missing",
+			file:    join(header, records[0], records[1], records[2]),
+			wantErr: ErrTruncated,
+			plain:   3,
+		},
+		{
+			name:    "cut inside a record",
+			file:    join(header, records[0], records[1][:100]),
+			wantErr: ErrTruncated,
+			plain:   1,
+		},
+		{
+			name:    "records reordered",
+			file:    join(header, records[1], records[0], records[2], records[3]),
+			errText: "record 0 of the encrypted file is damaged",
+		},
+		{
+			name:    "record dropped",
+			file:    join(header, records[0], records[2], records[3]),
+			errText: "record 1 of the encrypted file is damaged",
+			plain:   1,
+		},
+		{
+			name:    "ciphertext changed",
+			file:    join(header, records[0], flipped, records[2], records[3]),
+			errText: "record 1 of the encrypted file is damaged",
+			plain:   1,
+		},
+		{
+			name:    "sealed with the wrong index",
+			file:    join(header, records[0], reseal(data[recordSize:2*recordSize], 5, false), records[2], records[3]),
+			errText: "record 1 of the encrypted file is damaged",
+			plain:   1,
+		},
+		{
+			name:    "cut short behind a forged last record",
+			file:    join(header, records[0], reseal(nil, 1, false)),
+			errText: "record 1 of the encrypted file is damaged",
+			plain:   1,
+		},
+		{
+			name:    "data after the last record",
+			file:    join(file, records[0]),
+			errText: "encrypted file continues after its last record",
+			plain:   3,
+		},
+		{
+			name:    "not encrypted",
+			file:    []byte("plain webm"),
+			errText: "not an encrypted file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var plain bytes.Buffer
+			err := key.Decrypt(&plain, bytes.NewReader(tt.file))
+			switch {
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("Decrypt error = %v, want %v", err, tt.wantErr)
+			case tt.errText != "" && (err == nil || err.Error() != tt.errText):
+				t.Errorf("Decrypt error = %v, want %q", err, tt.errText)
+			}
+			if want := data[:tt.plain*recordSize]; !bytes.Equal(plain.Bytes(), want) {
+				t.Errorf("decrypted %d bytes before the error, want %d", plain.Len(), len(want))
+			}
+		})
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	file := encrypt(t, newTestKey(t), []byte("recording"), 100)
+	var plain bytes.Buffer
+	err := newTestKey(t).Decrypt(&plain, bytes.NewReader(file))
+	if err == nil || !strings.Contains(err.Error(), "wrong master key") {
+		t.Errorf("Decrypt error = %v, want the data key not to unwrap", err)
+	}
+	if plain.Len() != 0 {
+		t.Errorf("decrypted %d bytes with the wrong key", plain.Len())
+	}
+}
+
+func TestNewMasterKeySize(t *testing.T) {
+	for _, size := range []int{0, 16, 31, 33} {
+		if _, err := NewMasterKey(make([]byte, size)); err == nil {
+			t.Errorf("NewMasterKey accepted a %d byte key", size)
+		}
+	}
+}
+
+func TestEncryptedSink(t *testing.T) {
+	dir := t.TempDir()
+	key := newTestKey(t)
+	sink := NewEncrypted(NewLocal(dir), key)
+	data := testData(recordSize + 10)
+
+	w, err := sink.Create("a/take.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.ReadFile(filepath.Join(dir, "a", "take.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(file, data[:100]) {
+		t.Error("the stored file holds the recording in plain text")
+	}
+	var plain bytes.Buffer
+	if err := key.Decrypt(&plain, bytes.NewReader(file)); err != nil || !bytes.Equal(plain.Bytes(), data) {
+		t.Errorf("stored file does not decrypt to what was written: %v", err)
+	}
+
+	w, err = sink.Create("aborted.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "aborted.webm")); !os.IsNotExist(err) {
+		t.Errorf("aborted file left behind: %v", err)
+	}
+}
@@ -0,0 +1,561 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MinPartSize is the smallest part S3 accepts in a multipart upload, other
+// than the last.
+const MinPartSize = 5 << 20
+
+// s3Attempts is how often a request is tried before a write fails.
+const s3Attempts = 3
+
+// s3RetryDelay is how long the first retry of a request waits; every
+// further retry waits as long again.
+var s3RetryDelay = time.Second
+
+// S3Config describes a bucket of an S3-compatible object store, such as
+// Amazon S3, MinIO or Cloudflare R2.
+type S3Config struct {
+	// Endpoint is the base URL of the store, such as
+	// "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000".
+	Endpoint string
+	// Region signs requests. Most stores other than Amazon S3 accept
+	// "us-east-1".
+	Region string
+	Bucket string
+	// Prefix is put in front of every file name, as in "recordings/".
+	Prefix string
+	// AccessKeyID and SecretAccessKey are the credentials requests are
+	// signed with; SessionToken is only needed for temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PathStyle puts the bucket in the URL path instead of the host name,
+	// as MinIO and most self-hosted stores need.
+	PathStyle bool
+	// PartSize is how much is buffered before it is uploaded as a part. It
+	// defaults to MinPartSize.
+	PartSize int
+	// Client sends the requests. It defaults to a client with a timeout of a
+	// few minutes per request.
+	Client *http.Client
+}
+
+// S3 stores files as objects in an S3 bucket, each written with a multipart
+// upload. Requests are signed with AWS Signature Version 4.
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns a sink writing to the bucket described by config.
+func NewS3(config S3Config) (*S3, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" || config.Region == "" {
+		return nil, errors.New("S3 needs a bucket and region")
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("S3 needs an access key ID and secret access key")
+	}
+	if config.PartSize == 0 {
+		config.PartSize = MinPartSize
+	}
+	if config.PartSize < MinPartSize {
+		return nil, fmt.Errorf("S3 part size must be at least %d bytes", MinPartSize)
+	}
+
+	s := &S3{config: config, endpoint: endpoint, client: config.Client}
+	if s.client == nil {
+		s.client = &http.Client{Timeout: 5 * time.Minute}
+	}
+	return s, nil
+}
+
+func (s *S3) String() string {
+	return "s3://" + s.config.Bucket + "/" + s.key("")
+}
+
+// key returns the object key of the file name.
+func (s *S3) key(name string) string {
+	prefix := strings.Trim(s.config.Prefix, "/")
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+func (s *S3) Create(name string) (Writer, error) {
+	clean, err := CleanName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &s3Writer{
+		sink:  s,
+		key:   s.key(clean),
+		parts: make(chan s3Part, 1),
+		done:  make(chan struct{}),
+	}
+	if w.uploadID, err = s.startUpload(w.key); err != nil {
+		return nil, err
+	}
+
+	go w.upload()
+	return w, nil
+}
+
+// startUpload starts a multipart upload of key and returns its ID.
+func (s *S3) startUpload(key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if _, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, &result); err != nil {
+		return "", fmt.Errorf("starting upload of %s: %w", key, err)
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("starting upload of %s: no upload ID in the response", key)
+	}
+	return result.UploadID, nil
+}
+
+// completeUpload makes the object key out of parts.
+func (s *S3) completeUpload(key, uploadID string, parts []s3CompletedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	if _, err := s.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, nil); err != nil {
+		return fmt.Errorf("completing upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// abortUpload discards the upload and its parts.
+func (s *S3) abortUpload(key, uploadID string) error {
+	if _, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); err != nil {
+		return fmt.Errorf("aborting upload of %s: %w", key, err)
+	}
+	return nil
+}
+
+// listParts returns the parts uploaded so far and their total size.
+func (s *S3) listParts(key, uploadID string) ([]s3CompletedPart, int64, error) {
+	var parts []s3CompletedPart
+	var size int64
+	query := url.Values{"uploadId": {uploadID}}
+	for {
+		var result struct {
+			Parts []struct {
+				s3CompletedPart
+				Size int64 `xml:"Size"`
+			} `xml:"Part"`
+			IsTruncated          bool   `xml:"IsTruncated"`
+			NextPartNumberMarker string `xml:"NextPartNumberMarker"`
+		}
+		if _, err := s.do(http.MethodGet, key, query, nil, &result); err != nil {
+			return nil, 0, fmt.Errorf("listing parts of %s: %w", key, err)
+		}
+		for _, part := range result.Parts {
+			parts = append(parts, part.s3CompletedPart)
+			size += part.Size
+		}
+		if !result.IsTruncated {
+			return parts, size, nil
+		}
+		query.Set("part-number-marker", result.NextPartNumberMarker)
+	}
+}
+
+// IncompleteUpload is an object whose multipart upload was started but
+// never completed or aborted, as when the server writing it crashed.
+type IncompleteUpload struct {
+	Name      string
+	UploadID  string
+	Initiated time.Time
+}
+
+// IncompleteUploads lists the incomplete uploads under the sink's prefix.
+func (s *S3) IncompleteUploads() ([]IncompleteUpload, error) {
+	var uploads []IncompleteUpload
+	query := url.Values{"uploads": {""}, "prefix": {s.key("")}}
+	for {
+		var result struct {
+			Uploads []struct {
+				Key       string    `xml:"Key"`
+				UploadID  string    `xml:"UploadId"`
+				Initiated time.Time `xml:"Initiated"`
+			} `xml:"Upload"`
+			IsTruncated        bool   `xml:"IsTruncated"`
+			NextKeyMarker      string `xml:"NextKeyMarker"`
+			NextUploadIDMarker string `xml:"NextUploadIdMarker"`
+		}
+		if _, err := s.do(http.MethodGet, "", query, nil, &result); err != nil {
+			return nil, fmt.Errorf("listing uploads: %w", err)
+		}
+		for _, upload := range result.Uploads {
+			uploads = append(uploads, IncompleteUpload{
+				Name:      strings.TrimPrefix(upload.Key, s.key("")),
+				UploadID:  upload.UploadID,
+				Initiated: upload.Initiated,
+			})
+		}
+		if !result.IsTruncated {
+			return uploads, nil
+		}
+		query.Set("key-marker", result.NextKeyMarker)
+		query.Set("upload-id-marker", result.NextUploadIDMarker)
+	}
+}
+
+// Recover completes an incomplete upload with the parts uploaded so far and
+// returns the size of the object. An upload without parts is aborted, and
+// its size is -1.
+func (s *S3) Recover(upload IncompleteUpload) (int64, error) {
+	key := s.key(upload.Name)
+	parts, size, err := s.listParts(key, upload.UploadID)
+	if err != nil {
+		return 0, err
+	}
+	if len(parts) == 0 {
+		return -1, s.abortUpload(key, upload.UploadID)
+	}
+	return size, s.completeUpload(key, upload.UploadID, parts)
+}
+
+// s3Part is a part of a multipart upload waiting to be sent.
+type s3Part struct {
+	number int
+	data   []byte
+}
+
+// s3CompletedPart is an uploaded part, as listed in the request completing
+// the upload.
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3Writer buffers what is written to it and uploads it a part at a time in
+// the background, so that writers are only held up when uploading falls
+// behind by more than a part.
+type s3Writer struct {
+	sink     *S3
+	key      string
+	uploadID string
+
+	buffer []byte
+	number int
+	closed bool
+	parts  chan s3Part
+	done   chan struct{}
+
+	// mutex guards the results of the upload goroutine.
+	mutex     sync.Mutex
+	err       error
+	completed []s3CompletedPart
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed S3 writer")
+	}
+	if err := w.failed(); err != nil {
+		return 0, err
+	}
+
+	w.buffer = append(w.buffer, p...)
+	for len(w.buffer) >= w.sink.config.PartSize {
+		w.send(w.buffer[:w.sink.config.PartSize])
+		w.buffer = append([]byte(nil), w.buffer[w.sink.config.PartSize:]...)
+	}
+	return len(p), nil
+}
+
+// send queues data as the next part.
+func (w *s3Writer) send(data []byte) {
+	w.number++
+	w.parts <- s3Part{number: w.number, data: data}
+}
+
+func (w *s3Writer) failed() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.err
+}
+
+// upload sends the queued parts in order until the writer is closed.
+func (w *s3Writer) upload() {
+	defer close(w.done)
+
+	for part := range w.parts {
+		if w.failed() != nil {
+			continue
+		}
+
+		query := url.Values{
+			"partNumber": {strconv.Itoa(part.number)},
+			"uploadId":   {w.uploadID},
+		}
+		header, err := w.sink.do(http.MethodPut, w.key, query, part.data, nil)
+
+		w.mutex.Lock()
+		if err != nil {
+			w.err = fmt.Errorf("uploading part %d of %s: %w", part.number, w.key, err)
+		} else {
+			w.completed = append(w.completed, s3CompletedPart{PartNumber: part.number, ETag: header.Get("ETag")})
+		}
+		w.mutex.Unlock()
+	}
+}
+
+// finish uploads what is left in the buffer and waits for every part.
+func (w *s3Writer) finish() error {
+	if w.closed {
+		return errors.New("S3 writer already closed")
+	}
+	w.closed = true
+
+	// An upload needs at least one part, even if it is empty.
+	if len(w.buffer) > 0 || w.number == 0 {
+		w.send(w.buffer)
+		w.buffer = nil
+	}
+	close(w.parts)
+	<-w.done
+	return w.failed()
+}
+
+// Close completes the upload, making the object visible. If any part failed
+// the upload is aborted instead.
+func (w *s3Writer) Close() error {
+	if err := w.finish(); err != nil {
+		w.abort()
+		return err
+	}
+
+	return w.sink.completeUpload(w.key, w.uploadID, w.completed)
+}
+
+func (w *s3Writer) Abort() error {
+	w.finish()
+	return w.abort()
+}
+
+func (w *s3Writer) abort() error {
+	return w.sink.abortUpload(w.key, w.uploadID)
+}
+
+// s3Error is the error document S3 responds with.
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// do sends a signed request for key, retrying server errors and network
+// failures, and decodes the XML response into result if it is not nil.
+func (s *S3) do(method, key string, query url.Values, body []byte, result interface{}) (http.Header, error) {
+	var err error
+	for attempt := 0; attempt < s3Attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * s3RetryDelay)
+		}
+
+		var header http.Header
+		var retry bool
+		header, retry, err = s.try(method, key, query, body, result)
+		if err == nil || !retry {
+			return header, err
+		}
+	}
+	return nil, err
+}
+
+func (s *S3) try(method, key string, query url.Values, body []byte, result interface{}) (http.Header, bool, error) {
+	req, err := s.newRequest(method, key, query, body)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var s3Err s3Error
+		if xml.Unmarshal(data, &s3Err) != nil || s3Err.Code == "" {
+			return nil, resp.StatusCode >= 500, fmt.Errorf("%s %s: %s", method, key, resp.Status)
+		}
+		return nil, resp.StatusCode >= 500, &s3Err
+	}
+
+	// Completing an upload can fail after the response has started, with an
+	// error document in a 200 response.
+	var s3Err s3Error
+	if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+		return nil, s3Err.Code == "InternalError" || s3Err.Code == "SlowDown", &s3Err
+	}
+	if result != nil {
+		if err := xml.Unmarshal(data, result); err != nil {
+			return nil, false, fmt.Errorf("%s %s: %w", method, key, err)
+		}
+	}
+	return resp.Header, false, nil
+}
+
+// newRequest builds a signed request for key in the bucket.
+func (s *S3) newRequest(method, key string, query url.Values, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	objectPath := "/" + key
+	if s.config.PathStyle {
+		objectPath = "/" + s.config.Bucket + objectPath
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = strings.TrimSuffix(s.endpoint.EscapedPath(), "/") + uriEncode(objectPath, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodPost && len(body) > 0 {
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	s.sign(req, body, time.Now())
+	return req, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to req, signing the host,
+// the x-amz-* headers and the body.
+func (s *S3) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name := strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretAccessKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.config.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes query sorted by name, as Signature Version 4
+// requires. Unlike url.Values.Encode it escapes spaces as %20 and keeps the
+// "=" of empty values.
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode percent-encodes everything but the unreserved characters of RFC
+// 3986, and "/" unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
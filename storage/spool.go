@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// spoolHeaderSize is the size of the spool file's header: the offset in the
+// object of the first byte spooled, so that a part that was uploaded just
+// before a crash is not uploaded again.
+const spoolHeaderSize = 8
+
+// maxQueuedParts is how many parts Flush queues for upload before it waits
+// for one to be uploaded. Together with the part being uploaded and the one
+// being written, it bounds the spool file to a few parts.
+const maxQueuedParts = 2
+
+// Spooled is an object written to S3 through a spool file on local disk,
+// which holds what has not been uploaded as a part yet. Unlike the writers
+// of Create, it can be continued after a restart with ResumeSpooled, since
+// everything written to it is either in the bucket or in the spool.
+//
+// Write only appends to the spool. Flush hands every whole part in it to a
+// goroutine that uploads them in the background, so that writers are only
+// held up when uploading falls behind by more than maxQueuedParts parts.
+// Write, Flush, Close, Complete and Abort must not be called concurrently.
+type Spooled struct {
+	sink     *S3
+	key      string
+	uploadID string
+
+	spoolPath string
+	queue     chan struct{}
+	done      chan struct{}
+	stopped   bool
+	// onUpload is called with the size of every part uploaded in the
+	// background, once the spool no longer holds it.
+	onUpload func(n int64)
+
+	// mutex guards everything below, which the upload goroutine changes.
+	// It is not held while a part is being sent.
+	mutex sync.Mutex
+	spool *os.File
+	// start is the offset of the spool's first byte in the object, and
+	// spooled how many bytes follow it, queued how many of them are queued
+	// for upload.
+	start   int64
+	spooled int64
+	queued  int64
+	parts   []s3CompletedPart
+	// err is the first error of the upload goroutine, and discard set once
+	// it should drop what is queued.
+	err     error
+	discard bool
+}
+
+// CreateSpooled starts the object name, spooling to the file spoolPath.
+func (s *S3) CreateSpooled(name, spoolPath string) (*Spooled, error) {
+	clean, err := CleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	sp := &Spooled{sink: s, key: s.key(clean), spoolPath: spoolPath}
+	if sp.uploadID, err = s.startUpload(sp.key); err != nil {
+		return nil, err
+	}
+
+	if sp.spool, err = os.Create(spoolPath); err == nil {
+		if err = writeSpoolHeader(sp.spool, 0); err != nil {
+			sp.spool.Close()
+		}
+	}
+	if err != nil {
+		s.abortUpload(sp.key, sp.uploadID)
+		return nil, err
+	}
+	sp.startUploading()
+	return sp, nil
+}
+
+// ResumeSpooled continues the upload uploadID of the object name, whose
+// first size bytes were written before. Any parts in the bucket are kept,
+// and the rest is taken from the spool file.
+func (s *S3) ResumeSpooled(name, uploadID, spoolPath string, size int64) (*Spooled, error) {
+	clean, err := CleanName(name)
+	if err != nil {
+		return nil, err
+	}
+	sp := &Spooled{sink: s, key: s.key(clean), uploadID: uploadID, spoolPath: spoolPath}
+
+	var uploaded int64
+	sp.parts, uploaded, err = s.listParts(sp.key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if uploaded > size {
+		return nil, fmt.Errorf("%s has %d bytes uploaded, more than the %d written", sp.key, uploaded, size)
+	}
+
+	if sp.spool, err = os.OpenFile(spoolPath, os.O_RDWR, 0); err != nil {
+		return nil, err
+	}
+	if err := sp.readHeader(); err != nil {
+		sp.spool.Close()
+		return nil, err
+	}
+
+	// A part can have been uploaded without the spool being cut down.
+	if uploaded < sp.start || uploaded > sp.start+sp.spooled || sp.start+sp.spooled < size {
+		sp.spool.Close()
+		return nil, fmt.Errorf("spool file %s does not continue the %d bytes of %s in the bucket", spoolPath, uploaded, sp.key)
+	}
+	if err := sp.spool.Truncate(spoolHeaderSize + size - sp.start); err != nil {
+		sp.spool.Close()
+		return nil, err
+	}
+	sp.spooled = size - sp.start
+	if err := sp.cut(uploaded - sp.start); err != nil {
+		sp.spool.Close()
+		return nil, err
+	}
+	sp.startUploading()
+	return sp, nil
+}
+
+// UploadID identifies the upload for ResumeSpooled.
+func (sp *Spooled) UploadID() string {
+	return sp.uploadID
+}
+
+// OnUpload sets a function called with the size of every part Flush gets
+// uploaded, once it has been cut from the spool file. It is called from the
+// goroutine uploading the parts.
+func (sp *Spooled) OnUpload(f func(n int64)) {
+	sp.onUpload = f
+}
+
+// Write appends p to the spool.
+func (sp *Spooled) Write(p []byte) (int, error) {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	if sp.spool == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := sp.spool.WriteAt(p, spoolHeaderSize+sp.spooled)
+	sp.spooled += int64(n)
+	return n, err
+}
+
+// Flush queues every whole part in the spool for upload, waiting if the
+// queue is full. It returns the error of any earlier part that failed.
+func (sp *Spooled) Flush() error {
+	if sp.stopped {
+		return os.ErrClosed
+	}
+
+	partSize := int64(sp.sink.config.PartSize)
+	for {
+		sp.mutex.Lock()
+		err := sp.err
+		ready := err == nil && sp.spooled-sp.queued >= partSize
+		if ready {
+			sp.queued += partSize
+		}
+		sp.mutex.Unlock()
+
+		if !ready {
+			return err
+		}
+		sp.queue <- struct{}{}
+	}
+}
+
+// Close waits for the part being uploaded, drops those still queued and
+// closes the spool file, leaving the upload to be continued with
+// ResumeSpooled or finished with Complete.
+func (sp *Spooled) Close() error {
+	sp.stopUploading(true)
+
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+
+	if sp.spool == nil {
+		return nil
+	}
+	err := sp.spool.Close()
+	sp.spool = nil
+	return err
+}
+
+// Complete waits for the queued parts, uploads what is left in the spool,
+// completes the object and removes the spool file.
+func (sp *Spooled) Complete() error {
+	sp.stopUploading(false)
+
+	sp.mutex.Lock()
+	closed, err := sp.spool == nil, sp.err
+	sp.mutex.Unlock()
+	if closed {
+		return os.ErrClosed
+	}
+	if err != nil {
+		return err
+	}
+
+	if sp.spooled > 0 || len(sp.parts) == 0 {
+		data, err := sp.readPart(sp.spooled)
+		if err != nil {
+			return err
+		}
+		part, err := sp.uploadPart(len(sp.parts)+1, data)
+		if err != nil {
+			return err
+		}
+		sp.parts = append(sp.parts, part)
+	}
+	if err := sp.sink.completeUpload(sp.key, sp.uploadID, sp.parts); err != nil {
+		return err
+	}
+
+	sp.Close()
+	return os.Remove(sp.spoolPath)
+}
+
+// Abort discards the upload and the spool.
+func (sp *Spooled) Abort() error {
+	sp.Close()
+	os.Remove(sp.spoolPath)
+	return sp.sink.abortUpload(sp.key, sp.uploadID)
+}
+
+// startUploading starts the goroutine uploading the parts Flush queues.
+func (sp *Spooled) startUploading() {
+	sp.queue = make(chan struct{}, maxQueuedParts)
+	sp.done = make(chan struct{})
+	go sp.upload()
+}
+
+// stopUploading waits for the upload goroutine to finish, after uploading
+// the queued parts unless discard is set.
+func (sp *Spooled) stopUploading(discard bool) {
+	if sp.stopped {
+		return
+	}
+	sp.stopped = true
+
+	sp.mutex.Lock()
+	sp.discard = discard
+	sp.mutex.Unlock()
+
+	close(sp.queue)
+	<-sp.done
+}
+
+// upload uploads a part from the front of the spool for every part queued,
+// and cuts it from the spool once it is in the bucket. After an error it
+// only drains the queue.
+func (sp *Spooled) upload() {
+	defer close(sp.done)
+
+	partSize := int64(sp.sink.config.PartSize)
+	for range sp.queue {
+		sp.mutex.Lock()
+		skip := sp.err != nil || sp.discard
+		var data []byte
+		var err error
+		if !skip {
+			data, err = sp.readPart(partSize)
+		}
+		number := len(sp.parts) + 1
+		sp.mutex.Unlock()
+
+		var part s3CompletedPart
+		if !skip && err == nil {
+			part, err = sp.uploadPart(number, data)
+		}
+
+		sp.mutex.Lock()
+		sp.queued -= partSize
+		if !skip && err == nil {
+			sp.parts = append(sp.parts, part)
+			err = sp.cut(partSize)
+		}
+		if err != nil && sp.err == nil {
+			sp.err = err
+		}
+		sp.mutex.Unlock()
+
+		if !skip && err == nil && sp.onUpload != nil {
+			sp.onUpload(partSize)
+		}
+	}
+}
+
+// readPart reads the first n spooled bytes. The caller must hold sp.mutex
+// or own sp exclusively.
+func (sp *Spooled) readPart(n int64) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := sp.spool.ReadAt(data, spoolHeaderSize); err != nil && !(errors.Is(err, io.EOF) && n == 0) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// uploadPart uploads data as the part number.
+func (sp *Spooled) uploadPart(number int, data []byte) (s3CompletedPart, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {sp.uploadID}}
+	header, err := sp.sink.do(http.MethodPut, sp.key, query, data, nil)
+	if err != nil {
+		return s3CompletedPart{}, fmt.Errorf("uploading part %d of %s: %w", number, sp.key, err)
+	}
+	return s3CompletedPart{PartNumber: number, ETag: header.Get("ETag")}, nil
+}
+
+// cut drops the first n spooled bytes, which have been uploaded. The new
+// spool replaces the old one in a single rename, and the offsets only
+// change once it has; on failure the old spool is left as it was. The caller
+// must hold sp.mutex or own sp exclusively.
+func (sp *Spooled) cut(n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	rest := make([]byte, sp.spooled-n)
+	if _, err := sp.spool.ReadAt(rest, spoolHeaderSize+n); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	tmp, err := os.Create(sp.spoolPath + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err := writeSpoolHeader(tmp, sp.start+n); err == nil {
+		_, err = tmp.WriteAt(rest, spoolHeaderSize)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), sp.spoolPath)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	sp.spool.Close()
+	sp.spool = tmp
+	sp.start += n
+	sp.spooled -= n
+	return nil
+}
+
+// writeSpoolHeader writes the header of a spool file starting at offset
+// start of the object.
+func writeSpoolHeader(f *os.File, start int64) error {
+	var header [spoolHeaderSize]byte
+	binary.BigEndian.PutUint64(header[:], uint64(start))
+	_, err := f.WriteAt(header[:], 0)
+	return err
+}
+
+func (sp *Spooled) readHeader() error {
+	info, err := sp.spool.Stat()
+	if err != nil {
+		return err
+	}
+	var header [spoolHeaderSize]byte
+	if _, err := sp.spool.ReadAt(header[:], 0); err != nil {
+		return fmt.Errorf("reading spool file header: %w", err)
+	}
+	sp.start = int64(binary.BigEndian.Uint64(header[:]))
+	sp.spooled = info.Size() - spoolHeaderSize
+	return nil
+}
@@ -0,0 +1,135 @@
+// Package storage stores the recordings made by the Go servers in this
+// repository. A Sink is where finished recording files end up: a local
+// directory, or a bucket of an S3-compatible object store.
+//
+// File names are slash-separated relative paths such as
+// "2024/05/output-1234-1.webm". Each sink maps them onto its own namespace.
+//
+// Like package signaling, the package does not depend on pion/webrtc.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Sink stores recording files.
+type Sink interface {
+	// Create starts the file name, replacing any file of the same name. The
+	// file is complete once the returned Writer has been closed.
+	Create(name string) (Writer, error)
+	// String describes where the sink stores files, for logs.
+	String() string
+}
+
+// Writer writes one file to a Sink.
+type Writer interface {
+	io.WriteCloser
+	// Abort discards what was written instead of completing the file.
+	Abort() error
+}
+
+// ErrInvalidName is returned for file names that are absolute or leave the
+// sink's namespace.
+var ErrInvalidName = errors.New("invalid file name")
+
+// CleanName checks that name is a relative path inside the sink and returns
+// it cleaned.
+func CleanName(name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%w %q", ErrInvalidName, name)
+	}
+	return clean, nil
+}
+
+// Local stores files in a directory, creating subdirectories as needed.
+type Local struct {
+	Dir string
+}
+
+// NewLocal returns a sink storing files in dir.
+func NewLocal(dir string) *Local {
+	return &Local{Dir: dir}
+}
+
+func (l *Local) String() string {
+	return l.Dir
+}
+
+// Path returns where the file name is stored.
+func (l *Local) Path(name string) (string, error) {
+	clean, err := CleanName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(clean)), nil
+}
+
+func (l *Local) Create(name string) (Writer, error) {
+	path, err := l.Path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{File: file}, nil
+}
+
+// localWriter is a file being written to a Local sink.
+type localWriter struct {
+	*os.File
+}
+
+func (w *localWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.File.Name())
+}
+
+// Store moves the local file at path into sink as name. A Local sink renames
+// the file when it can; otherwise it is copied, and removed once the copy is
+// complete.
+func Store(sink Sink, path, name string) error {
+	if local, ok := sink.(*Local); ok {
+		target, err := local.Path(name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if os.Rename(path, target) == nil {
+			return nil
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w, err := sink.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(path)
+}
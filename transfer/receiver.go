@@ -0,0 +1,140 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Receiver writes the chunks of a single transfer to an io.Writer in order
+// and checks the result against the sender's manifest.
+type Receiver struct {
+	w    io.Writer
+	hash hash.Hash
+
+	nextSeq uint32
+	size    uint64
+	done    bool
+}
+
+// NewReceiver returns a Receiver that writes to w.
+func NewReceiver(w io.Writer) *Receiver {
+	return &Receiver{
+		w:    w,
+		hash: sha256.New(),
+	}
+}
+
+// ResumeReceiver returns a Receiver that continues a transfer whose first
+// nextSeq chunks have already been written. The bytes written so far are
+// read from written to restore the running checksum; new chunks go to w.
+func ResumeReceiver(w io.Writer, written io.Reader, nextSeq uint32) (*Receiver, error) {
+	r := NewReceiver(w)
+	n, err := io.Copy(r.hash, written)
+	if err != nil {
+		return nil, err
+	}
+	r.size = uint64(n)
+	r.nextSeq = nextSeq
+	return r, nil
+}
+
+// RestoreReceiver returns a Receiver that continues a transfer from the
+// checksum state saved by ChecksumState, for when the bytes written so far
+// cannot be read back. New chunks go to w.
+func RestoreReceiver(w io.Writer, nextSeq uint32, size uint64, checksumState []byte) (*Receiver, error) {
+	r := NewReceiver(w)
+	if err := r.hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(checksumState); err != nil {
+		return nil, fmt.Errorf("invalid checksum state: %w", err)
+	}
+	r.size = size
+	r.nextSeq = nextSeq
+	return r, nil
+}
+
+// ChecksumState returns the state of the running checksum, for
+// RestoreReceiver.
+func (r *Receiver) ChecksumState() ([]byte, error) {
+	return r.hash.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+// NextSeq returns the sequence number of the next chunk expected.
+func (r *Receiver) NextSeq() uint32 {
+	return r.nextSeq
+}
+
+// Size returns the number of bytes written so far.
+func (r *Receiver) Size() uint64 {
+	return r.size
+}
+
+// Complete reports whether a manifest has been verified.
+func (r *Receiver) Complete() bool {
+	return r.done
+}
+
+// HandleChunk verifies a binary frame, writes its payload and returns the
+// reply for the sender: an ack for a written or duplicate chunk, or a nack
+// naming the next expected sequence number. A non-nil error means the
+// payload could not be written and the transfer cannot continue.
+func (r *Receiver) HandleChunk(frame []byte) (Control, error) {
+	if r.done {
+		return Control{Type: TypeFailed, Reason: "transfer already finished"}, nil
+	}
+
+	chunk, err := ParseChunk(frame)
+	if err != nil {
+		return r.nack(err.Error()), nil
+	}
+
+	switch {
+	case chunk.Seq < r.nextSeq:
+		// A retransmission of something already written.
+		return Control{Type: TypeAck, Seq: r.nextSeq - 1, Offset: r.size}, nil
+	case chunk.Seq > r.nextSeq:
+		return r.nack(fmt.Sprintf("expected chunk %d, got %d", r.nextSeq, chunk.Seq)), nil
+	case chunk.Offset != r.size:
+		return r.nack(fmt.Sprintf("expected offset %d, got %d", r.size, chunk.Offset)), nil
+	case !chunk.Valid():
+		return r.nack(fmt.Sprintf("checksum mismatch in chunk %d", chunk.Seq)), nil
+	}
+
+	if _, err := r.w.Write(chunk.Data); err != nil {
+		return Control{}, err
+	}
+	r.hash.Write(chunk.Data)
+	r.size += uint64(len(chunk.Data))
+	r.nextSeq++
+
+	return Control{Type: TypeAck, Seq: chunk.Seq, Offset: r.size}, nil
+}
+
+// HandleManifest compares the sender's manifest with what was written and
+// returns either a complete or a failed reply.
+func (r *Receiver) HandleManifest(manifest Control) Control {
+	sum := hex.EncodeToString(r.hash.Sum(nil))
+
+	var reason string
+	switch {
+	case manifest.Chunks != r.nextSeq:
+		reason = fmt.Sprintf("expected %d chunks, received %d", manifest.Chunks, r.nextSeq)
+	case manifest.Size != r.size:
+		reason = fmt.Sprintf("expected %d bytes, received %d", manifest.Size, r.size)
+	case manifest.SHA256 != sum:
+		reason = "sha256 mismatch"
+	}
+
+	if reason != "" {
+		return Control{Type: TypeFailed, Chunks: r.nextSeq, Size: r.size, SHA256: sum, Reason: reason}
+	}
+
+	r.done = true
+	return Control{Type: TypeComplete, Chunks: r.nextSeq, Size: r.size, SHA256: sum}
+}
+
+func (r *Receiver) nack(reason string) Control {
+	return Control{Type: TypeNack, Seq: r.nextSeq, Offset: r.size, Reason: reason}
+}
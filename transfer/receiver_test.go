@@ -0,0 +1,268 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// chunks splits data into frames of at most size bytes.
+func chunks(data []byte, size int) []Chunk {
+	var list []Chunk
+	for offset := 0; offset < len(data); offset += size {
+		end := offset + size
+		if end > len(data) {
+			end = len(data)
+		}
+		list = append(list, NewChunk(uint32(len(list)), uint64(offset), data[offset:end]))
+	}
+	return list
+}
+
+func manifest(data []byte, chunkCount int) Control {
+	sum := sha256.Sum256(data)
+	return Control{
+		Type:   TypeManifest,
+		Chunks: uint32(chunkCount),
+		Size:   uint64(len(data)),
+		SHA256: hex.EncodeToString(sum[:]),
+	}
+}
+
+func TestReceiverChunks(t *testing.T) {
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	c := chunks(data, 10)
+	corrupt := c[1]
+	corrupt.Data = []byte("XXXXXXXXXX")
+
+	type step struct {
+		frame      []byte
+		wantType   string
+		wantSeq    uint32
+		wantOffset uint64
+	}
+	tests := []struct {
+		name    string
+		steps   []step
+		written string
+	}{
+		{
+			name: "in order",
+			steps: []step{
+				{c[0].Marshal(), TypeAck, 0, 10},
+				{c[1].Marshal(), TypeAck, 1, 20},
+				{c[2].Marshal(), TypeAck, 2, 30},
+				{c[3].Marshal(), TypeAck, 3, 36},
+			},
+			written: string(data),
+		},
+		{
+			name: "out of order",
+			steps: []step{
+				{c[0].Marshal(), TypeAck, 0, 10},
+				{c[2].Marshal(), TypeNack, 1, 10},
+				{c[3].Marshal(), TypeNack, 1, 10},
+				{c[1].Marshal(), TypeAck, 1, 20},
+				{c[2].Marshal(), TypeAck, 2, 30},
+			},
+			written: string(data[:30]),
+		},
+		{
+			name: "duplicate",
+			steps: []step{
+				{c[0].Marshal(), TypeAck, 0, 10},
+				{c[1].Marshal(), TypeAck, 1, 20},
+				{c[0].Marshal(), TypeAck, 1, 20},
+				{c[1].Marshal(), TypeAck, 1, 20},
+				{c[2].Marshal(), TypeAck, 2, 30},
+			},
+			written: string(data[:30]),
+		},
+		{
+			name: "corrupt CRC",
+			steps: []step{
+				{c[0].Marshal(), TypeAck, 0, 10},
+				{corrupt.Marshal(), TypeNack, 1, 10},
+				{c[1].Marshal(), TypeAck, 1, 20},
+			},
+			written: string(data[:20]),
+		},
+		{
+			name: "wrong offset",
+			steps: []step{
+				{c[0].Marshal(), TypeAck, 0, 10},
+				{NewChunk(1, 11, c[1].Data).Marshal(), TypeNack, 1, 10},
+			},
+			written: string(data[:10]),
+		},
+		{
+			name: "short frame",
+			steps: []step{
+				{make([]byte, HeaderSize-1), TypeNack, 0, 0},
+				{c[0].Marshal(), TypeAck, 0, 10},
+			},
+			written: string(data[:10]),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var written bytes.Buffer
+			r := NewReceiver(&written)
+			for i, s := range tt.steps {
+				reply, err := r.HandleChunk(s.frame)
+				if err != nil {
+					t.Fatalf("step %d: HandleChunk: %v", i, err)
+				}
+				if reply.Type != s.wantType || reply.Seq != s.wantSeq || reply.Offset != s.wantOffset {
+					t.Errorf("step %d: reply %s seq %d offset %d, want %s seq %d offset %d",
+						i, reply.Type, reply.Seq, reply.Offset, s.wantType, s.wantSeq, s.wantOffset)
+				}
+			}
+			if written.String() != tt.written {
+				t.Errorf("wrote %q, want %q", written.String(), tt.written)
+			}
+		})
+	}
+}
+
+func TestReceiverManifest(t *testing.T) {
+	data := bytes.Repeat([]byte("recording "), 100)
+	c := chunks(data, 64)
+	good := manifest(data, len(c))
+
+	tests := []struct {
+		name     string
+		manifest func(Control) Control
+		wantType string
+	}{
+		{"match", func(m Control) Control { return m }, TypeComplete},
+		{"chunk count", func(m Control) Control { m.Chunks++; return m }, TypeFailed},
+		{"size", func(m Control) Control { m.Size--; return m }, TypeFailed},
+		{"sha256", func(m Control) Control { m.SHA256 = hex.EncodeToString(make([]byte, 32)); return m }, TypeFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReceiver(&bytes.Buffer{})
+			for _, chunk := range c {
+				if _, err := r.HandleChunk(chunk.Marshal()); err != nil {
+					t.Fatalf("HandleChunk: %v", err)
+				}
+			}
+
+			reply := r.HandleManifest(tt.manifest(good))
+			if reply.Type != tt.wantType {
+				t.Fatalf("reply %s (%s), want %s", reply.Type, reply.Reason, tt.wantType)
+			}
+			if reply.Chunks != good.Chunks || reply.Size != good.Size || reply.SHA256 != good.SHA256 {
+				t.Errorf("reply reports %d chunks, %d bytes, %s; received %d, %d, %s",
+					reply.Chunks, reply.Size, reply.SHA256, good.Chunks, good.Size, good.SHA256)
+			}
+			if r.Complete() != (tt.wantType == TypeComplete) {
+				t.Errorf("Complete() = %t", r.Complete())
+			}
+		})
+	}
+}
+
+func TestReceiverAfterComplete(t *testing.T) {
+	data := []byte("done")
+	r := NewReceiver(&bytes.Buffer{})
+	if _, err := r.HandleChunk(NewChunk(0, 0, data).Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if reply := r.HandleManifest(manifest(data, 1)); reply.Type != TypeComplete {
+		t.Fatalf("manifest: %s (%s)", reply.Type, reply.Reason)
+	}
+
+	reply, err := r.HandleChunk(NewChunk(1, 4, data).Marshal())
+	if err != nil || reply.Type != TypeFailed {
+		t.Errorf("chunk after completion: %s, %v; want %s", reply.Type, err, TypeFailed)
+	}
+}
+
+var errDiskFull = errors.New("disk full")
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errDiskFull
+}
+
+func TestReceiverWriteError(t *testing.T) {
+	r := NewReceiver(failingWriter{})
+	if _, err := r.HandleChunk(NewChunk(0, 0, []byte("x")).Marshal()); !errors.Is(err, errDiskFull) {
+		t.Fatalf("HandleChunk error = %v, want %v", err, errDiskFull)
+	}
+	if r.NextSeq() != 0 || r.Size() != 0 {
+		t.Errorf("receiver advanced to chunk %d, offset %d after a failed write", r.NextSeq(), r.Size())
+	}
+}
+
+func TestReceiverResume(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 20)
+	c := chunks(data, 32)
+	const sent = 3
+
+	// first receives the first chunks before the connection drops.
+	var file bytes.Buffer
+	first := NewReceiver(&file)
+	for _, chunk := range c[:sent] {
+		if _, err := first.HandleChunk(chunk.Marshal()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checksum, err := first.ChecksumState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		resume func(w *bytes.Buffer) (*Receiver, error)
+	}{
+		{"read back", func(w *bytes.Buffer) (*Receiver, error) {
+			return ResumeReceiver(w, bytes.NewReader(file.Bytes()), first.NextSeq())
+		}},
+		{"restored checksum", func(w *bytes.Buffer) (*Receiver, error) {
+			return RestoreReceiver(w, first.NextSeq(), first.Size(), checksum)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rest := &bytes.Buffer{}
+			r, err := tt.resume(rest)
+			if err != nil {
+				t.Fatalf("resuming: %v", err)
+			}
+			if r.NextSeq() != sent || r.Size() != first.Size() {
+				t.Fatalf("resumed at chunk %d, offset %d; want %d, %d", r.NextSeq(), r.Size(), sent, first.Size())
+			}
+
+			// A chunk acknowledged before the drop is only acknowledged
+			// again.
+			if reply, err := r.HandleChunk(c[sent-1].Marshal()); err != nil || reply.Type != TypeAck {
+				t.Fatalf("retransmitted chunk: %s, %v", reply.Type, err)
+			}
+			for _, chunk := range c[sent:] {
+				if reply, err := r.HandleChunk(chunk.Marshal()); err != nil || reply.Type != TypeAck {
+					t.Fatalf("chunk %d: %s (%s), %v", chunk.Seq, reply.Type, reply.Reason, err)
+				}
+			}
+
+			if reply := r.HandleManifest(manifest(data, len(c))); reply.Type != TypeComplete {
+				t.Fatalf("manifest: %s (%s)", reply.Type, reply.Reason)
+			}
+			if got := append(append([]byte(nil), file.Bytes()...), rest.Bytes()...); !bytes.Equal(got, data) {
+				t.Errorf("resumed file differs from the original")
+			}
+		})
+	}
+}
+
+func TestRestoreReceiverInvalidState(t *testing.T) {
+	if _, err := RestoreReceiver(&bytes.Buffer{}, 1, 10, []byte("not a checksum")); err == nil {
+		t.Error("RestoreReceiver accepted an invalid checksum state")
+	}
+}
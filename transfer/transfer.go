@@ -0,0 +1,129 @@
+// Package transfer implements the framing protocol used to upload a
+// recording from the browser over a WebRTC data channel.
+//
+// The sender starts a transfer with a "begin" control message, which the
+// receiver answers with "ready", then sends the file as binary chunk frames
+// and finishes with a "manifest". Every frame
+// carries a sequence number, the byte offset of its payload within the file
+// and a CRC-32 of the payload:
+//
+//	0       4       8               16
+//	+-------+-------+---------------+------------
+//	|  seq  | crc32 |    offset     |  payload...
+//	+-------+-------+---------------+------------
+//
+// All header fields are big endian. The receiver acknowledges each chunk it
+// writes and answers a bad or out-of-order chunk with a "nack" naming the
+// sequence number it expects next, from which the sender retransmits. The
+// manifest carries the chunk count, total size and SHA-256 of the whole file;
+// the receiver answers with "complete" when they match what it wrote and
+// "failed" otherwise.
+//
+// A transfer can be resumed on a new channel: a "begin" naming a recording
+// ID the receiver already holds part of is answered with a "ready" carrying
+// the sequence number and offset to continue from.
+//
+// Control messages are JSON text messages on the same channel.
+package transfer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// HeaderSize is the length of the chunk frame header.
+const HeaderSize = 16
+
+// Control message types.
+const (
+	TypeBegin    = "begin"
+	TypeReady    = "ready"
+	TypeAck      = "ack"
+	TypeNack     = "nack"
+	TypeManifest = "manifest"
+	TypeComplete = "complete"
+	TypeFailed   = "failed"
+)
+
+var errShortFrame = errors.New("transfer: frame shorter than header")
+
+// Chunk is one binary frame of a transfer.
+type Chunk struct {
+	Seq      uint32
+	Checksum uint32
+	Offset   uint64
+	Data     []byte
+}
+
+// NewChunk returns a chunk for data with its checksum filled in.
+func NewChunk(seq uint32, offset uint64, data []byte) Chunk {
+	return Chunk{
+		Seq:      seq,
+		Checksum: crc32.ChecksumIEEE(data),
+		Offset:   offset,
+		Data:     data,
+	}
+}
+
+// ParseChunk decodes a binary frame. The payload aliases frame.
+func ParseChunk(frame []byte) (Chunk, error) {
+	if len(frame) < HeaderSize {
+		return Chunk{}, errShortFrame
+	}
+	return Chunk{
+		Seq:      binary.BigEndian.Uint32(frame[0:4]),
+		Checksum: binary.BigEndian.Uint32(frame[4:8]),
+		Offset:   binary.BigEndian.Uint64(frame[8:16]),
+		Data:     frame[HeaderSize:],
+	}, nil
+}
+
+// Marshal encodes the chunk as a binary frame.
+func (c Chunk) Marshal() []byte {
+	frame := make([]byte, HeaderSize+len(c.Data))
+	binary.BigEndian.PutUint32(frame[0:4], c.Seq)
+	binary.BigEndian.PutUint32(frame[4:8], c.Checksum)
+	binary.BigEndian.PutUint64(frame[8:16], c.Offset)
+	copy(frame[HeaderSize:], c.Data)
+	return frame
+}
+
+// Valid reports whether the payload matches the checksum.
+func (c Chunk) Valid() bool {
+	return crc32.ChecksumIEEE(c.Data) == c.Checksum
+}
+
+// Control is a JSON control message. Only the fields relevant to Type are
+// set.
+type Control struct {
+	Type        string `json:"type"`
+	RecordingID string `json:"recordingId,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+	Seq         uint32 `json:"seq"`
+	Offset      uint64 `json:"offset"`
+	Chunks      uint32 `json:"chunks,omitempty"`
+	Size        uint64 `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// ParseControl decodes a JSON control message.
+func ParseControl(data []byte) (Control, error) {
+	var c Control
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Control{}, fmt.Errorf("transfer: malformed control message: %w", err)
+	}
+	if c.Type == "" {
+		return Control{}, errors.New("transfer: control message has no type")
+	}
+	return c, nil
+}
+
+// Marshal encodes the control message as JSON.
+func (c Control) Marshal() []byte {
+	data, _ := json.Marshal(c)
+	return data
+}
@@ -0,0 +1,118 @@
+package transfer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		seq    uint32
+		offset uint64
+		data   []byte
+	}{
+		{"empty", 0, 0, nil},
+		{"small", 1, 16384, []byte("hello")},
+		{"max header values", 0xffffffff, 0xffffffffffffffff, bytes.Repeat([]byte{0xab}, 16384)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunk := NewChunk(tt.seq, tt.offset, tt.data)
+			frame := chunk.Marshal()
+			if len(frame) != HeaderSize+len(tt.data) {
+				t.Fatalf("frame is %d bytes, want %d", len(frame), HeaderSize+len(tt.data))
+			}
+
+			parsed, err := ParseChunk(frame)
+			if err != nil {
+				t.Fatalf("ParseChunk: %v", err)
+			}
+			if parsed.Seq != tt.seq || parsed.Offset != tt.offset || parsed.Checksum != chunk.Checksum {
+				t.Errorf("header = %d/%d/%08x, want %d/%d/%08x",
+					parsed.Seq, parsed.Offset, parsed.Checksum, tt.seq, tt.offset, chunk.Checksum)
+			}
+			if !bytes.Equal(parsed.Data, tt.data) {
+				t.Errorf("payload does not round-trip")
+			}
+			if !parsed.Valid() {
+				t.Errorf("round-tripped chunk is not valid")
+			}
+		})
+	}
+}
+
+func TestParseChunkShortFrame(t *testing.T) {
+	for n := 0; n < HeaderSize; n++ {
+		if _, err := ParseChunk(make([]byte, n)); err == nil {
+			t.Errorf("ParseChunk accepted a %d byte frame", n)
+		}
+	}
+}
+
+func TestChunkCorruption(t *testing.T) {
+	frame := NewChunk(3, 100, []byte("payload")).Marshal()
+
+	tests := []struct {
+		name    string
+		corrupt func([]byte)
+	}{
+		{"payload bit flip", func(f []byte) { f[HeaderSize] ^= 0x01 }},
+		{"checksum bit flip", func(f []byte) { f[4] ^= 0x80 }},
+		{"last payload byte", func(f []byte) { f[len(f)-1]++ }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corrupt := append([]byte(nil), frame...)
+			tt.corrupt(corrupt)
+			chunk, err := ParseChunk(corrupt)
+			if err != nil {
+				t.Fatalf("ParseChunk: %v", err)
+			}
+			if chunk.Valid() {
+				t.Errorf("corrupt chunk is valid")
+			}
+		})
+	}
+}
+
+func TestControlRoundTrip(t *testing.T) {
+	tests := []Control{
+		{Type: TypeBegin, RecordingID: "rec-1", MimeType: "video/webm"},
+		{Type: TypeReady, RecordingID: "rec-1", Seq: 7, Offset: 114688},
+		{Type: TypeAck, Seq: 0, Offset: 16384},
+		{Type: TypeNack, Seq: 2, Offset: 32768, Reason: "checksum mismatch in chunk 2"},
+		{Type: TypeManifest, Chunks: 3, Size: 40000, SHA256: "abcd"},
+		{Type: TypeFailed, Reason: "not recording"},
+	}
+	for _, want := range tests {
+		t.Run(want.Type, func(t *testing.T) {
+			got, err := ParseControl(want.Marshal())
+			if err != nil {
+				t.Fatalf("ParseControl: %v", err)
+			}
+			if got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseControlErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not JSON", "begin"},
+		{"no type", `{"seq": 1}`},
+		{"empty type", `{"type": ""}`},
+		{"wrong field type", `{"type": "ack", "seq": "one"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseControl([]byte(tt.data)); err == nil {
+				t.Errorf("ParseControl(%s) succeeded", tt.data)
+			}
+		})
+	}
+}
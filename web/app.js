@@ -10,7 +10,40 @@ let mediaRecorder
 let isMuted = false
 let isVideoStopped = false
 let isDataChannelOpen = false
-let chunkQueue = []
+let upload = null
+let pendingCandidates = []
+// STUN/TURN servers, as configured on the server
+let iceServers = []
+let reconnectTimer = null
+let signalingTimer = null
+// The server's ID for this call, used to pick it up again if only the
+// WebSocket drops, and the token that proves the call is ours
+let sessionId = null
+let reconnectToken = null
+// Perfect negotiation: the browser is the polite peer, so when its offer
+// crosses one from the server it rolls back and answers the server's
+let makingOffer = false
+// Set once the server has refused the session for good, for a bad token or
+// at the end of its time limit, so that the page stops reconnecting
+let refused = false
+
+// Must match signaling.Version on the Go side.
+const SIGNALING_VERSION = 1
+const RECONNECT_DELAY = 2000
+// Joining a room (?room=name) turns the server into an SFU: every other
+// participant in the room shows up as a tile in #videos
+const room = new URLSearchParams(window.location.search).get("room")
+// Servers that require a token get it from ?token=, sent as the first
+// message rather than in the WebSocket URL to keep it out of access logs
+const authToken = new URLSearchParams(window.location.search).get("token")
+
+function sendSignal(message) {
+  if (!ws || ws.readyState !== WebSocket.OPEN) {
+    console.warn(`Signaling is down, dropping ${message.type} message`)
+    return
+  }
+  ws.send(JSON.stringify({ version: SIGNALING_VERSION, ...message }))
+}
 
 async function joinSession() {
   console.log("Joining session...")
@@ -24,14 +57,75 @@ async function joinSession() {
   document.getElementById("join-screen").style.display = "none"
   document.getElementById("participant-view").style.display = "block"
 
-  peerConnection = new RTCPeerConnection({
-    iceServers: [{ urls: "stun:stun.l.google.com:19302" }]
-  })
+  try {
+    localStream = await navigator.mediaDevices.getUserMedia({
+      video: {
+        width: { ideal: 1280 },
+        height: { ideal: 720 },
+        frameRate: { ideal: 30 },
+        aspectRatio: 16 / 9
+      },
+      audio: true
+    })
+    console.log("Local media stream obtained")
+  } catch (err) {
+    console.error("Error getting user media:", err)
+    return
+  }
+
+  iceServers = await fetchIceServers()
+
+  const localVideo = document.createElement("video")
+  localVideo.srcObject = localStream
+  localVideo.autoplay = true
+  localVideo.muted = true
+  document.getElementById("videos").appendChild(localVideo)
+  console.log("Local video element created and added to DOM")
+
+  startMediaRecorder()
+  connect()
+}
+
+// fetchIceServers asks the server for its STUN and TURN servers, so that
+// both ends of the call gather candidates from the same ones
+async function fetchIceServers() {
+  try {
+    // The list may hold TURN credentials, so it takes the same token as
+    // the WebSocket
+    const headers = authToken ? { Authorization: `Bearer ${authToken}` } : {}
+    const response = await fetch("/api/ice-servers", { headers })
+    if (!response.ok) {
+      throw new Error(`HTTP ${response.status}`)
+    }
+    const config = await response.json()
+    console.log(`Using ${config.iceServers.length} ICE servers`)
+    return config.iceServers
+  } catch (err) {
+    console.error("Failed to fetch ICE servers, using host candidates only:", err)
+    return []
+  }
+}
+
+// connect opens the signaling WebSocket, PeerConnection and data channel. It
+// runs again after a disconnect; the recording keeps going meanwhile and the
+// upload resumes from wherever the server got to.
+function connect() {
+  reconnectTimer = null
+  sessionId = null
+  reconnectToken = null
+  pendingCandidates = []
+  makingOffer = false
+  if (upload) {
+    // The new session has to start the take again before accepting data
+    upload.started = false
+  }
+
+  peerConnection = new RTCPeerConnection({ iceServers })
   console.log("RTCPeerConnection created")
 
-  dataChannel = peerConnection.createDataChannel("videoChannel", { 
-    ordered: true,
-    maxRetransmits: 3
+  // Reliable and ordered: the transfer protocol relies on every chunk arriving
+  dataChannel = peerConnection.createDataChannel("videoChannel", {
+    ordered: true
   })
   dataChannel.binaryType = "arraybuffer"
   console.log("Data channel created")
@@ -39,110 +133,70 @@ async function joinSession() {
   dataChannel.onopen = () => {
     console.log("Data channel opened")
     isDataChannelOpen = true
-    sendQueuedChunks()
+    if (upload && upload.started) {
+      sendBegin(upload)
+    }
   }
 
+  dataChannel.onmessage = (event) => handleTransferMessage(JSON.parse(event.data))
+
   dataChannel.onclose = () => {
     console.log("Data channel closed")
-    isDataChannelOpen = false
+    dataChannelLost()
   }
 
   dataChannel.onerror = (error) => {
     console.error("Data channel error:", error)
-    isDataChannelOpen = false
+    dataChannelLost()
   }
 
-  // ws = new WebSocket(`ws://${window.location.host}/ws`)
-  ws = new WebSocket(`ws://localhost:8080/ws`)
-
-  ws.onopen = async () => {
-    console.log("WebSocket connection opened")
+  openSignaling(async () => {
     try {
-      localStream = await navigator.mediaDevices.getUserMedia({
-        video: {
-          width: { ideal: 1280 },
-          height: { ideal: 720 },
-          frameRate: { ideal: 30 },
-          aspectRatio: 16 / 9
-        },
-        audio: true
-      })
-      console.log("Local media stream obtained")
-
-      const localVideo = document.createElement("video")
-      localVideo.srcObject = localStream
-      localVideo.autoplay = true
-      localVideo.muted = true
-      document.getElementById("videos").appendChild(localVideo)
-      console.log("Local video element created and added to DOM")
-
-      mediaRecorder = new MediaRecorder(localStream, {
-        mimeType: 'video/webm;codecs=vp8,opus',
-        videoBitsPerSecond: 1000000 // 1 Mbps
-      })
-      console.log("MediaRecorder created")
-
-      mediaRecorder.ondataavailable = (event) => {
-        if (event.data.size > 0) {
-          const chunk = event.data
-          if (isDataChannelOpen) {
-            sendVideoChunk(chunk)
-          } else {
-            chunkQueue.push(chunk)
-            if (chunkQueue.length > 100) {
-              chunkQueue.shift() // Remove oldest chunk if queue gets too large
-            }
-          }
-        }
+      if (upload && !upload.stopped) {
+        sendSignal({ type: "resume-upload", recordingId: upload.recordingId })
+        sendSignal({ type: "start-recording", recordingId: upload.recordingId })
       }
 
-      mediaRecorder.start(100) // Start recording and send data every 100ms
-      console.log("MediaRecorder started")
-
       localStream.getTracks().forEach(track => peerConnection.addTrack(track, localStream))
 
-      const offer = await peerConnection.createOffer()
-      await peerConnection.setLocalDescription(offer)
-      console.log("Local description set")
+      // negotiationneeded fired for the data channel before the socket was
+      // open, so the first offer is sent from here
+      await negotiate()
 
-      ws.send(JSON.stringify({ type: "offer", sdp: offer.sdp }))
-      console.log("Offer sent through WebSocket")
+      if (room) {
+        sendSignal({ type: "join", room })
+      }
     } catch (err) {
       console.error("Error during WebRTC setup:", err)
     }
-  }
+  })
 
-  ws.onmessage = async (message) => {
-    const data = JSON.parse(message.data)
-    console.log("Received message:", data.type)
-    try {
-      if (data.type === "answer") {
-        await peerConnection.setRemoteDescription(
-          new RTCSessionDescription(data)
-        )
-        console.log("Remote description set")
-      } else if (data.type === "candidate") {
-        if (data.candidate) {
-          await peerConnection.addIceCandidate(
-            new RTCIceCandidate(data.candidate)
-          )
-          console.log("ICE candidate added")
-        }
+  peerConnection.onnegotiationneeded = negotiate
+
+  // Forwarded tracks carry the publishing participant's ID as their stream ID
+  peerConnection.ontrack = (event) => {
+    const stream = event.streams[0]
+    if (!stream) {
+      return
+    }
+    addRemoteTile(stream)
+    stream.onremovetrack = () => {
+      if (stream.getTracks().length === 0) {
+        removeRemoteTile(stream.id)
       }
-    } catch (err) {
-      console.error("Error handling WebSocket message:", err)
     }
   }
 
   peerConnection.onicecandidate = (event) => {
     if (event.candidate) {
-      ws.send(
-        JSON.stringify({
-          type: "candidate",
-          candidate: event.candidate.candidate
-        })
-      )
+      sendSignal({
+        type: "candidate",
+        candidate: event.candidate.toJSON()
+      })
       console.log("ICE candidate sent")
+    } else {
+      sendSignal({ type: "end-of-candidates" })
+      console.log("End of ICE candidates sent")
     }
   }
 
@@ -157,70 +211,571 @@ async function joinSession() {
       peerConnection.iceConnectionState === "completed"
     ) {
       console.log("[STATE] WebRTC connection successfully established.")
+      // The data channel survives an ICE restart, so pick the upload up
+      // where the server got to
+      if (!isDataChannelOpen && dataChannel.readyState === "open") {
+        isDataChannelOpen = true
+        if (upload && upload.started) {
+          sendBegin(upload)
+        }
+      }
     }
 
-    if (
-      peerConnection.iceConnectionState === "failed" ||
-      peerConnection.iceConnectionState === "disconnected"
-    ) {
-      console.log("[STATE] WebRTC connection failed or disconnected.")
-      isDataChannelOpen = false
+    if (peerConnection.iceConnectionState === "disconnected") {
+      // The server keeps the session for a while, so try to recover it
+      console.log("[STATE] WebRTC connection interrupted, restarting ICE.")
+      dataChannelLost()
+      peerConnection.restartIce()
+    }
+
+    if (peerConnection.iceConnectionState === "failed") {
+      console.log("[STATE] WebRTC connection failed.")
+      dataChannelLost()
+      scheduleReconnect()
+    }
+  }
+}
+
+// openSignaling connects the WebSocket, picking up the current server
+// session again if there is one, and calls onOpen once the server has
+// confirmed the session.
+function openSignaling(onOpen) {
+  // Pages served over HTTPS must use a secure WebSocket too
+  const scheme = window.location.protocol === "https:" ? "wss" : "ws"
+  const url = `${scheme}://${window.location.host}/ws`
+  ws = new WebSocket(
+    sessionId ? `${url}?session=${sessionId}&reconnect=${reconnectToken}` : url
+  )
+
+  ws.onopen = () => {
+    console.log("WebSocket connection opened")
+    if (authToken) {
+      sendSignal({ type: "auth", token: authToken })
+    }
+  }
+
+  ws.onmessage = async (message) => {
+    const data = JSON.parse(message.data)
+    console.log("Received message:", data.type)
+    try {
+      if (data.type === "session") {
+        sessionId = data.sessionId
+        // Only the WebSocket that opened the session is sent the token
+        if (data.reconnectToken) {
+          reconnectToken = data.reconnectToken
+        }
+        console.log(`Server session ${sessionId}`)
+        // The server's own TURN relay comes with credentials for this
+        // session only, so it is added before anything is gathered
+        if (data.iceServers) {
+          peerConnection.setConfiguration({ iceServers: [...iceServers, ...data.iceServers] })
+          console.log(`Added ${data.iceServers.length} ICE servers for this session`)
+        }
+        await onOpen()
+      } else if (data.type === "answer") {
+        await peerConnection.setRemoteDescription(
+          new RTCSessionDescription({ type: "answer", sdp: data.sdp })
+        )
+        console.log("Remote description set")
+        // Candidates can overtake the answer, so apply any that were held back
+        for (const candidate of pendingCandidates.splice(0)) {
+          await peerConnection.addIceCandidate(candidate)
+        }
+      } else if (data.type === "offer") {
+        // The server renegotiates when participants' tracks come and go. If
+        // our own offer is in flight, setRemoteDescription rolls it back and
+        // negotiationneeded fires again once this exchange is done
+        if (makingOffer || peerConnection.signalingState !== "stable") {
+          console.log("Offer collision, rolling back our offer")
+        }
+        await peerConnection.setRemoteDescription(
+          new RTCSessionDescription({ type: "offer", sdp: data.sdp })
+        )
+        await peerConnection.setLocalDescription()
+        sendSignal({ type: "answer", sdp: peerConnection.localDescription.sdp })
+        console.log("Answered renegotiation offer")
+      } else if (data.type === "candidate") {
+        if (data.candidate) {
+          const candidate = new RTCIceCandidate(data.candidate)
+          if (peerConnection.remoteDescription) {
+            await peerConnection.addIceCandidate(candidate)
+            console.log("ICE candidate added")
+          } else {
+            pendingCandidates.push(candidate)
+          }
+        }
+      } else if (data.type === "end-of-candidates") {
+        console.log("Server finished gathering ICE candidates")
+      } else if (data.type === "upload-offset") {
+        if (upload && upload.recordingId === data.recordingId) {
+          console.log(`Server has ${data.offset} bytes of recording ${data.recordingId}`)
+          if (data.complete) {
+            upload.unacked.clear()
+          } else {
+            releaseChunks(upload, data.seq)
+          }
+        }
+      } else if (data.type === "recording-started") {
+        console.log(`Recording take ${data.take} into ${data.file}`)
+        if (upload && upload.recordingId === data.recordingId) {
+          upload.started = true
+          if (isDataChannelOpen) {
+            sendBegin(upload)
+          }
+        }
+      } else if (data.type === "recording-stopped") {
+        console.log(`Take ${data.take} saved as ${data.file} (${data.duration.toFixed(1)} s)`)
+      } else if (data.type === "joined") {
+        console.log(`Joined room ${data.room} as ${data.peerId}, participants:`, data.peers)
+      } else if (data.type === "peer-joined") {
+        console.log(`Participant ${data.peerId} joined`)
+      } else if (data.type === "peer-left") {
+        console.log(`Participant ${data.peerId} left`)
+        removeRemoteTile(data.peerId)
+      } else if (data.type === "error") {
+        console.error(`Server rejected message (${data.code}): ${data.message}`)
+        if (data.code === "unauthorized" || data.code === "session-expired") {
+          refused = true
+        } else if (data.code === "unknown-session") {
+          // The session ended while we were away, so start a new one
+          sessionId = null
+          reconnectToken = null
+          dataChannelLost()
+          scheduleReconnect()
+        }
+      }
+    } catch (err) {
+      console.error("Error handling WebSocket message:", err)
     }
   }
 
   ws.onclose = (event) => {
     console.log("WebSocket closed:", event)
-    isDataChannelOpen = false
+    const state = peerConnection.connectionState
+    if (sessionId && state !== "failed" && state !== "closed") {
+      // The call itself may well be fine, so only the WebSocket is reopened
+      scheduleSignalingReconnect()
+    } else {
+      dataChannelLost()
+      scheduleReconnect()
+    }
   }
 
   ws.onerror = (error) => {
     console.error("WebSocket error:", error)
-    isDataChannelOpen = false
   }
 }
 
-function sendVideoChunk(chunk) {
-  const reader = new FileReader()
-  reader.onload = function() {
-    try {
-      const chunkSize = 16384 // 16 KB chunks
-      const arrayBuffer = reader.result
-      for (let i = 0; i < arrayBuffer.byteLength; i += chunkSize) {
-        const slice = arrayBuffer.slice(i, i + chunkSize)
-        dataChannel.send(slice)
+// resumeSession runs once the WebSocket of a live session has reconnected.
+// The PeerConnection is kept, and ICE is restarted if it dropped as well.
+async function resumeSession() {
+  const state = peerConnection.iceConnectionState
+  if (state !== "connected" && state !== "completed") {
+    peerConnection.restartIce()
+    // negotiationneeded may already have fired while the socket was down
+    if (peerConnection.signalingState === "stable") {
+      await negotiate()
+    }
+  }
+}
+
+// negotiate sends an offer for the current tracks and data channels. It runs
+// for the first offer and whenever the browser's side changes mid-session.
+async function negotiate() {
+  if (!ws || ws.readyState !== WebSocket.OPEN || makingOffer) {
+    return
+  }
+  try {
+    makingOffer = true
+    await peerConnection.setLocalDescription()
+    sendSignal({ type: "offer", sdp: peerConnection.localDescription.sdp })
+    console.log("Offer sent through WebSocket")
+  } catch (err) {
+    console.error("Error creating offer:", err)
+  } finally {
+    makingOffer = false
+  }
+}
+
+function addRemoteTile(stream) {
+  if (document.getElementById(`peer-${stream.id}`)) {
+    return
+  }
+  const video = document.createElement("video")
+  video.id = `peer-${stream.id}`
+  video.className = "remote"
+  video.srcObject = stream
+  video.autoplay = true
+  video.playsInline = true
+  document.getElementById("videos").appendChild(video)
+  console.log(`Added tile for participant ${stream.id}`)
+}
+
+function removeRemoteTile(peerId) {
+  const video = document.getElementById(`peer-${peerId}`)
+  if (video) {
+    video.remove()
+    console.log(`Removed tile for participant ${peerId}`)
+  }
+}
+
+function dataChannelLost() {
+  isDataChannelOpen = false
+  if (upload) {
+    upload.paused = true
+  }
+}
+
+function scheduleSignalingReconnect() {
+  if (signalingTimer || reconnectTimer || refused) {
+    return
+  }
+  console.log(`Reconnecting signaling in ${RECONNECT_DELAY} ms...`)
+  signalingTimer = setTimeout(() => {
+    signalingTimer = null
+    openSignaling(resumeSession)
+  }, RECONNECT_DELAY)
+}
+
+function scheduleReconnect() {
+  if (reconnectTimer || refused) {
+    return
+  }
+  clearTimeout(signalingTimer)
+  signalingTimer = null
+  console.log(`Reconnecting in ${RECONNECT_DELAY} ms...`)
+  ws.onclose = null
+  ws.close()
+  peerConnection.close()
+  // The new session gets everyone's tracks again when it rejoins the room
+  document.querySelectorAll("#videos video.remote").forEach(video => video.remove())
+  reconnectTimer = setTimeout(connect, RECONNECT_DELAY)
+}
+
+// Recordings are uploaded over the data channel with the transfer protocol
+// implemented by the Go transfer package: a "begin" message, binary chunk
+// frames carrying a sequence number, CRC-32 and byte offset, and a final
+// "manifest" with the SHA-256 of the whole file. Each MediaRecorder run is
+// one take: it is announced with "start-recording" and the upload begins once
+// the server confirms. Every take has a recording ID so that the upload can be
+// resumed on a new connection after a disconnect; chunks are kept until the
+// server acknowledges them. The SHA-256 is computed as the chunks are made,
+// so the recording is never held in memory as a whole.
+const CHUNK_SIZE = 16384 // 16 KB chunks
+const CHUNK_HEADER_SIZE = 16
+
+function startMediaRecorder() {
+  mediaRecorder = new MediaRecorder(localStream, {
+    mimeType: 'video/webm;codecs=vp8,opus',
+    videoBitsPerSecond: 1000000 // 1 Mbps
+  })
+  console.log("MediaRecorder created")
+
+  upload = {
+    recordingId: newRecordingId(),
+    mimeType: mediaRecorder.mimeType,
+    nextSeq: 0,
+    offset: 0,
+    unacked: new Map(),
+    sha256: newSHA256(),
+    chain: Promise.resolve(),
+    resendFrom: -1,
+    manifest: null,
+    // Set once the server has confirmed the take
+    started: false,
+    stopped: false,
+    // Nothing is sent until the server answers "begin" with "ready"
+    paused: true
+  }
+  if (ws && ws.readyState === WebSocket.OPEN) {
+    sendSignal({ type: "start-recording", recordingId: upload.recordingId })
+  }
+
+  const current = upload
+  mediaRecorder.ondataavailable = (event) => {
+    if (event.data.size > 0) {
+      // Blobs are read asynchronously, so chain them to keep chunks in order
+      current.chain = current.chain.then(() => sendBlob(current, event.data))
+    }
+  }
+
+  mediaRecorder.onstop = () => {
+    current.chain = current.chain.then(() => sendManifest(current))
+  }
+
+  mediaRecorder.start(100) // Start recording and send data every 100ms
+  console.log("MediaRecorder started")
+}
+
+function newRecordingId() {
+  const bytes = crypto.getRandomValues(new Uint8Array(16))
+  return Array.from(bytes, b => b.toString(16).padStart(2, "0")).join("")
+}
+
+function sendBegin(current) {
+  current.paused = true
+  dataChannel.send(JSON.stringify({
+    type: "begin",
+    recordingId: current.recordingId,
+    mimeType: current.mimeType
+  }))
+}
+
+async function sendBlob(current, blob) {
+  const buffer = await blob.arrayBuffer()
+  for (let i = 0; i < buffer.byteLength; i += CHUNK_SIZE) {
+    const payload = new Uint8Array(buffer.slice(i, i + CHUNK_SIZE))
+    const frame = encodeChunk(current.nextSeq, current.offset, payload)
+    sha256Update(current.sha256, payload)
+    current.unacked.set(current.nextSeq, frame)
+    sendFrame(current, frame)
+    current.nextSeq++
+    current.offset += payload.byteLength
+  }
+}
+
+function sendManifest(current) {
+  current.manifest = JSON.stringify({
+    type: "manifest",
+    chunks: current.nextSeq,
+    size: current.offset,
+    sha256: sha256Digest(current.sha256)
+  })
+  sendFrame(current, current.manifest)
+  console.log(`Manifest ready: ${current.nextSeq} chunks, ${current.offset} bytes`)
+}
+
+// sendFrame sends now if the upload is live on an open channel. Otherwise
+// the chunk stays in unacked and goes out when the server is ready again.
+function sendFrame(current, data) {
+  if (current !== upload || current.paused || !isDataChannelOpen) {
+    return
+  }
+  try {
+    dataChannel.send(data)
+  } catch (error) {
+    console.error("Error sending data through channel:", error)
+  }
+}
+
+function encodeChunk(seq, offset, payload) {
+  const frame = new Uint8Array(CHUNK_HEADER_SIZE + payload.byteLength)
+  const view = new DataView(frame.buffer)
+  view.setUint32(0, seq)
+  view.setUint32(4, crc32(payload))
+  view.setBigUint64(8, BigInt(offset))
+  frame.set(payload, CHUNK_HEADER_SIZE)
+  return frame.buffer
+}
+
+// releaseChunks forgets chunks the server has stored.
+function releaseChunks(current, nextSeq) {
+  for (const seq of current.unacked.keys()) {
+    if (seq < nextSeq) {
+      current.unacked.delete(seq)
+    }
+  }
+}
+
+// resendFrom sends every unacknowledged chunk from seq on, in order,
+// followed by the manifest if the recording has already stopped.
+function resendFrom(current, seq) {
+  const seqs = [...current.unacked.keys()].filter(s => s >= seq)
+  seqs.sort((a, b) => a - b).forEach(s => sendFrame(current, current.unacked.get(s)))
+  if (current.manifest) {
+    sendFrame(current, current.manifest)
+  }
+}
+
+function handleTransferMessage(message) {
+  if (!upload) {
+    return
+  }
+
+  switch (message.type) {
+    case "ready":
+      console.log(`Server ready for upload at offset ${message.offset}`)
+      upload.paused = false
+      upload.resendFrom = -1
+      releaseChunks(upload, message.seq)
+      resendFrom(upload, message.seq)
+      break
+    case "ack":
+      releaseChunks(upload, message.seq + 1)
+      if (message.seq >= upload.resendFrom) {
+        upload.resendFrom = -1
+      }
+      break
+    case "nack":
+      // Go back to the chunk the server expects, once per nack
+      if (message.seq !== upload.resendFrom) {
+        console.warn(`Retransmitting from chunk ${message.seq}: ${message.reason}`)
+        upload.resendFrom = message.seq
+        resendFrom(upload, message.seq)
       }
-      console.log("Video chunk sent through data channel")
-    } catch (error) {
-      console.error("Error sending data through channel:", error)
-      chunkQueue.push(chunk)
+      break
+    case "complete":
+      console.log(`Upload verified by server: ${message.size} bytes, sha256 ${message.sha256}`)
+      finishTake(upload)
+      break
+    case "failed":
+      console.error("Upload failed:", message.reason)
+      // A failed manifest means the take cannot be completed anyway
+      if (upload.manifest) {
+        finishTake(upload)
+      }
+      break
+  }
+}
+
+const CRC32_TABLE = (() => {
+  const table = new Uint32Array(256)
+  for (let i = 0; i < 256; i++) {
+    let c = i
+    for (let k = 0; k < 8; k++) {
+      c = c & 1 ? 0xedb88320 ^ (c >>> 1) : c >>> 1
     }
+    table[i] = c
+  }
+  return table
+})()
+
+function crc32(bytes) {
+  let crc = 0xffffffff
+  for (let i = 0; i < bytes.length; i++) {
+    crc = CRC32_TABLE[(crc ^ bytes[i]) & 0xff] ^ (crc >>> 8)
   }
-  reader.readAsArrayBuffer(chunk)
+  return (crc ^ 0xffffffff) >>> 0
 }
 
-function sendQueuedChunks() {
-  while (chunkQueue.length > 0 && isDataChannelOpen) {
-    const chunk = chunkQueue.shift()
-    sendVideoChunk(chunk)
+// crypto.subtle can only hash a whole buffer at once, so uploads hash their
+// chunks with this incremental SHA-256 instead (FIPS 180-4).
+const SHA256_K = new Uint32Array([
+  0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+  0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+  0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+  0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+  0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+  0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+  0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+  0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+])
+const SHA256_W = new Uint32Array(64)
+
+function newSHA256() {
+  return {
+    state: new Uint32Array([
+      0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19
+    ]),
+    // Bytes left over until the next 64-byte block is complete
+    block: new Uint8Array(64),
+    blockLength: 0,
+    length: 0
+  }
+}
+
+function sha256Update(hash, bytes) {
+  hash.length += bytes.length
+  let i = 0
+  if (hash.blockLength > 0) {
+    i = Math.min(64 - hash.blockLength, bytes.length)
+    hash.block.set(bytes.subarray(0, i), hash.blockLength)
+    hash.blockLength += i
+    if (hash.blockLength < 64) {
+      return
+    }
+    sha256Block(hash.state, hash.block, 0)
+    hash.blockLength = 0
+  }
+  for (; i + 64 <= bytes.length; i += 64) {
+    sha256Block(hash.state, bytes, i)
   }
+  hash.block.set(bytes.subarray(i))
+  hash.blockLength = bytes.length - i
+}
+
+// sha256Digest pads the last block and returns the hash in hex. The hash
+// cannot be updated afterwards.
+function sha256Digest(hash) {
+  const tail = new Uint8Array(hash.blockLength < 56 ? 64 : 128)
+  tail.set(hash.block.subarray(0, hash.blockLength))
+  tail[hash.blockLength] = 0x80
+  new DataView(tail.buffer).setBigUint64(tail.length - 8, BigInt(hash.length) * 8n)
+  for (let i = 0; i < tail.length; i += 64) {
+    sha256Block(hash.state, tail, i)
+  }
+  return Array.from(hash.state, word => word.toString(16).padStart(8, "0")).join("")
+}
+
+function sha256Block(state, bytes, start) {
+  const w = SHA256_W
+  for (let t = 0; t < 16; t++) {
+    const j = start + 4 * t
+    w[t] = (bytes[j] << 24) | (bytes[j + 1] << 16) | (bytes[j + 2] << 8) | bytes[j + 3]
+  }
+  for (let t = 16; t < 64; t++) {
+    const x = w[t - 15]
+    const y = w[t - 2]
+    const s0 = rotr(x, 7) ^ rotr(x, 18) ^ (x >>> 3)
+    const s1 = rotr(y, 17) ^ rotr(y, 19) ^ (y >>> 10)
+    w[t] = w[t - 16] + s0 + w[t - 7] + s1
+  }
+
+  let [a, b, c, d, e, f, g, h] = state
+  for (let t = 0; t < 64; t++) {
+    const s1 = rotr(e, 6) ^ rotr(e, 11) ^ rotr(e, 25)
+    const ch = (e & f) ^ (~e & g)
+    const t1 = (h + s1 + ch + SHA256_K[t] + w[t]) | 0
+    const s0 = rotr(a, 2) ^ rotr(a, 13) ^ rotr(a, 22)
+    const maj = (a & b) ^ (a & c) ^ (b & c)
+    const t2 = (s0 + maj) | 0
+    h = g
+    g = f
+    f = e
+    e = (d + t1) | 0
+    d = c
+    c = b
+    b = a
+    a = (t1 + t2) | 0
+  }
+  state[0] += a
+  state[1] += b
+  state[2] += c
+  state[3] += d
+  state[4] += e
+  state[5] += f
+  state[6] += g
+  state[7] += h
+}
+
+function rotr(x, n) {
+  return (x >>> n) | (x << (32 - n))
+}
+
+// finishTake tells the server the take is over once its upload has been
+// verified, so the take is never cut short while chunks are in flight.
+function finishTake(current) {
+  if (current.stopped) {
+    return
+  }
+  current.stopped = true
+  sendSignal({ type: "stop-recording" })
+  console.log("Stop recording message sent")
 }
 
 function startRecording() {
   console.log("Starting recording...")
-  if (mediaRecorder && mediaRecorder.state === "paused") {
-    mediaRecorder.resume()
-    console.log("MediaRecorder resumed")
+  if (mediaRecorder && mediaRecorder.state === "inactive") {
+    startMediaRecorder()
   }
-  ws.send(JSON.stringify({ type: "start-recording" }))
-  console.log("Start recording message sent")
 }
 
 function stopRecording() {
   console.log("Stopping recording...")
   if (mediaRecorder && mediaRecorder.state === "recording") {
-    mediaRecorder.pause()
-    console.log("MediaRecorder paused")
+    // Stopping flushes the last blob and then sends the manifest; the take
+    // is stopped once the server has verified it
+    mediaRecorder.stop()
+    console.log("MediaRecorder stopped")
   }
-  ws.send(JSON.stringify({ type: "stop-recording" }))
-  console.log("Stop recording message sent")
 }